@@ -0,0 +1,370 @@
+package aptcacher
+
+// This file implements access control for clients.
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	maxVerifiedCredentials = 1000
+)
+
+// networkList is a list of networks.
+type networkList []*net.IPNet
+
+func parseNetworks(l []string) (networkList, error) {
+	var nl networkList
+	for _, s := range l {
+		if !strings.Contains(s, "/") {
+			// a single address
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nl = append(nl, n)
+	}
+	return nl, nil
+}
+
+func (nl networkList) contains(ip net.IP) bool {
+	for _, n := range nl {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// networkACL is a pair of allowed and denied networks.
+type networkACL struct {
+	allow networkList
+	deny  networkList
+}
+
+func newNetworkACL(allow, deny []string) (*networkACL, error) {
+	a, err := parseNetworks(allow)
+	if err != nil {
+		return nil, errors.Wrap(err, "allow")
+	}
+	d, err := parseNetworks(deny)
+	if err != nil {
+		return nil, errors.Wrap(err, "deny")
+	}
+	return &networkACL{a, d}, nil
+}
+
+// permits returns true if ip is not denied and is allowed.
+// If allow list is empty, all addresses are allowed.
+func (acl *networkACL) permits(ip net.IP) bool {
+	if acl.deny.contains(ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || acl.allow.contains(ip)
+}
+
+// accessControl keeps access control rules for clients.
+type accessControl struct {
+	global   *networkACL
+	mappings map[string]*networkACL
+	trusted  networkList
+
+	// union prefix -> prefixes of member mappings.
+	unions map[string][]string
+
+	// user name -> password hash in htpasswd format.
+	users  map[string]string
+	tokens []string
+
+	// credentials of administrators.
+	adminUsers  []string
+	adminTokens []string
+
+	// cache of verified credentials as bcrypt is slow.
+	verifiedLock sync.Mutex
+	verified     map[[sha256.Size]byte]bool
+}
+
+func newAccessControl(config *AccessConfig) (*accessControl, error) {
+	global, err := newNetworkACL(config.Allow, config.Deny)
+	if err != nil {
+		return nil, err
+	}
+	trusted, err := parseNetworks(config.TrustedProxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "trusted_proxies")
+	}
+	a := &accessControl{
+		global:   global,
+		mappings: make(map[string]*networkACL),
+		trusted:  trusted,
+		unions:   make(map[string][]string),
+		tokens:   config.BearerTokens,
+		verified: make(map[[sha256.Size]byte]bool),
+
+		adminUsers:  config.AdminUsers,
+		adminTokens: config.AdminTokens,
+	}
+	for prefix, mc := range config.Mapping {
+		acl, err := newNetworkACL(mc.Allow, mc.Deny)
+		if err != nil {
+			return nil, errors.Wrap(err, "mapping."+prefix)
+		}
+		a.mappings[prefix] = acl
+	}
+	if config.HtpasswdFile != "" {
+		a.users, err = readHtpasswd(config.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, user := range config.AdminUsers {
+		if _, ok := a.users[user]; !ok {
+			return nil, errors.New("unknown admin user: " + user)
+		}
+	}
+	return a, nil
+}
+
+// readHtpasswd reads an htpasswd file.
+//
+// Only bcrypt and SHA1 ({SHA}) hashes are supported.
+func readHtpasswd(fname string) (map[string]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		t := strings.SplitN(line, ":", 2)
+		if len(t) != 2 {
+			return nil, errors.New("invalid line in " + fname)
+		}
+		hash := t[1]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, errors.New("unsupported hash for user " + t[0])
+		}
+		users[t[0]] = hash
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// matchPassword returns true if password matches hash in htpasswd format.
+func matchPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		encoded := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(encoded)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// requestToken returns a token in Authorization header of r.
+//
+// The token is either a bearer token or the password of
+// basic authentication.
+func requestToken(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return auth[len("Bearer "):]
+	}
+	return ""
+}
+
+// matchToken returns true if token is one of tokens.
+func matchToken(tokens []string, token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresCredentials returns true if clients must be authenticated.
+func (a *accessControl) requiresCredentials() bool {
+	return a.users != nil || len(a.tokens) > 0
+}
+
+// authenticated returns true if r has valid credentials.
+func (a *accessControl) authenticated(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		if hash, ok := a.users[user]; ok && a.verify(user, hash, password) {
+			return true
+		}
+	}
+	token := requestToken(r)
+	return matchToken(a.tokens, token) || matchToken(a.adminTokens, token)
+}
+
+// isAdmin returns true if r has credentials of an administrator.
+func (a *accessControl) isAdmin(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok && contains(a.adminUsers, user) {
+		if hash, ok := a.users[user]; ok && a.verify(user, hash, password) {
+			return true
+		}
+	}
+	return matchToken(a.adminTokens, requestToken(r))
+}
+
+// verify is the same as matchPassword but caches successful results.
+func (a *accessControl) verify(user, hash, password string) bool {
+	key := sha256.Sum256([]byte(user + ":" + password))
+	a.verifiedLock.Lock()
+	ok := a.verified[key]
+	a.verifiedLock.Unlock()
+	if ok {
+		return true
+	}
+
+	if !matchPassword(hash, password) {
+		return false
+	}
+	a.verifiedLock.Lock()
+	if len(a.verified) >= maxVerifiedCredentials {
+		a.verified = make(map[[sha256.Size]byte]bool)
+	}
+	a.verified[key] = true
+	a.verifiedLock.Unlock()
+	return true
+}
+
+// clientIP returns the IP address of the client of r.
+//
+// If the peer is a trusted proxy, addresses in X-Forwarded-For are
+// examined from the last one, and the first untrusted address is
+// returned.
+func (a *accessControl) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !a.trusted.contains(ip) {
+		return ip
+	}
+
+	var addrs []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		addrs = append(addrs, strings.Split(h, ",")...)
+	}
+	for i := len(addrs) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(addrs[i]))
+		if fip == nil {
+			break
+		}
+		ip = fip
+		if !a.trusted.contains(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// mappingsOf returns prefixes of mappings whose rules apply to p.
+//
+// Snapshots are controlled by rules of the original prefix, and
+// API requests for a local repository by rules of the repository.
+// Requests for a union are also controlled by rules of the member
+// mappings that serve them: files of a member by the member, and
+// other files, which are generated from indices of all members,
+// by all members.
+func (a *accessControl) mappingsOf(p string) []string {
+	t := strings.SplitN(upstreamPath(p), "/", 3)
+	if t[0] == apiPrefix {
+		if len(t) == 3 && t[1] == "local" {
+			return []string{strings.SplitN(t[2], "/", 2)[0]}
+		}
+		return nil
+	}
+	members, ok := a.unions[t[0]]
+	if !ok {
+		return t[:1]
+	}
+	if len(t) == 3 && t[1] != "dists" && contains(members, t[1]) {
+		return []string{t[0], t[1]}
+	}
+	return append([]string{t[0]}, members...)
+}
+
+// check checks if r for p is permitted.
+//
+// If not permitted, it returns 401 or 403 with the reason.
+// Otherwise, it returns 200.
+func (a *accessControl) check(r *http.Request, p string, ip net.IP) (int, string) {
+	if ip == nil || !a.global.permits(ip) {
+		return http.StatusForbidden, "network"
+	}
+
+	for _, prefix := range a.mappingsOf(p) {
+		if acl, ok := a.mappings[prefix]; ok && !acl.permits(ip) {
+			return http.StatusForbidden, "network of " + prefix
+		}
+	}
+
+	// uploads carry upload tokens of local repositories in
+	// Authorization header, and are authenticated by them.
+	if isUploadRequest(r, p) || !a.requiresCredentials() {
+		return http.StatusOK, ""
+	}
+	if r.Header.Get("Authorization") == "" {
+		return http.StatusUnauthorized, "no credentials"
+	}
+	if !a.authenticated(r) {
+		return http.StatusUnauthorized, "invalid credentials"
+	}
+	return http.StatusOK, ""
+}
+
+// checkAdmin checks if r has credentials of an administrator.
+//
+// If not, it returns 401 or 403 with the reason.
+// Otherwise, it returns 200.
+func (a *accessControl) checkAdmin(r *http.Request) (int, string) {
+	if a == nil || (len(a.adminUsers) == 0 && len(a.adminTokens) == 0) {
+		return http.StatusForbidden, "no administrators"
+	}
+	if r.Header.Get("Authorization") == "" {
+		return http.StatusUnauthorized, "no credentials"
+	}
+	if a.isAdmin(r) {
+		return http.StatusOK, ""
+	}
+	if a.authenticated(r) {
+		return http.StatusForbidden, "not an administrator"
+	}
+	return http.StatusUnauthorized, "invalid credentials"
+}
@@ -0,0 +1,277 @@
+package aptcacher
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestNetworkACL(t *testing.T) {
+	t.Parallel()
+
+	acl, err := newNetworkACL([]string{"10.0.0.0/8", "192.168.0.1", "fd00::/8"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	permitted := map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.0.1":    false,
+		"192.168.0.1": true,
+		"192.168.0.2": false,
+		"fd00::1":     true,
+		"fe80::1":     false,
+	}
+	for addr, expected := range permitted {
+		if acl.permits(net.ParseIP(addr)) != expected {
+			t.Error(`acl.permits(` + addr + `) is wrong`)
+		}
+	}
+
+	acl, err = newNetworkACL(nil, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acl.permits(net.ParseIP("172.16.0.1")) {
+		t.Error(`empty allow list must permit all`)
+	}
+
+	_, err = newNetworkACL([]string{"10.0.0.0/33"}, nil)
+	if err == nil {
+		t.Error(`invalid network must be an error`)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+
+	a, err := newAccessControl(&AccessConfig{
+		TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "/ubuntu/dists/trusty/Release", nil)
+	r.RemoteAddr = "192.168.0.1:12345"
+	r.Header.Set("X-Forwarded-For", "172.16.0.1")
+	if ip := a.clientIP(r); ip.String() != "192.168.0.1" {
+		t.Error(`X-Forwarded-For from untrusted peers must be ignored`)
+	}
+
+	r.RemoteAddr = "127.0.0.1:12345"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 172.16.0.1, 10.0.0.1")
+	if ip := a.clientIP(r); ip.String() != "172.16.0.1" {
+		t.Error(`the last untrusted address must be the client`, ip)
+	}
+
+	r.Header.Del("X-Forwarded-For")
+	if ip := a.clientIP(r); ip.String() != "127.0.0.1" {
+		t.Error(`the peer must be the client without X-Forwarded-For`)
+	}
+}
+
+func TestMatchPassword(t *testing.T) {
+	t.Parallel()
+
+	// htpasswd -nbs user password
+	if !matchPassword("{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password") {
+		t.Error(`{SHA} password does not match`)
+	}
+	if matchPassword("{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "wrong") {
+		t.Error(`wrong {SHA} password matches`)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matchPassword(string(hash), "password") {
+		t.Error(`bcrypt password does not match`)
+	}
+	if matchPassword(string(hash), "wrong") {
+		t.Error(`wrong bcrypt password matches`)
+	}
+}
+
+func TestAccessCheck(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(dir, "htpasswd")
+	data := "# comment\nuser:" + string(hash) + "\n"
+	if err := ioutil.WriteFile(htpasswd, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newAccessControl(&AccessConfig{
+		Allow: []string{"10.0.0.0/8"},
+		Mapping: map[string]*NetworkConfig{
+			"internal": {Allow: []string{"10.2.0.0/16"}},
+		},
+		HtpasswdFile: htpasswd,
+		BearerTokens: []string{"token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkMethod := func(method, p, ip string, set func(r *http.Request)) int {
+		r, _ := http.NewRequest(method, "/"+p, nil)
+		if set != nil {
+			set(r)
+		}
+		status, _ := a.check(r, p, net.ParseIP(ip))
+		return status
+	}
+	check := func(p, ip string, set func(r *http.Request)) int {
+		return checkMethod("GET", p, ip, set)
+	}
+	basic := func(user, password string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.SetBasicAuth(user, password)
+		}
+	}
+	bearer := func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer token")
+	}
+
+	p := "ubuntu/dists/trusty/Release"
+	if check(p, "192.168.0.1", basic("user", "password")) != http.StatusForbidden {
+		t.Error(`not allowed network must be forbidden`)
+	}
+	if check(p, "10.0.0.1", nil) != http.StatusUnauthorized {
+		t.Error(`no credentials must be unauthorized`)
+	}
+	if check(p, "10.0.0.1", basic("user", "wrong")) != http.StatusUnauthorized {
+		t.Error(`wrong password must be unauthorized`)
+	}
+	if check(p, "10.0.0.1", basic("user", "password")) != http.StatusOK {
+		t.Error(`valid password must be permitted`)
+	}
+	if check(p, "10.0.0.1", basic("user", "password")) != http.StatusOK {
+		t.Error(`cached password must be permitted`)
+	}
+	if check(p, "10.0.0.1", bearer) != http.StatusOK {
+		t.Error(`valid bearer token must be permitted`)
+	}
+	if check(p, "10.0.0.1", basic("apt", "token")) != http.StatusOK {
+		t.Error(`token as a password must be permitted`)
+	}
+
+	p = "internal/dists/stable/Release"
+	if check(p, "10.0.0.1", bearer) != http.StatusForbidden {
+		t.Error(`not allowed network for internal must be forbidden`)
+	}
+	if check(p, "10.2.0.1", bearer) != http.StatusOK {
+		t.Error(`allowed network for internal must be permitted`)
+	}
+	if check("_api/snapshots", "10.0.0.1", nil) != http.StatusUnauthorized {
+		t.Error(`API must require credentials`)
+	}
+	if checkMethod("DELETE", "_api/snapshots/ubuntu@1", "10.0.0.1", nil) != http.StatusUnauthorized {
+		t.Error(`API must require credentials`)
+	}
+	if check("_api/local/internal", "10.2.0.1", nil) != http.StatusUnauthorized {
+		t.Error(`listing local packages must require credentials`)
+	}
+	if checkMethod("PUT", "_api/local/internal", "10.2.0.1", nil) != http.StatusOK {
+		t.Error(`uploads must be authenticated by upload tokens`)
+	}
+	if checkMethod("PUT", "_api/local/internal", "10.0.0.1", nil) != http.StatusForbidden {
+		t.Error(`uploads from not allowed network for internal must be forbidden`)
+	}
+	if check("_api/local/internal", "10.0.0.1", bearer) != http.StatusForbidden {
+		t.Error(`listing from not allowed network for internal must be forbidden`)
+	}
+	if checkMethod("PUT", "_api/local/internal", "192.168.0.1", nil) != http.StatusForbidden {
+		t.Error(`uploads from not allowed network must be forbidden`)
+	}
+}
+
+func TestAccessCheckAdmin(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	htpasswd := filepath.Join(dir, "htpasswd")
+	data := "admin:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\nuser:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	if err := ioutil.WriteFile(htpasswd, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newAccessControl(&AccessConfig{
+		HtpasswdFile: htpasswd,
+		AdminUsers:   []string{"nobody"},
+	})
+	if err == nil {
+		t.Error(`unknown admin user must be an error`)
+	}
+
+	a, err := newAccessControl(&AccessConfig{
+		HtpasswdFile: htpasswd,
+		AdminUsers:   []string{"admin"},
+		AdminTokens:  []string{"token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(set func(r *http.Request)) int {
+		r, _ := http.NewRequest("POST", "/_api/snapshots", nil)
+		if set != nil {
+			set(r)
+		}
+		status, _ := a.checkAdmin(r)
+		return status
+	}
+	basic := func(user, password string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.SetBasicAuth(user, password)
+		}
+	}
+
+	if check(nil) != http.StatusUnauthorized {
+		t.Error(`no credentials must be unauthorized`)
+	}
+	if check(basic("admin", "wrong")) != http.StatusUnauthorized {
+		t.Error(`wrong password must be unauthorized`)
+	}
+	if check(basic("user", "password")) != http.StatusForbidden {
+		t.Error(`non-admin user must be forbidden`)
+	}
+	if check(basic("admin", "password")) != http.StatusOK {
+		t.Error(`admin user must be permitted`)
+	}
+	if check(basic("any", "token")) != http.StatusOK {
+		t.Error(`admin token must be permitted`)
+	}
+
+	r, _ := http.NewRequest("GET", "/ubuntu/dists/trusty/Release", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	if !a.authenticated(r) {
+		t.Error(`admin token must be accepted as a bearer token`)
+	}
+
+	var nilAccess *accessControl
+	if status, _ := nilAccess.checkAdmin(r); status != http.StatusForbidden {
+		t.Error(`admin API must be forbidden without access control`)
+	}
+}
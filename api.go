@@ -0,0 +1,293 @@
+package aptcacher
+
+// This file implements HTTP API to administer go-apt-cacher.
+//
+// API endpoints are served under "/_api/".
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	apiPrefix = "_api"
+)
+
+// isAPIPath returns true if p points an API endpoint.
+func isAPIPath(p string) bool {
+	return p == apiPrefix || strings.HasPrefix(p, apiPrefix+"/")
+}
+
+// isUploadRequest returns true if r for p uploads a package to
+// a local repository.
+func isUploadRequest(r *http.Request, p string) bool {
+	if r.Method != "PUT" && r.Method != "POST" {
+		return false
+	}
+	return strings.HasPrefix(p, apiPrefix+"/local/")
+}
+
+// renderJSON writes v as a JSON response.
+func renderJSON(w http.ResponseWriter, v interface{}, status int) int {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.Encode(v)
+	return status
+}
+
+// renderError writes an error response in JSON.
+func renderError(w http.ResponseWriter, msg string, status int) int {
+	return renderJSON(w, map[string]string{"error": msg}, status)
+}
+
+// checkAdmin checks if r has credentials of an administrator.
+// If not, it writes an error response and returns true with the
+// HTTP status code.
+func (c cacheHandler) checkAdmin(w http.ResponseWriter, r *http.Request) (bool, int) {
+	status, reason := c.access.checkAdmin(r)
+	if status == http.StatusOK {
+		return false, 0
+	}
+
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="go-apt-cacher"`)
+	}
+	c.logger.Warn("admin access denied", map[string]interface{}{
+		"_method":      r.Method,
+		"_path":        r.URL.Path,
+		"_status":      status,
+		"_reason":      reason,
+		"_remote_addr": r.RemoteAddr,
+	})
+	return true, renderError(w, http.StatusText(status), status)
+}
+
+// serveAPI handles requests for API endpoints.
+//
+// p is the cleaned request path beginning with apiPrefix.
+// The return value is the HTTP status code of the response.
+func (c cacheHandler) serveAPI(w http.ResponseWriter, r *http.Request, p string) int {
+	p = strings.TrimPrefix(p, apiPrefix)
+	switch {
+	case p == "/mirror":
+		if r.Method != "GET" {
+			return renderError(w, "bad method", http.StatusMethodNotAllowed)
+		}
+		return renderJSON(w, c.MirrorStatus(), http.StatusOK)
+	case p == "/snapshots":
+		return c.serveSnapshots(w, r)
+	case strings.HasPrefix(p, "/snapshots/"):
+		return c.serveSnapshot(w, r, p[len("/snapshots/"):])
+	case p == "/search":
+		return c.serveSearch(w, r)
+	case strings.HasPrefix(p, "/feed/"):
+		return c.serveFeed(w, r, p[len("/feed/"):])
+	case p == "/pins":
+		return c.servePins(w, r)
+	case strings.HasPrefix(p, "/local/"):
+		return c.serveLocal(w, r, strings.SplitN(p[len("/local/"):], "/", 2)[0])
+	}
+	return renderError(w, "not found", http.StatusNotFound)
+}
+
+// serveSnapshots lists or creates snapshots.
+//
+// To create a snapshot, POST "prefix", "suite", and optionally "id"
+// with admin credentials.
+func (c cacheHandler) serveSnapshots(w http.ResponseWriter, r *http.Request) int {
+	switch r.Method {
+	case "GET":
+		return renderJSON(w, c.Snapshots(), http.StatusOK)
+	case "POST":
+		if denied, status := c.checkAdmin(w, r); denied {
+			return status
+		}
+		s, err := c.CreateSnapshot(r.FormValue("prefix"), r.FormValue("suite"), r.FormValue("id"))
+		switch {
+		case err == ErrSnapshotExists:
+			return renderError(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			return renderError(w, err.Error(), http.StatusBadRequest)
+		}
+		return renderJSON(w, s, http.StatusCreated)
+	}
+	return renderError(w, "bad method", http.StatusMethodNotAllowed)
+}
+
+// serveSnapshot deletes a snapshot with admin credentials.
+func (c cacheHandler) serveSnapshot(w http.ResponseWriter, r *http.Request, name string) int {
+	if r.Method != "DELETE" {
+		return renderError(w, "bad method", http.StatusMethodNotAllowed)
+	}
+	if denied, status := c.checkAdmin(w, r); denied {
+		return status
+	}
+	switch err := c.DeleteSnapshot(name); {
+	case err == ErrNotFound:
+		return renderError(w, "not found", http.StatusNotFound)
+	case err != nil:
+		return renderError(w, err.Error(), http.StatusInternalServerError)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent
+}
+
+// servePins lists, adds, or removes pin rules.
+//
+// To add or remove a rule, POST or DELETE one of "path", "mapping",
+// or "package" parameters with admin credentials.
+func (c cacheHandler) servePins(w http.ResponseWriter, r *http.Request) int {
+	switch r.Method {
+	case "GET":
+		return renderJSON(w, c.PinStatus(), http.StatusOK)
+	case "POST", "DELETE":
+	default:
+		return renderError(w, "bad method", http.StatusMethodNotAllowed)
+	}
+	if denied, status := c.checkAdmin(w, r); denied {
+		return status
+	}
+
+	var kind, rule string
+	for _, k := range []string{PinPath, PinMapping, PinPackage} {
+		if v := r.FormValue(k); v != "" {
+			kind, rule = k, v
+			break
+		}
+	}
+	if kind == "" {
+		return renderError(w, "no rule", http.StatusBadRequest)
+	}
+
+	var err error
+	if r.Method == "POST" {
+		err = c.AddPinRule(kind, rule)
+	} else {
+		err = c.RemovePinRule(kind, rule)
+	}
+	switch {
+	case err == ErrNotFound:
+		return renderError(w, "not found", http.StatusNotFound)
+	case err != nil:
+		return renderError(w, err.Error(), http.StatusBadRequest)
+	}
+	return renderJSON(w, c.PinStatus(), http.StatusOK)
+}
+
+// serveLocal lists or uploads packages of a local repository.
+//
+// To upload a package, PUT or POST the .deb file as the request body
+// with an upload token.  The component can be specified by "component"
+// parameter in the query string.
+func (c cacheHandler) serveLocal(w http.ResponseWriter, r *http.Request, prefix string) int {
+	l, ok := c.locals[prefix]
+	if !ok {
+		return renderError(w, "not found", http.StatusNotFound)
+	}
+
+	switch r.Method {
+	case "GET":
+		pl, err := c.LocalPackages(prefix)
+		if err != nil {
+			return renderError(w, err.Error(), http.StatusInternalServerError)
+		}
+		return renderJSON(w, pl, http.StatusOK)
+	case "PUT", "POST":
+		// later on
+	default:
+		return renderError(w, "bad method", http.StatusMethodNotAllowed)
+	}
+
+	if !l.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="go-apt-cacher"`)
+		return renderError(w, "unauthorized", http.StatusUnauthorized)
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxUploadSize)
+	d, err := c.Upload(prefix, r.URL.Query().Get("component"), body)
+	switch {
+	case err == ErrPackageExists:
+		return renderError(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		return renderError(w, err.Error(), http.StatusBadRequest)
+	}
+	return renderJSON(w, makeLocalPackage(d), http.StatusCreated)
+}
+
+// serveSearch searches packages in cached indices.
+//
+// Parameters are "package", "source", "version", "arch", "prefix",
+// "suite", and "limit".
+func (c cacheHandler) serveSearch(w http.ResponseWriter, r *http.Request) int {
+	if r.Method != "GET" {
+		return renderError(w, "bad method", http.StatusMethodNotAllowed)
+	}
+
+	q := r.URL.Query()
+	query := &SearchQuery{
+		Package:      q.Get("package"),
+		Source:       q.Get("source"),
+		Version:      q.Get("version"),
+		Architecture: q.Get("arch"),
+		Prefix:       q.Get("prefix"),
+		Suite:        q.Get("suite"),
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return renderError(w, "invalid limit", http.StatusBadRequest)
+		}
+		query.Limit = n
+	}
+
+	results, err := c.Search(query)
+	if err != nil {
+		return renderError(w, err.Error(), http.StatusBadRequest)
+	}
+	return renderJSON(w, results, http.StatusOK)
+}
+
+// serveFeed serves the update feed of a suite.
+//
+// name is "<prefix>/<suite>" for JSON, or "<prefix>/<suite>/atom"
+// for Atom.  Parameter "package" filters changes by package names.
+func (c cacheHandler) serveFeed(w http.ResponseWriter, r *http.Request, name string) int {
+	if r.Method != "GET" {
+		return renderError(w, "bad method", http.StatusMethodNotAllowed)
+	}
+	if c.feedSize == 0 {
+		return renderError(w, "feed is disabled", http.StatusNotFound)
+	}
+
+	t := strings.Split(name, "/")
+	atom := len(t) == 3 && t[2] == "atom"
+	if len(t) != 2 && !atom {
+		return renderError(w, "not found", http.StatusNotFound)
+	}
+
+	pattern := r.URL.Query().Get("package")
+	if !validPattern(pattern) {
+		return renderError(w, "invalid pattern: "+pattern, http.StatusBadRequest)
+	}
+	entries := c.Feed(t[0], t[1], pattern)
+	if !atom {
+		return renderJSON(w, entries, http.StatusOK)
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	self := scheme + "://" + r.Host + r.URL.RequestURI()
+	data, err := makeAtom(self, "Updates of "+t[0]+" "+t[1], entries)
+	if err != nil {
+		return renderError(w, err.Error(), http.StatusInternalServerError)
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return http.StatusOK
+}
@@ -5,36 +5,52 @@ package aptcacher
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cybozu-go/log"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
-	"golang.org/x/net/context/ctxhttp"
 )
 
 const (
-	gib            = 1 << 30
-	requestTimeout = 30 * time.Minute
+	gib               = 1 << 30
+	requestTimeout    = 30 * time.Minute
+	saveStateInterval = 10 * time.Minute
 )
 
+// mappingSettings is a set of settings for a mapping.
+type mappingSettings struct {
+	checkInterval time.Duration
+	cachePeriod   time.Duration
+	timeout       time.Duration
+
+	// key of hostSem, and its size.
+	semKey   string
+	maxConns int
+}
+
 // Cacher downloads and caches APT indices and deb files.
 type Cacher struct {
-	meta          *Storage
-	items         *Storage
+	meta          Store
+	items         Store
 	um            URLMap
 	checkInterval time.Duration
-	cachePeriod   time.Duration
 	ctx           context.Context
 	client        *http.Client
-	maxConns      int
+	fetchers      map[string]Fetcher
+	upstreams     map[string]Fetcher // prefix -> fetcher
+	settings      map[string]*mappingSettings
+	logger        *log.Logger
+	now           func() time.Time
 
 	fiLock sync.RWMutex
 	info   map[string]*FileInfo
@@ -45,82 +61,356 @@ type Cacher struct {
 
 	hostLock sync.Mutex
 	hostSem  map[string]chan struct{}
-}
 
-// NewCacher constructs Cacher.
-func NewCacher(ctx context.Context, config *CacherConfig) (*Cacher, error) {
-	checkInterval := time.Duration(config.CheckInterval) * time.Second
-	if checkInterval == 0 {
-		checkInterval = defaultCheckInterval * time.Second
-	}
+	// nil if prefetching upgrades is disabled.
+	prefetchQueue chan *FileInfo
 
-	cachePeriod := time.Duration(config.CachePeriod) * time.Second
-	if cachePeriod == 0 {
-		cachePeriod = defaultCachePeriod * time.Second
-	}
+	// zero if the update feed is disabled.
+	feedSize int
+	feedLock sync.Mutex
+	feeds    map[string][]*FeedEntry
+
+	mirrors map[string]*mirror
+
+	snapLock     sync.Mutex
+	snapshots    map[string]*Snapshot
+	snapCreating map[string]bool // names of snapshots being created
 
+	locals map[string]*localRepo
+	unions map[string]*union
+
+	filters map[string]*filter
+
+	hooks     []*hook
+	observers []Observer
+
+	// nil if access control is not configured.
+	access *accessControl
+
+	pins *pinner
+}
+
+// newStorages creates storages for meta data and other items
+// as configured.  The storages log with logger.
+func newStorages(config *CacherConfig, logger *log.Logger) (meta, items Store, err error) {
 	metaDir := filepath.Clean(config.MetaDirectory)
 	if !filepath.IsAbs(metaDir) {
-		return nil, errors.New("meta_dir must be an absolute path")
+		return nil, nil, errors.New("meta_dir must be an absolute path")
 	}
 
 	cacheDir := filepath.Clean(config.CacheDirectory)
 	if !filepath.IsAbs(cacheDir) {
-		return nil, errors.New("cache_dir must be an absolute path")
+		return nil, nil, errors.New("cache_dir must be an absolute path")
 	}
 
 	if metaDir == cacheDir {
-		return nil, errors.New("meta_dir and cache_dir must be different")
+		return nil, nil, errors.New("meta_dir and cache_dir must be different")
 	}
 
-	capacity := uint64(config.CacheCapacity) * gib
+	capacity := uint64(config.CacheSize)
+	if capacity == 0 {
+		capacity = uint64(config.CacheCapacity) * gib
+	}
 	if capacity == 0 {
 		capacity = defaultCacheCapacity * gib
 	}
 
-	meta := NewStorage(metaDir, 0)
 	cache := NewStorage(cacheDir, capacity)
+	cache.SetLogger(logger)
+	if config.Eviction != "" {
+		if err := cache.SetEvictionPolicy(config.Eviction); err != nil {
+			return nil, nil, err
+		}
+	}
+	if config.FreeSpaceLow > 0 {
+		cache.SetFreeSpaceWatermarks(uint64(config.FreeSpaceLow), uint64(config.FreeSpaceHigh))
+	}
+	ms := NewStorage(metaDir, 0)
+	ms.SetLogger(logger)
+	return ms, cache, nil
+}
 
-	if err := meta.Load(); err != nil {
-		return nil, errors.Wrap(err, "meta.Load")
+// NewCacher constructs Cacher.
+//
+// Options can replace some components such as the HTTP client
+// or storages.
+func NewCacher(ctx context.Context, config *CacherConfig, opts ...Option) (*Cacher, error) {
+	checkInterval := time.Duration(config.CheckInterval) * time.Second
+	if checkInterval == 0 {
+		checkInterval = defaultCheckInterval * time.Second
 	}
-	if err := cache.Load(); err != nil {
-		return nil, errors.Wrap(err, "cache.Load")
+
+	cachePeriod := time.Duration(config.CachePeriod) * time.Second
+	if cachePeriod == 0 {
+		cachePeriod = defaultCachePeriod * time.Second
 	}
 
 	um := make(URLMap)
-	for prefix, urlString := range config.Mapping {
-		u, err := url.Parse(urlString)
+	settings := make(map[string]*mappingSettings)
+	quotas := make(map[string]uint64)
+	for prefix := range config.MappingOptions {
+		if _, ok := config.Mapping[prefix]; !ok {
+			return nil, errors.New("mapping_options for unknown prefix: " + prefix)
+		}
+	}
+	for prefix, rawurl := range config.Mapping {
+		if prefix == apiPrefix {
+			return nil, errors.New("reserved prefix: " + prefix)
+		}
+		u, err := url.Parse(rawurl)
 		if err != nil {
 			return nil, errors.Wrap(err, prefix)
 		}
-		if u.Scheme != "http" && u.Scheme != "https" {
-			return nil, errors.New("unsupported scheme: " + u.Scheme)
+		if u.Scheme == "" && path.IsAbs(u.Path) {
+			// a local directory
+			u.Scheme = "file"
 		}
 		err = um.Register(prefix, u)
 		if err != nil {
 			return nil, errors.Wrap(err, prefix)
 		}
+
+		s := &mappingSettings{
+			checkInterval: checkInterval,
+			cachePeriod:   cachePeriod,
+			timeout:       requestTimeout,
+			semKey:        u.Host,
+			maxConns:      config.MaxConns,
+		}
+		mc := config.MappingOptions[prefix]
+		if mc == nil {
+			mc = &MappingConfig{}
+		}
+		if mc.CheckInterval > 0 {
+			s.checkInterval = time.Duration(mc.CheckInterval) * time.Second
+		}
+		if mc.CachePeriod > 0 {
+			s.cachePeriod = time.Duration(mc.CachePeriod) * time.Second
+		}
+		if mc.Timeout > 0 {
+			s.timeout = time.Duration(mc.Timeout) * time.Second
+		}
+		if mc.MaxConns > 0 {
+			// host names never contain slashes.
+			s.semKey = prefix + "/"
+			s.maxConns = mc.MaxConns
+		}
+		settings[prefix] = s
+		if mc.Capacity > 0 {
+			quotas[prefix] = uint64(mc.Capacity)
+		}
 	}
 
 	c := &Cacher{
-		meta:          meta,
-		items:         cache,
 		um:            um,
 		checkInterval: checkInterval,
-		cachePeriod:   cachePeriod,
 		ctx:           ctx,
 		client:        &http.Client{},
-		maxConns:      config.MaxConns,
+		logger:        log.DefaultLogger(),
+		now:           time.Now,
 		info:          make(map[string]*FileInfo),
 		dlChannels:    make(map[string]chan struct{}),
 		results:       make(map[string]int),
 		hostSem:       make(map[string]chan struct{}),
+		mirrors:       make(map[string]*mirror),
+		snapshots:     make(map[string]*Snapshot),
+		snapCreating:  make(map[string]bool),
+		locals:        make(map[string]*localRepo),
+		unions:        make(map[string]*union),
+		filters:       make(map[string]*filter),
+		feedSize:      config.FeedSize,
+		feeds:         make(map[string][]*FeedEntry),
+		fetchers:      make(map[string]Fetcher),
+		settings:      settings,
+		pins:          newPinner(),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
 
-	metas := meta.ListAll()
+	hf := &HTTPFetcher{Client: c.client}
+	defaultFetchers := map[string]Fetcher{
+		"http":  hf,
+		"https": hf,
+		"file":  FileFetcher{},
+	}
+	for scheme, f := range defaultFetchers {
+		if _, ok := c.fetchers[scheme]; !ok {
+			c.fetchers[scheme] = f
+		}
+	}
+	upstreams, err := c.upstreamFetchers(um, config)
+	if err != nil {
+		return nil, err
+	}
+	c.upstreams = upstreams
+
+	if c.meta == nil || c.items == nil {
+		if config.VerifyOnStart {
+			if _, err := verify(config, c.logger); err != nil {
+				return nil, errors.Wrap(err, "Verify")
+			}
+		}
+		meta, items, err := newStorages(config, c.logger)
+		if err != nil {
+			return nil, err
+		}
+		c.meta, c.items = meta, items
+	}
+	meta, cache := c.meta, c.items
+	if len(quotas) > 0 {
+		s, ok := cache.(*Storage)
+		if !ok {
+			return nil, errors.New("capacity of mappings needs Storage")
+		}
+		for prefix, quota := range quotas {
+			s.SetQuota(prefix, quota)
+		}
+	}
+	if err := meta.Load(); err != nil {
+		return nil, errors.Wrap(err, "meta.Load")
+	}
+
+	if config.Pin != nil {
+		rules := map[string][]string{
+			PinPath:    config.Pin.Paths,
+			PinMapping: config.Pin.Mappings,
+			PinPackage: config.Pin.Packages,
+		}
+		for kind, l := range rules {
+			for _, rule := range l {
+				if err := c.validatePinRule(kind, rule); err != nil {
+					return nil, errors.Wrap(err, "pin")
+				}
+			}
+		}
+		c.pins.mu.Lock()
+		c.pins.paths = config.Pin.Paths
+		c.pins.mappings = config.Pin.Mappings
+		c.pins.packages = config.Pin.Packages
+		err := c.applyPinRules(PinPath)
+		c.pins.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for prefix, lc := range config.Local {
+		if !validPrefix.MatchString(prefix) {
+			return nil, ErrInvalidPrefix
+		}
+		if _, ok := um[prefix]; ok || prefix == apiPrefix {
+			return nil, errors.New("duplicate prefix: " + prefix)
+		}
+		l, err := newLocalRepo(prefix, lc)
+		if err != nil {
+			return nil, errors.Wrap(err, "local."+prefix)
+		}
+		c.locals[prefix] = l
+	}
+
+	for prefix, uc := range config.Union {
+		if !validPrefix.MatchString(prefix) {
+			return nil, ErrInvalidPrefix
+		}
+		if _, ok := um[prefix]; ok || prefix == apiPrefix {
+			return nil, errors.New("duplicate prefix: " + prefix)
+		}
+		if _, ok := c.locals[prefix]; ok {
+			return nil, errors.New("duplicate prefix: " + prefix)
+		}
+		u, err := newUnion(prefix, uc)
+		if err != nil {
+			return nil, errors.Wrap(err, "union."+prefix)
+		}
+		for _, m := range u.members {
+			_, ok1 := um[m.prefix]
+			_, ok2 := c.locals[m.prefix]
+			if !ok1 && !ok2 {
+				return nil, errors.New("union." + prefix + ": unknown member: " + m.prefix)
+			}
+		}
+		c.unions[prefix] = u
+	}
+
+	for prefix, fc := range config.Filter {
+		if _, ok := um[prefix]; !ok {
+			return nil, errors.New("filter for unknown prefix: " + prefix)
+		}
+		f, err := newFilter(prefix, fc)
+		if err != nil {
+			return nil, errors.Wrap(err, "filter."+prefix)
+		}
+		c.filters[prefix] = f
+	}
+
+	if config.Access != nil {
+		for prefix := range config.Access.Mapping {
+			_, ok1 := um[prefix]
+			_, ok2 := c.locals[prefix]
+			_, ok3 := c.unions[prefix]
+			if !ok1 && !ok2 && !ok3 {
+				return nil, errors.New("access for unknown prefix: " + prefix)
+			}
+		}
+		a, err := newAccessControl(config.Access)
+		if err != nil {
+			return nil, errors.Wrap(err, "access")
+		}
+		for prefix, u := range c.unions {
+			for _, m := range u.members {
+				a.unions[prefix] = append(a.unions[prefix], m.prefix)
+			}
+		}
+		c.access = a
+	}
+
+	for i, hc := range config.Hook {
+		h, err := newHook(hc, c.logger)
+		if err != nil {
+			return nil, errors.Wrapf(err, "hook[%d]", i)
+		}
+		c.hooks = append(c.hooks, h)
+		c.observers = append(c.observers, h)
+	}
+	if config.Observer != nil {
+		c.observers = append(c.observers, config.Observer)
+	}
+	if s, ok := cache.(*Storage); ok && len(c.observers) > 0 {
+		s.onEvict = func(fi *FileInfo) {
+			c.emit(&Event{Type: EventEvicted, Path: fi.path, Size: fi.size})
+		}
+	}
+
+	for prefix, mc := range config.Mirror {
+		if _, ok := um[prefix]; !ok {
+			return nil, errors.New("mirror for unknown prefix: " + prefix)
+		}
+		m, err := newMirror(prefix, mc)
+		if err != nil {
+			return nil, errors.Wrap(err, "mirror."+prefix)
+		}
+		c.mirrors[prefix] = m
+	}
+
+	if config.PrefetchUpgrades {
+		c.prefetchQueue = make(chan *FileInfo, prefetchQueueSize)
+		go c.prefetchWorker(ctx)
+	}
+
+	// filtered views are regenerated from upstream indices.
+	var metas []*FileInfo
+	for _, fi := range meta.ListAll() {
+		if !isFilteredPath(fi.path) {
+			metas = append(metas, fi)
+			continue
+		}
+		if err := meta.Delete(fi.path); err != nil {
+			return nil, errors.Wrap(err, "meta.Delete")
+		}
+	}
 	for _, fi := range metas {
-		f, err := meta.Lookup(fi)
+		f, err := meta.LookupItem(fi)
 		if err != nil {
 			return nil, errors.Wrap(err, "meta.Lookup")
 		}
@@ -142,39 +432,115 @@ func NewCacher(ctx context.Context, config *CacherConfig) (*Cacher, error) {
 		}
 	}
 
+	// mirrored files and files referenced by snapshots need to be
+	// pinned before loading items so that they are not evicted.
+	c.loadSnapshots(metas)
+	for _, l := range c.locals {
+		if err := c.loadLocalRepo(l); err != nil {
+			return nil, errors.Wrap(err, "local."+l.prefix)
+		}
+	}
+	for _, f := range c.filters {
+		c.loadFilter(f, metas)
+	}
+	for _, m := range c.mirrors {
+		files, complete, err := c.mirrorFiles(m, false)
+		if err != nil {
+			// not synchronized yet.
+			continue
+		}
+		c.pinMirrorFiles(m, files, complete)
+	}
+	c.resolvePinnedPackages()
+
+	if err := cache.Load(); err != nil {
+		return nil, errors.Wrap(err, "cache.Load")
+	}
+
+	for _, h := range c.hooks {
+		go h.run(ctx)
+	}
+	for _, m := range c.mirrors {
+		go c.runMirror(m)
+	}
+	for _, u := range c.unions {
+		go c.runUnion(u)
+	}
+	for _, f := range c.filters {
+		go c.runFilter(f)
+	}
+	go c.runSaveState()
+	go c.runPins()
+
 	return c, nil
 }
 
-func (c *Cacher) acquireSemaphore(host string) {
-	if c.maxConns == 0 {
+// SaveState saves the eviction state of the cache so that the order
+// of eviction is preserved across restarts.
+//
+// This does nothing unless the cache is a Storage.
+func (c *Cacher) SaveState() error {
+	s, ok := c.items.(*Storage)
+	if !ok {
+		return nil
+	}
+	return s.SaveState()
+}
+
+// runSaveState saves the eviction state periodically.
+func (c *Cacher) runSaveState() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(saveStateInterval):
+		}
+		if err := c.SaveState(); err != nil {
+			c.logger.Warn("failed to save eviction state", map[string]interface{}{
+				"_err": err.Error(),
+			})
+		}
+	}
+}
+
+// acquireSemaphore limits concurrent connections of s.
+// Connections are counted for each upstream host, or for each
+// mapping if it has its own limit.
+func (c *Cacher) acquireSemaphore(s *mappingSettings) {
+	if s.maxConns == 0 {
 		return
 	}
 
 	c.hostLock.Lock()
-	sem, ok := c.hostSem[host]
+	sem, ok := c.hostSem[s.semKey]
 	if !ok {
-		sem = make(chan struct{}, c.maxConns)
-		for i := 0; i < c.maxConns; i++ {
+		sem = make(chan struct{}, s.maxConns)
+		for i := 0; i < s.maxConns; i++ {
 			sem <- struct{}{}
 		}
-		c.hostSem[host] = sem
+		c.hostSem[s.semKey] = sem
 	}
 	c.hostLock.Unlock()
 
 	<-sem
 }
 
-func (c *Cacher) releaseSemaphore(host string) {
-	if c.maxConns == 0 {
+func (c *Cacher) releaseSemaphore(s *mappingSettings) {
+	if s.maxConns == 0 {
 		return
 	}
 
 	c.hostLock.Lock()
-	c.hostSem[host] <- struct{}{}
+	c.hostSem[s.semKey] <- struct{}{}
 	c.hostLock.Unlock()
 }
 
 func (c *Cacher) maintMeta(p string) {
+	if c.um.URL(p) == nil {
+		// no upstream, e.g. snapshots.
+		return
+	}
+
 	switch path.Base(p) {
 	case "Release":
 		go c.maintRelease(p, true)
@@ -184,11 +550,12 @@ func (c *Cacher) maintMeta(p string) {
 }
 
 func (c *Cacher) maintRelease(p string, withGPG bool) {
-	ticker := time.NewTicker(c.checkInterval)
+	s := c.settings[strings.SplitN(p, "/", 2)[0]]
+	ticker := time.NewTicker(s.checkInterval)
 	defer ticker.Stop()
 
-	if log.Enabled(log.LvDebug) {
-		log.Debug("maintRelease", map[string]interface{}{
+	if c.logger.Enabled(log.LvDebug) {
+		c.logger.Debug("maintRelease", map[string]interface{}{
 			"_path": p,
 		})
 	}
@@ -241,12 +608,24 @@ func (c *Cacher) Download(p string, valid *FileInfo) <-chan struct{} {
 
 // download is a goroutine to download an item.
 func (c *Cacher) download(p string, u *url.URL, valid *FileInfo) {
-	c.acquireSemaphore(u.Host)
+	prefix := strings.SplitN(p, "/", 2)[0]
+	s := c.settings[prefix]
+	c.acquireSemaphore(s)
 
 	statusCode := http.StatusInternalServerError
+	var received int
+	start := c.now()
+	c.emit(&Event{Type: EventDownloadStarted, Path: p})
 
 	defer func() {
-		c.releaseSemaphore(u.Host)
+		c.releaseSemaphore(s)
+		c.emit(&Event{
+			Type:     EventDownloadFinished,
+			Path:     p,
+			Size:     uint64(received),
+			Status:   statusCode,
+			Duration: c.now().Sub(start),
+		})
 		c.dlLock.Lock()
 		ch := c.dlChannels[p]
 		delete(c.dlChannels, p)
@@ -259,7 +638,7 @@ func (c *Cacher) download(p string, u *url.URL, valid *FileInfo) {
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(c.cachePeriod):
+			case <-time.After(s.cachePeriod):
 			}
 			c.dlLock.Lock()
 			delete(c.results, p)
@@ -267,38 +646,48 @@ func (c *Cacher) download(p string, u *url.URL, valid *FileInfo) {
 		}(c.ctx)
 	}()
 
-	ctx, cancel := context.WithTimeout(c.ctx, requestTimeout)
+	ctx, cancel := context.WithTimeout(c.ctx, s.timeout)
 	defer cancel()
 
-	resp, err := ctxhttp.Get(ctx, c.client, u.String())
+	status, rc, err := c.upstreams[prefix].Fetch(ctx, u)
 	if err != nil {
-		log.Warn("GET failed", map[string]interface{}{
+		c.logger.Warn("GET failed", map[string]interface{}{
 			"_url": u.String(),
 			"_err": err.Error(),
 		})
+		c.emit(&Event{Type: EventUpstreamError, Path: p, Error: err.Error()})
 		return
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
 
-	statusCode = resp.StatusCode
+	statusCode = status
+	if statusCode >= 500 {
+		c.emit(&Event{Type: EventUpstreamError, Path: p, Status: statusCode})
+	}
 	if statusCode != 200 {
 		return
 	}
 
+	body, err := ioutil.ReadAll(rc)
+	rc.Close()
+	received = len(body)
 	if err != nil {
-		log.Warn("GET failed", map[string]interface{}{
+		c.logger.Warn("GET failed", map[string]interface{}{
 			"_url": u.String(),
 			"_err": err.Error(),
 		})
+		c.emit(&Event{Type: EventUpstreamError, Path: p, Error: err.Error()})
 		return
 	}
 
 	fi := MakeFileInfo(p, body)
+	if hr, ok := rc.(headerReader); ok {
+		fi.header = hr.Header()
+	}
 	if valid != nil && !valid.Same(fi) {
-		log.Warn("downloaded data is not valid", map[string]interface{}{
+		c.logger.Warn("downloaded data is not valid", map[string]interface{}{
 			"_url": u.String(),
 		})
+		c.emit(&Event{Type: EventValidationFailed, Path: p, Size: fi.size})
 		return
 	}
 
@@ -308,7 +697,7 @@ func (c *Cacher) download(p string, u *url.URL, valid *FileInfo) {
 		storage = c.meta
 		fil, err = ExtractFileInfo(p, bytes.NewReader(body))
 		if err != nil {
-			log.Error("invalid meta data", map[string]interface{}{
+			c.logger.Error("invalid meta data", map[string]interface{}{
 				"_path": p,
 				"_err":  err.Error(),
 			})
@@ -316,11 +705,16 @@ func (c *Cacher) download(p string, u *url.URL, valid *FileInfo) {
 		}
 	}
 
+	if IsMeta(p) {
+		// blocked files must be known before the index is used.
+		c.scanIndex(p, body)
+	}
+
 	c.fiLock.Lock()
 	defer c.fiLock.Unlock()
 
-	if err := storage.Insert(body, fi); err != nil {
-		log.Error("could not save an item", map[string]interface{}{
+	if err := storage.InsertItem(bytes.NewReader(body), fi); err != nil {
+		c.logger.Error("could not save an item", map[string]interface{}{
 			"_path": p,
 			"_err":  err.Error(),
 		})
@@ -328,9 +722,26 @@ func (c *Cacher) download(p string, u *url.URL, valid *FileInfo) {
 		panic(err)
 	}
 
+	var updates []indexUpdate
+	if c.prefetchQueue != nil || c.feedSize > 0 {
+		updates = c.findIndexUpdates(fil)
+	}
+	for _, u := range updates {
+		go c.indexUpdated(u)
+	}
+
 	for _, fi2 := range fil {
 		c.info[fi2.path] = fi2
 	}
+	old, ok := c.info[p]
+	changed := !ok || !old.Same(fi)
+	switch path.Base(p) {
+	case "Release", "InRelease":
+		if changed {
+			c.notifyRelease(p)
+			c.emit(&Event{Type: EventReleaseChanged, Path: p, Size: fi.size})
+		}
+	}
 	if IsMeta(p) {
 		_, ok := c.info[p]
 		if !ok {
@@ -339,9 +750,204 @@ func (c *Cacher) download(p string, u *url.URL, valid *FileInfo) {
 		}
 	}
 	c.info[p] = fi
-	log.Info("downloaded and cached", map[string]interface{}{
+	c.logger.Info("downloaded and cached", map[string]interface{}{
 		"_path": p,
 	})
+	if indexBase(p) == "Packages" {
+		c.pins.notify()
+	}
+	switch indexBase(p) {
+	case "Packages", "Sources", "Index":
+		c.emit(&Event{Type: EventIndexUpdated, Path: p, Size: fi.size})
+	default:
+		c.emit(&Event{Type: EventDownloaded, Path: p, Size: fi.size})
+	}
+}
+
+// notifyRelease notifies mirrors, unions, and filters that a Release file p
+// has been updated.
+func (c *Cacher) notifyRelease(p string) {
+	prefix := strings.SplitN(p, "/", 2)[0]
+	dir := path.Dir(p)
+	if m, ok := c.mirrors[prefix]; ok {
+		m.notify()
+	}
+	if f, ok := c.filters[prefix]; ok {
+		f.notify(dir)
+	}
+	for _, u := range c.unions {
+		if u.hasSuite(dir) {
+			u.notify()
+		}
+	}
+}
+
+// indexUpdate represents a Packages or Sources index whose checksums
+// have been changed by a new Release file.
+type indexUpdate struct {
+	old io.ReadCloser // contents of the previous index
+	fi  *FileInfo     // checksums of the new index
+}
+
+// findIndexUpdates returns indices whose checksums in fil differ from
+// those currently known and whose previous contents are still in
+// meta storage.
+//
+// Sources indices are returned only if the update feed is enabled.
+// Only one index is returned for each directory even if
+// the index is cached in multiple compression formats.
+//
+// c.fiLock must be locked beforehand.
+func (c *Cacher) findIndexUpdates(fil []*FileInfo) []indexUpdate {
+	keys := make(map[string]bool)
+	var updates []indexUpdate
+	for _, fi := range fil {
+		base := indexBase(fi.path)
+		switch {
+		case !IsSupported(fi.path):
+			continue
+		case base == "Packages":
+		case base == "Sources" && c.feedSize > 0:
+		default:
+			continue
+		}
+		key := path.Join(path.Dir(fi.path), base)
+		if keys[key] {
+			continue
+		}
+		old, ok := c.info[fi.path]
+		if !ok || old.Same(fi) {
+			continue
+		}
+		f, err := c.meta.LookupItem(old)
+		if err != nil {
+			continue
+		}
+		keys[key] = true
+		updates = append(updates, indexUpdate{old: f, fi: fi})
+	}
+	return updates
+}
+
+// indexUpdated downloads an updated index and compares it with
+// the previous one to prefetch upgrades and to record changes in
+// the update feed.
+func (c *Cacher) indexUpdated(u indexUpdate) {
+	p := u.fi.path
+	older, err := readPackages(p, u.old)
+	u.old.Close()
+	if err != nil {
+		c.logger.Warn("invalid old index", map[string]interface{}{
+			"_path": p,
+			"_err":  err.Error(),
+		})
+		return
+	}
+
+	ch := c.Download(p, u.fi)
+	if ch == nil {
+		return
+	}
+	select {
+	case <-c.ctx.Done():
+		return
+	case <-ch:
+	}
+
+	f, err := c.meta.LookupItem(u.fi)
+	if err != nil {
+		// download failed or the index was updated again.
+		c.logger.Warn("new index is not available", map[string]interface{}{
+			"_path": p,
+			"_err":  err.Error(),
+		})
+		return
+	}
+	newer, err := readPackages(p, f)
+	f.Close()
+	if err != nil {
+		c.logger.Warn("invalid new index", map[string]interface{}{
+			"_path": p,
+			"_err":  err.Error(),
+		})
+		return
+	}
+
+	if c.feedSize > 0 {
+		c.recordUpdate(p, older, newer)
+	}
+	if c.prefetchQueue != nil && indexBase(p) == "Packages" {
+		c.prefetchUpgrades(p, older, newer)
+	}
+}
+
+// lookupInfo returns FileInfo for p.
+func (c *Cacher) lookupInfo(p string) (*FileInfo, bool) {
+	c.fiLock.RLock()
+	defer c.fiLock.RUnlock()
+
+	fi, ok := c.info[p]
+	return fi, ok
+}
+
+// Result is the result of GetContext.
+type Result struct {
+	// Status is the HTTP status code.  For items not cached, this is
+	// the status code of the response from the upstream server.
+	Status int
+
+	// Item is the cached item if Status is 200, or nil.
+	// The caller is responsible to close it.
+	Item Item
+
+	// Size and checksums of the item known from indices.
+	// Checksums may be nil if unknown.
+	Size      uint64
+	MD5Sum    []byte
+	SHA1Sum   []byte
+	SHA256Sum []byte
+
+	// ModTime is the time when the item was cached, if known.
+	ModTime time.Time
+
+	// Header has upstream headers such as Last-Modified and ETag
+	// kept with the item.  nil if unknown.
+	Header http.Header
+
+	// Hit is true if the item was found in the cache without
+	// waiting for downloads.
+	Hit bool
+
+	// Upstream is the URL of the item in the upstream repository.
+	// This is empty for items in local repositories.
+	Upstream string
+}
+
+// newResult returns a Result for a found item.
+func newResult(f Item, fi *FileInfo, hit bool, upstream *url.URL) *Result {
+	r := &Result{
+		Status:    http.StatusOK,
+		Item:      f,
+		Size:      fi.size,
+		MD5Sum:    fi.md5sum,
+		SHA1Sum:   fi.sha1sum,
+		SHA256Sum: fi.sha256sum,
+		Hit:       hit,
+	}
+	if st, ok := f.(interface {
+		Stat() (os.FileInfo, error)
+	}); ok {
+		if fst, err := st.Stat(); err == nil {
+			r.ModTime = fst.ModTime()
+		}
+	}
+	if hr, ok := f.(headerReader); ok {
+		r.Header = hr.Header()
+	}
+	if upstream != nil {
+		r.Upstream = upstream.String()
+	}
+	return r
 }
 
 // Get looks up a cached item, and if not found, downloads it
@@ -349,54 +955,153 @@ func (c *Cacher) download(p string, u *url.URL, valid *FileInfo) {
 //
 // The return values are cached HTTP status code of the response from
 // an upstream server, a pointer to os.File for the cache file,
-// and error.
+// and error.  Items of stores other than files are copied to
+// unlinked temporary files.
+//
+// Use GetContext to cancel waiting for downloads.
 func (c *Cacher) Get(p string) (statusCode int, f *os.File, err error) {
+	r, err := c.GetContext(context.Background(), p)
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	if r.Item == nil {
+		return r.Status, nil, nil
+	}
+	f, err = itemFile(r.Item)
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	return r.Status, f, nil
+}
+
+// itemFile returns the file of item.  If item is not a file,
+// it is copied to an unlinked temporary file.  item is closed
+// in that case.
+func itemFile(item Item) (*os.File, error) {
+	switch i := item.(type) {
+	case *os.File:
+		return i, nil
+	case storageItem:
+		return i.File, nil
+	}
+	defer item.Close()
+
+	f, err := ioutil.TempFile("", "go-apt-cacher-item")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	_, err = io.Copy(f, item)
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// GetContext is the same as Get except that it returns a Result,
+// and returns ctx.Err() promptly when ctx is done.
+//
+// Downloads started by GetContext continue in background even if
+// ctx is done, so that other requests can use the result.
+func (c *Cacher) GetContext(ctx context.Context, p string) (*Result, error) {
+	if rule, ok := c.blockedBy(p); ok {
+		c.logger.Warn("filter: blocked", map[string]interface{}{
+			"_path": p,
+			"_rule": rule,
+		})
+		return &Result{Status: http.StatusForbidden}, nil
+	}
+	if flt, ok := c.filters[strings.SplitN(p, "/", 2)[0]]; ok {
+		return c.getFiltered(ctx, flt, p)
+	}
+	return c.get(ctx, p)
+}
+
+// wait waits for ch to be closed or ctx to be done.
+func wait(ctx context.Context, ch <-chan struct{}) error {
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// get is the same as GetContext except that filters are not applied.
+func (c *Cacher) get(ctx context.Context, p string) (*Result, error) {
+	if _, ok := snapshotName(p); ok {
+		return c.getKnown(ctx, p)
+	}
+	prefix := strings.SplitN(p, "/", 2)[0]
+	if _, ok := c.locals[prefix]; ok {
+		return c.getKnown(ctx, p)
+	}
+	if u, ok := c.unions[prefix]; ok {
+		return c.getUnion(ctx, u, p)
+	}
+
 	u := c.um.URL(p)
 	if u == nil {
-		return http.StatusNotFound, nil, nil
+		return &Result{Status: http.StatusNotFound}, nil
 	}
 
 	storage := c.items
 	if IsMeta(p) {
 		if !IsSupported(p) {
 			// return 404 for unsupported compression algorithms
-			return http.StatusNotFound, nil, nil
+			return &Result{Status: http.StatusNotFound}, nil
 		}
 		storage = c.meta
 	}
 
+	missed := false
+
 RETRY:
 	c.fiLock.RLock()
 	fi, ok := c.info[p]
 	c.fiLock.RUnlock()
 
 	if ok {
-		f, err := storage.Lookup(fi)
+		f, err := storage.LookupItem(fi)
 		switch err {
 		case nil:
-			return http.StatusOK, f, nil
+			if !missed {
+				c.emit(&Event{Type: EventHit, Path: p, Size: fi.size})
+			}
+			return newResult(f, fi, !missed, u), nil
 		case ErrNotFound:
 		default:
-			log.Error("lookup failure", map[string]interface{}{
+			c.logger.Error("lookup failure", map[string]interface{}{
 				"_err": err.Error(),
 			})
-			return http.StatusInternalServerError, nil, err
+			return nil, err
 		}
 	}
 
 	// not found in storage.
+	if !missed {
+		c.emit(&Event{Type: EventMiss, Path: p})
+		missed = true
+	}
+
 	c.dlLock.RLock()
 	ch, chOk := c.dlChannels[p]
 	result, resultOk := c.results[p]
 	c.dlLock.RUnlock()
 
 	if resultOk && result != http.StatusOK {
-		return result, nil, nil
+		return &Result{Status: result, Upstream: u.String()}, nil
+	}
+	var done <-chan struct{} = ch
+	if !chOk {
+		done = c.Download(p, fi)
 	}
-	if chOk {
-		<-ch
-	} else {
-		<-c.Download(p, fi)
+	if err := wait(ctx, done); err != nil {
+		return nil, err
 	}
 	goto RETRY
 }
@@ -43,12 +43,506 @@ type CacherConfig struct {
 	// Unit is GiB.  Default is 1 GiB.
 	CacheCapacity int `toml:"cache_capacity"`
 
+	// CacheSize is the same as CacheCapacity except that the unit is
+	// byte.  If not zero, this takes precedence over CacheCapacity.
+	CacheSize ByteSize `toml:"cache_size"`
+
+	// FreeSpaceLow specifies the low watermark of the free space of
+	// the file system for CacheDirectory.
+	//
+	// When the free space falls below this, cached items are evicted
+	// until the free space reaches FreeSpaceHigh.
+	// Zero disables the watermarks.
+	FreeSpaceLow ByteSize `toml:"free_space_low"`
+
+	// FreeSpaceHigh specifies the high watermark of the free space.
+	//
+	// Default is FreeSpaceLow.
+	FreeSpaceHigh ByteSize `toml:"free_space_high"`
+
+	// VerifyOnStart runs Verify before loading storages in NewCacher.
+	VerifyOnStart bool `toml:"verify_on_start"`
+
+	// QuarantineDirectory is a directory to keep broken files found
+	// by Verify.  If empty, broken files are removed.
+	//
+	// This must be outside of MetaDirectory and CacheDirectory.
+	QuarantineDirectory string `toml:"quarantine_dir"`
+
+	// Eviction specifies the policy to evict items from CacheDirectory.
+	// One of "lru", "lfu", or "2q".
+	//
+	// Default is "lru".
+	Eviction string `toml:"eviction"`
+
 	// MaxConns specifies the maximum concurrent connections to an
 	// upstream host.
 	//
 	// Zero disables limit on the number of connections.
 	MaxConns int `toml:"max_conns"`
 
+	// PrefetchUpgrades enables prefetching of upgraded packages.
+	//
+	// If true, when an updated Packages index is detected, new versions
+	// of packages whose older versions are cached will be downloaded
+	// in background.
+	PrefetchUpgrades bool `toml:"prefetch_upgrades"`
+
+	// FeedSize specifies the number of index updates kept for
+	// each suite in the update feed.
+	//
+	// Zero disables the update feed.
+	FeedSize int `toml:"feed_size"`
+
 	// Mapping specifies mapping between prefixes and APT URLs.
+	//
+	// URLs may be http, https, or file URLs.  Absolute paths of local
+	// directories are treated as file URLs.
 	Mapping map[string]string `toml:"mapping"`
+
+	// MappingOptions specifies settings of mappings that override
+	// the global ones.
+	//
+	// Keys are prefixes defined in Mapping.
+	MappingOptions map[string]*MappingConfig `toml:"mapping_options"`
+
+	// Proxy specifies a proxy URL to access upstream repositories.
+	//
+	// The scheme of the URL may be http, https, or socks5.
+	// Credentials can be embedded in the URL.  If empty, proxies are
+	// taken from environment variables such as HTTPS_PROXY.
+	Proxy string `toml:"proxy"`
+
+	// NoProxy specifies hosts to be accessed without proxies.
+	//
+	// Each entry is a host name, a domain name that begins with ".",
+	// an IP address, a CIDR, or "*" to match all hosts.
+	// Host names match their sub-domains as well.
+	NoProxy []string `toml:"no_proxy"`
+
+	// Upstream specifies settings to access upstream repositories.
+	//
+	// Keys are prefixes defined in Mapping.
+	Upstream map[string]*UpstreamConfig `toml:"upstream"`
+
+	// Mirror specifies suites to be fully mirrored for prefixes.
+	Mirror map[string]*MirrorConfig `toml:"mirror"`
+
+	// Local specifies local repositories hosted by go-apt-cacher.
+	//
+	// Keys are prefixes that must not be used in Mapping.
+	Local map[string]*LocalConfig `toml:"local"`
+
+	// Union specifies union repositories that merge suites of
+	// other mappings or local repositories.
+	//
+	// Keys are prefixes that must not be used in Mapping nor Local.
+	Union map[string]*UnionConfig `toml:"union"`
+
+	// Filter specifies rules to hide packages for prefixes.
+	//
+	// Keys are prefixes defined in Mapping.
+	Filter map[string]*FilterConfig `toml:"filter"`
+
+	// Pin specifies rules to exclude cached files from eviction.
+	Pin *PinConfig `toml:"pin"`
+
+	// Hook specifies hooks invoked on cache events.
+	Hook []*HookConfig `toml:"hook"`
+
+	// Access specifies access control for clients.
+	Access *AccessConfig `toml:"access"`
+
+	// TLS configures a TLS listener of go-apt-cacher command.
+	//
+	// This is not used by NewCacher.
+	TLS *TLSConfig `toml:"tls"`
+
+	// Observer receives events of Cacher if not nil.
+	//
+	// This is for programs embedding Cacher, and cannot be
+	// specified in configuration files.
+	Observer Observer `toml:"-"`
+}
+
+// MirrorConfig is a configuration to mirror suites of a mapping.
+//
+// All indices and all files listed in Packages and Sources indices
+// of the specified components and architectures are downloaded and
+// excluded from cache eviction.
+type MirrorConfig struct {
+	// Suites is a list of suites (directory names under dists/)
+	// such as "jammy-security".
+	Suites []string `toml:"suites"`
+
+	// Components is a list of components such as "main".
+	Components []string `toml:"components"`
+
+	// Architectures is a list of architectures such as "amd64".
+	//
+	// Architecture independent packages in binary-all are always mirrored.
+	Architectures []string `toml:"architectures"`
+
+	// Sources specifies whether source packages are mirrored.
+	Sources bool `toml:"sources"`
+}
+
+// LocalConfig is a configuration of a local repository.
+//
+// Binary packages are uploaded via HTTP, and indices are generated
+// by go-apt-cacher.
+type LocalConfig struct {
+	// Codename is the name of the suite (directory name under dists/).
+	Codename string `toml:"codename"`
+
+	// Components is a list of components.
+	//
+	// Default is ["main"].
+	Components []string `toml:"components"`
+
+	// Architectures is a list of architectures such as "amd64".
+	//
+	// Architecture independent packages are included in all architectures.
+	Architectures []string `toml:"architectures"`
+
+	// Origin is the value of Origin field in Release.
+	Origin string `toml:"origin"`
+
+	// Label is the value of Label field in Release.
+	Label string `toml:"label"`
+
+	// SigningKey is a file path of an ASCII armored OpenPGP private key
+	// to sign Release.
+	//
+	// If empty, InRelease and Release.gpg are not generated.
+	SigningKey string `toml:"signing_key"`
+
+	// SigningPassphrase is the passphrase for an encrypted SigningKey.
+	SigningPassphrase string `toml:"signing_passphrase"`
+
+	// UploadTokens is a list of tokens allowed to upload packages.
+	//
+	// Tokens are given as bearer tokens or passwords of basic
+	// authentication.
+	UploadTokens []string `toml:"upload_tokens"`
+}
+
+// UnionConfig is a configuration of a union repository.
+//
+// Packages indices of a union are the merge of Packages indices
+// of member suites, and Release is generated by go-apt-cacher.
+type UnionConfig struct {
+	// Codename is the name of the suite (directory name under dists/).
+	Codename string `toml:"codename"`
+
+	// Members is a list of member suites in "<prefix>/<suite>" form
+	// such as "ubuntu/jammy-updates".  Prefixes must be defined in
+	// Mapping or Local.
+	Members []string `toml:"members"`
+
+	// Components is a list of components to be merged.
+	//
+	// Default is ["main"].
+	Components []string `toml:"components"`
+
+	// Architectures is a list of architectures to be merged.
+	Architectures []string `toml:"architectures"`
+
+	// Precedence is the rule to choose a package found in
+	// multiple members.  "first" chooses the package in the
+	// earliest member in Members, and "version" chooses the
+	// package with the highest version.
+	//
+	// Default is "first".
+	Precedence string `toml:"precedence"`
+
+	// Origin is the value of Origin field in Release.
+	Origin string `toml:"origin"`
+
+	// Label is the value of Label field in Release.
+	Label string `toml:"label"`
+
+	// SigningKey is a file path of an ASCII armored OpenPGP private key
+	// to sign Release.
+	//
+	// If empty, InRelease and Release.gpg are not generated.
+	SigningKey string `toml:"signing_key"`
+
+	// SigningPassphrase is the passphrase for an encrypted SigningKey.
+	SigningPassphrase string `toml:"signing_passphrase"`
+}
+
+// FilterConfig is a configuration to hide packages of a mapping.
+//
+// Packages matching any of the rules are omitted from Packages and
+// Sources indices, and their files are refused with 403 Forbidden.
+// As Release is regenerated, clients need to trust SigningKey.
+type FilterConfig struct {
+	// Rules is a list of filter rules.
+	Rules []*FilterRule `toml:"rules"`
+
+	// SigningKey is a file path of an ASCII armored OpenPGP private key
+	// to sign Release.
+	//
+	// If empty, InRelease and Release.gpg are not served.
+	SigningKey string `toml:"signing_key"`
+
+	// SigningPassphrase is the passphrase for an encrypted SigningKey.
+	SigningPassphrase string `toml:"signing_passphrase"`
+}
+
+// FilterRule is a rule to match packages.
+//
+// Package, Source, Section and Priority are shell patterns as
+// described in path.Match.  Empty conditions match any packages.
+// A rule matches a package if all of its conditions match.
+type FilterRule struct {
+	// Name identifies the rule in logs.
+	//
+	// Default is "rules[<index>]".
+	Name string `toml:"name"`
+
+	// Package is a pattern of package names.
+	//
+	// For Sources indices, this is matched against source package names.
+	Package string `toml:"package"`
+
+	// Source is a pattern of source package names.
+	Source string `toml:"source"`
+
+	// Version is a relation such as "<< 1.0-1" or a pattern of versions.
+	//
+	// Relations are one of "<<", "<=", "=", ">=" and ">>".
+	Version string `toml:"version"`
+
+	// Section is a pattern of sections such as "*/games".
+	Section string `toml:"section"`
+
+	// Priority is a pattern of priorities such as "extra".
+	Priority string `toml:"priority"`
+}
+
+// MappingConfig is a configuration of a mapping.
+//
+// Zero values mean the global ones in CacherConfig.
+type MappingConfig struct {
+	// CheckInterval specifies interval in seconds to check updates for
+	// Release/InRelease files of the mapping.
+	CheckInterval int `toml:"check_interval"`
+
+	// CachePeriod specifies the period to cache bad HTTP response
+	// statuses for the mapping.
+	CachePeriod int `toml:"cache_period"`
+
+	// MaxConns specifies the maximum concurrent connections to the
+	// upstream of the mapping.
+	//
+	// If specified, connections are not counted against MaxConns
+	// of CacherConfig.
+	MaxConns int `toml:"max_conns"`
+
+	// Capacity specifies how many bytes can be used for non-meta data
+	// files of the mapping in CacheDirectory.
+	//
+	// Zero means no quota.
+	Capacity ByteSize `toml:"capacity"`
+
+	// Timeout specifies the timeout in seconds to download a file
+	// from the upstream.
+	//
+	// Default is 1800 seconds.
+	Timeout int `toml:"timeout"`
+}
+
+// UpstreamConfig is a configuration to access an upstream repository.
+//
+// Credentials are taken from the first available source of:
+// Username or Token (with PasswordFile or TokenFile), the user
+// information in the mapped URL, and AuthFile.
+// Credentials are sent only to the host of the mapped URL.
+type UpstreamConfig struct {
+	// Username is a user name for HTTP basic authentication.
+	Username string `toml:"username"`
+
+	// Password is the password for Username.
+	Password string `toml:"password"`
+
+	// PasswordFile is a file that contains the password for Username.
+	PasswordFile string `toml:"password_file"`
+
+	// Token is a bearer token.
+	Token string `toml:"token"`
+
+	// TokenFile is a file that contains a bearer token.
+	TokenFile string `toml:"token_file"`
+
+	// AuthFile is a netrc or APT auth.conf file.
+	//
+	// The first entry matching the host and the path of the mapped
+	// URL is used.
+	AuthFile string `toml:"auth_file"`
+
+	// CAFile is a file of PEM encoded CA certificates to verify
+	// the upstream server.
+	//
+	// If specified, system CA certificates are not used.
+	CAFile string `toml:"ca_file"`
+
+	// CertFile is a PEM encoded client certificate for mutual TLS.
+	CertFile string `toml:"cert_file"`
+
+	// KeyFile is a PEM encoded private key of CertFile.
+	KeyFile string `toml:"key_file"`
+
+	// Pins is a list of base64 encoded SHA-256 hashes of public keys
+	// (SPKI) in the form of "sha256//<hash>".
+	//
+	// If specified, the server certificate chain must have one of them.
+	Pins []string `toml:"pins"`
+
+	// ServerName overrides the server name to verify the certificate.
+	ServerName string `toml:"server_name"`
+
+	// Proxy overrides the global proxy for the upstream.
+	//
+	// "direct" disables proxies.
+	Proxy string `toml:"proxy"`
+
+	// NoProxy overrides the global NoProxy for the upstream.
+	NoProxy []string `toml:"no_proxy"`
+}
+
+// HookConfig is a configuration of a hook invoked on cache events.
+//
+// Exactly one of URL or Command must be specified.
+// The event is sent as a JSON object by HTTP POST to URL, or given
+// to Command from stdin.
+type HookConfig struct {
+	// Events is a list of event types such as "downloaded".
+	//
+	// If empty, the hook is invoked for all events.
+	Events []string `toml:"events"`
+
+	// URL is the URL of a webhook.
+	URL string `toml:"url"`
+
+	// Command is a command and its arguments.
+	Command []string `toml:"command"`
+
+	// Retries is the maximum number of retries for failed invocations.
+	//
+	// Default is 3.
+	Retries int `toml:"retries"`
+
+	// Timeout is the timeout in seconds for each invocation.
+	//
+	// Default is 30.
+	Timeout int `toml:"timeout"`
+
+	// QueueSize is the maximum number of queued events.
+	// Events are dropped when the queue is full.
+	//
+	// Default is 1000.
+	QueueSize int `toml:"queue_size"`
+}
+
+// TLSConfig is a configuration of a TLS listener.
+//
+// Certificate files are reloaded when modified, or by SIGHUP.
+type TLSConfig struct {
+	// Listen is the listen address such as ":3143".
+	Listen string `toml:"listen"`
+
+	// CertFile is a PEM encoded certificate file.
+	//
+	// Intermediate certificates may follow the server certificate.
+	CertFile string `toml:"cert_file"`
+
+	// KeyFile is a PEM encoded private key file.
+	KeyFile string `toml:"key_file"`
+
+	// ClientCAFile is a PEM encoded CA certificates file.
+	//
+	// If specified, clients are required to present certificates
+	// signed by one of the CAs.  This is not reloaded.
+	ClientCAFile string `toml:"client_ca_file"`
+
+	// MinVersion is the minimum TLS version: "1.0", "1.1", "1.2" or "1.3".
+	//
+	// Default is "1.2".
+	MinVersion string `toml:"min_version"`
+
+	// ReloadInterval is the interval in seconds to check modification
+	// of certificate files.
+	//
+	// Default is 60.
+	ReloadInterval int `toml:"reload_interval"`
+}
+
+// PinConfig is a set of rules to exclude cached files from eviction.
+//
+// Pinned files are not counted against the cache capacity nor quotas.
+type PinConfig struct {
+	// Paths is a list of patterns of file paths such as
+	// "ubuntu/pool/main/l/linux-*".
+	//
+	// Patterns match paths and their parent directories.
+	Paths []string `toml:"paths"`
+
+	// Mappings is a list of prefixes whose files are all pinned.
+	Mappings []string `toml:"mappings"`
+
+	// Packages is a list of patterns of binary package names.
+	//
+	// Files of matching packages are looked up in Packages indices
+	// cached in MetaDirectory.
+	Packages []string `toml:"packages"`
+}
+
+// AccessConfig is a configuration of access control for clients.
+//
+// Networks are CIDRs such as "10.0.0.0/8" or IP addresses.
+type AccessConfig struct {
+	// Allow is a list of networks allowed to access.
+	//
+	// If empty, all networks not in Deny are allowed.
+	Allow []string `toml:"allow"`
+
+	// Deny is a list of networks denied to access.
+	Deny []string `toml:"deny"`
+
+	// Mapping specifies Allow and Deny for prefixes.
+	//
+	// They are checked in addition to global ones.
+	Mapping map[string]*NetworkConfig `toml:"mapping"`
+
+	// TrustedProxies is a list of networks of reverse proxies.
+	//
+	// For requests from them, client addresses are taken from
+	// X-Forwarded-For header.
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// HtpasswdFile is an htpasswd file for HTTP basic authentication.
+	//
+	// Only bcrypt and SHA1 hashes are supported.
+	HtpasswdFile string `toml:"htpasswd_file"`
+
+	// BearerTokens is a list of tokens accepted as bearer tokens or
+	// passwords of HTTP basic authentication for any user.
+	BearerTokens []string `toml:"bearer_tokens"`
+
+	// AdminUsers is a list of users in HtpasswdFile allowed to
+	// modify snapshots and pin rules through API.
+	AdminUsers []string `toml:"admin_users"`
+
+	// AdminTokens is a list of tokens allowed to modify snapshots
+	// and pin rules through API.  They are also accepted as
+	// BearerTokens.
+	AdminTokens []string `toml:"admin_tokens"`
+}
+
+// NetworkConfig is a pair of allowed and denied networks.
+type NetworkConfig struct {
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
 }
@@ -35,9 +35,36 @@ func TestCacherConfig(t *testing.T) {
 	if config.CacheCapacity != 21 {
 		t.Error(`config.CacheCapacity != 21`)
 	}
+	if config.CacheSize != 20*gib {
+		t.Error(`config.CacheSize != 20*gib`)
+	}
+	if config.FreeSpaceLow != 10*gib || config.FreeSpaceHigh != 15*gib {
+		t.Error(`config.FreeSpaceLow or FreeSpaceHigh`)
+	}
+	if config.Eviction != Eviction2Q {
+		t.Error(`config.Eviction != Eviction2Q`)
+	}
+	if !config.VerifyOnStart || config.QuarantineDirectory != "/tmp/quarantine" {
+		t.Error(`config.VerifyOnStart or QuarantineDirectory`)
+	}
 	if config.MaxConns != 3 {
 		t.Error(`config.MaxConns != 3`)
 	}
+	if !config.PrefetchUpgrades {
+		t.Error(`!config.PrefetchUpgrades`)
+	}
+	if config.FeedSize != 50 {
+		t.Error(`config.FeedSize != 50`)
+	}
+	if config.TLS == nil {
+		t.Fatal(`config.TLS is not defined`)
+	}
+	if config.TLS.Listen != ":3143" || config.TLS.CertFile != "/etc/go-apt-cacher/cert.pem" {
+		t.Error(`config.TLS`)
+	}
+	if config.TLS.MinVersion != "1.2" {
+		t.Error(`config.TLS.MinVersion != "1.2"`)
+	}
 
 	if config.Mapping["ubuntu"] != "http://archive.ubuntu.com/ubuntu" {
 		t.Error(`config.Mapping["ubuntu"]`)
@@ -48,4 +75,156 @@ func TestCacherConfig(t *testing.T) {
 	if config.Mapping["dell"] != "http://linux.dell.com/repo/community/ubuntu" {
 		t.Error(`config.Mapping["dell"]`)
 	}
+	security := config.MappingOptions["security"]
+	if security == nil {
+		t.Fatal(`config.MappingOptions["security"] is not defined`)
+	}
+	if security.CheckInterval != 60 || security.MaxConns != 2 {
+		t.Error(`config.MappingOptions["security"] intervals`)
+	}
+	if security.Capacity != 50*1000*1000*1000 || security.Timeout != 600 {
+		t.Error(`config.MappingOptions["security"] capacity or timeout`)
+	}
+	if _, ok := config.MappingOptions["ubuntu"]; ok {
+		t.Error(`config.MappingOptions["ubuntu"] must not be defined`)
+	}
+
+	mc, ok := config.Mirror["security"]
+	if !ok {
+		t.Fatal(`config.Mirror["security"] is not defined`)
+	}
+	if len(mc.Suites) != 1 || mc.Suites[0] != "trusty-security" {
+		t.Error(`mc.Suites`)
+	}
+	if len(mc.Components) != 2 {
+		t.Error(`len(mc.Components) != 2`)
+	}
+	if len(mc.Architectures) != 1 || mc.Architectures[0] != "amd64" {
+		t.Error(`mc.Architectures`)
+	}
+	if !mc.Sources {
+		t.Error(`!mc.Sources`)
+	}
+
+	lc, ok := config.Local["internal"]
+	if !ok {
+		t.Fatal(`config.Local["internal"] is not defined`)
+	}
+	if lc.Codename != "stable" {
+		t.Error(`lc.Codename != "stable"`)
+	}
+	if len(lc.Architectures) != 2 {
+		t.Error(`len(lc.Architectures) != 2`)
+	}
+	if lc.Origin != "Cybozu" {
+		t.Error(`lc.Origin != "Cybozu"`)
+	}
+	if len(lc.UploadTokens) != 1 || lc.UploadTokens[0] != "secret" {
+		t.Error(`lc.UploadTokens`)
+	}
+
+	uc, ok := config.Union["all"]
+	if !ok {
+		t.Fatal(`config.Union["all"] is not defined`)
+	}
+	if len(uc.Members) != 2 || uc.Members[0] != "internal/stable" {
+		t.Error(`uc.Members`)
+	}
+	if uc.Precedence != "version" {
+		t.Error(`uc.Precedence != "version"`)
+	}
+
+	fc, ok := config.Filter["ubuntu"]
+	if !ok {
+		t.Fatal(`config.Filter["ubuntu"] is not defined`)
+	}
+	if len(fc.Rules) != 2 {
+		t.Fatal(`len(fc.Rules) != 2`)
+	}
+	if fc.Rules[0].Name != "bad-openssl" || fc.Rules[0].Source != "openssl" {
+		t.Error(`fc.Rules[0]`)
+	}
+	if fc.Rules[1].Section != "*/games" {
+		t.Error(`fc.Rules[1].Section != "*/games"`)
+	}
+
+	if uc, ok := config.Upstream["dell"]; !ok || uc.Username != "user" || uc.PasswordFile == "" {
+		t.Error(`config.Upstream["dell"]`)
+	}
+	if uc, ok := config.Upstream["dell"]; !ok || uc.CAFile == "" || len(uc.Pins) != 1 {
+		t.Error(`config.Upstream["dell"] TLS`)
+	}
+	if config.Proxy != "http://proxy.example.com:3128" || len(config.NoProxy) != 2 {
+		t.Error(`config.Proxy or config.NoProxy`)
+	}
+	if uc, ok := config.Upstream["dell"]; !ok || uc.Proxy != "direct" {
+		t.Error(`config.Upstream["dell"].Proxy`)
+	}
+
+	if config.Access == nil {
+		t.Fatal(`config.Access is not defined`)
+	}
+	if len(config.Access.Allow) != 2 || len(config.Access.Deny) != 1 {
+		t.Error(`config.Access.Allow or Deny`)
+	}
+	if len(config.Access.TrustedProxies) != 1 || len(config.Access.BearerTokens) != 1 {
+		t.Error(`config.Access.TrustedProxies or BearerTokens`)
+	}
+	if len(config.Access.AdminTokens) != 1 {
+		t.Error(`config.Access.AdminTokens`)
+	}
+	if mc, ok := config.Access.Mapping["internal"]; !ok || len(mc.Allow) != 1 {
+		t.Error(`config.Access.Mapping["internal"]`)
+	}
+
+	if config.Pin == nil {
+		t.Fatal(`config.Pin is not defined`)
+	}
+	if len(config.Pin.Paths) != 1 || len(config.Pin.Mappings) != 1 || len(config.Pin.Packages) != 2 {
+		t.Error(`config.Pin`)
+	}
+
+	if len(config.Hook) != 2 {
+		t.Fatal(`len(config.Hook) != 2`)
+	}
+	if len(config.Hook[0].Events) != 2 || config.Hook[0].URL != "http://localhost:8080/hook" {
+		t.Error(`config.Hook[0]`)
+	}
+	if len(config.Hook[1].Command) != 2 || config.Hook[1].Retries != 5 {
+		t.Error(`config.Hook[1]`)
+	}
+}
+
+func TestMappingConfig(t *testing.T) {
+	t.Parallel()
+
+	var config CacherConfig
+	_, err := toml.Decode(`
+[mapping]
+ubuntu = "http://archive.ubuntu.com/ubuntu"
+ports = "http://ports.ubuntu.com/ubuntu-ports"
+[mapping_options.ports]
+capacity = "50GiB"
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Mapping["ports"] != "http://ports.ubuntu.com/ubuntu-ports" {
+		t.Error(`config.Mapping["ports"]`)
+	}
+	if config.MappingOptions["ports"].Capacity != 50*gib {
+		t.Error(`config.MappingOptions["ports"].Capacity != 50*gib`)
+	}
+
+	bad := []string{
+		"[mapping_options.ports]\ncheck_interval = \"60\"\n",
+		"[mapping_options.ports]\ncapacity = \"50 GB of disk\"\n",
+		"[mapping]\nports = 50\n",
+	}
+	for _, data := range bad {
+		var config CacherConfig
+		if _, err := toml.Decode(data, &config); err == nil {
+			t.Error(`invalid mapping must be an error:`, data)
+		}
+	}
 }
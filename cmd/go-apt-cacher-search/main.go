@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	aptcacher "github.com/cybozu-go/go-apt-cacher"
+	"github.com/cybozu-go/log"
+)
+
+const (
+	defaultServer = "http://localhost:3142"
+)
+
+var (
+	server     = flag.String("s", defaultServer, "go-apt-cacher URL")
+	source     = flag.String("source", "", "source package name pattern")
+	version    = flag.String("version", "", "version pattern or relation such as \"<< 1.0\"")
+	arch       = flag.String("arch", "", "architecture pattern; \"source\" for source packages")
+	prefix     = flag.String("prefix", "", "mapping prefix")
+	suite      = flag.String("suite", "", "suite name")
+	limit      = flag.Int("limit", 0, "maximum number of results")
+	jsonOutput = flag.Bool("json", false, "output results in JSON")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] [PACKAGE]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "PACKAGE is a package name pattern such as \"libssl*\".")
+	fmt.Fprintln(os.Stderr, "\nOptions:")
+	flag.PrintDefaults()
+}
+
+func search(query url.Values) ([]byte, error) {
+	u := strings.TrimSuffix(*server, "/") + "/_api/search?" + query.Encode()
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	query := url.Values{}
+	query.Set("package", flag.Arg(0))
+	query.Set("source", *source)
+	query.Set("version", *version)
+	query.Set("arch", *arch)
+	query.Set("prefix", *prefix)
+	query.Set("suite", *suite)
+	if *limit > 0 {
+		query.Set("limit", strconv.Itoa(*limit))
+	}
+
+	body, err := search(query)
+	if err != nil {
+		log.ErrorExit(err)
+	}
+	if *jsonOutput {
+		os.Stdout.Write(body)
+		return
+	}
+
+	var results []*aptcacher.SearchResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		log.ErrorExit(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tVERSION\tARCH\tCACHED\tSIZE\tPATH")
+	for _, res := range results {
+		for _, f := range res.Files {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%d\t%s\n",
+				res.Package, res.Version, res.Architecture, f.Cached, f.Size, f.Path)
+		}
+	}
+	w.Flush()
+}
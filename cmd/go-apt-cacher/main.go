@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
@@ -23,14 +25,15 @@ const (
 
 var (
 	configPath    = flag.String("f", defaultConfigPath, "configuration file name")
-	listenAddress = flag.String("s", defaultAddress, "listen address")
+	listenAddress = flag.String("s", defaultAddress, "listen address; empty to disable plain HTTP")
 	logLevel      = flag.String("l", "info", "log level [critical/error/warning/info/debug]")
 )
 
 func main() {
 	flag.Parse()
 
-	err := log.DefaultLogger().SetThresholdByName(*logLevel)
+	logger := log.DefaultLogger()
+	err := logger.SetThresholdByName(*logLevel)
 	if err != nil {
 		log.ErrorExit(err)
 	}
@@ -50,28 +53,91 @@ func main() {
 		config.MaxConns = defaultMaxConns
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "verify":
+		report, err := aptcacher.Verify(&config)
+		if err != nil {
+			log.ErrorExit(err)
+		}
+		report.WriteTo(os.Stdout)
+		return
+	default:
+		log.ErrorExit(errors.New("unknown command: " + flag.Arg(0)))
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	cacher, err := aptcacher.NewCacher(ctx, &config)
+	cacher, err := aptcacher.NewCacher(ctx, &config, aptcacher.WithLogger(logger))
 	if err != nil {
 		log.ErrorExit(err)
 	}
 
-	l, err := net.Listen("tcp", *listenAddress)
-	if err != nil {
-		log.ErrorExit(err)
+	var listeners []net.Listener
+	if *listenAddress != "" {
+		l, err := net.Listen("tcp", *listenAddress)
+		if err != nil {
+			log.ErrorExit(err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	var reloader *aptcacher.CertReloader
+	if config.TLS != nil {
+		if config.TLS.Listen == "" {
+			log.ErrorExit(errors.New("tls.listen must be specified"))
+		}
+		tc, r, err := aptcacher.NewTLSConfig(config.TLS)
+		if err != nil {
+			log.ErrorExit(err)
+		}
+		reloader = r
+		reloader.SetLogger(logger)
+		go reloader.Watch(ctx, config.TLS.WatchInterval())
+
+		l, err := net.Listen("tcp", config.TLS.Listen)
+		if err != nil {
+			log.ErrorExit(err)
+		}
+		listeners = append(listeners, tls.NewListener(l, tc))
+	}
+	if len(listeners) == 0 {
+		log.ErrorExit(errors.New("no listen address"))
 	}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- aptcacher.Serve(ctx, l, cacher)
-	}()
+	done := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			done <- aptcacher.Serve(ctx, l, cacher)
+		}(l)
+	}
 
 	sig := make(chan os.Signal, 10)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			break
+		}
+		if reloader == nil {
+			continue
+		}
+		if err := reloader.Reload(); err != nil {
+			log.Error("failed to reload certificate", map[string]interface{}{
+				"_err": err.Error(),
+			})
+			continue
+		}
+		log.Info("certificate reloaded", nil)
+	}
 	signal.Stop(sig)
 	cancel()
-	if err := <-done; err != nil {
-		log.Error(err.Error(), nil)
+	for range listeners {
+		if err := <-done; err != nil {
+			log.Error(err.Error(), nil)
+		}
+	}
+	if err := cacher.SaveState(); err != nil {
+		log.Error("failed to save eviction state", map[string]interface{}{
+			"_err": err.Error(),
+		})
 	}
 }
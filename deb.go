@@ -0,0 +1,100 @@
+package aptcacher
+
+// This file implements a reader for binary packages (.deb files).
+//
+// A .deb file is an ar archive containing debian-binary,
+// control.tar.* and data.tar.* members.  See deb(5).
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+)
+
+// readControlTar reads the control file in control.tar.
+func readControlTar(r io.Reader) (Paragraph, error) {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("no control file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Clean(h.Name) != "control" {
+			continue
+		}
+		return NewParser(tr).Read()
+	}
+}
+
+// ReadDebControl reads the control file of a .deb file.
+//
+// control.tar may be uncompressed or compressed with gzip or xz.
+// Other compressions such as zstd are not supported.
+func ReadDebControl(r io.Reader) (Paragraph, error) {
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != arMagic {
+		return nil, errors.New("not a deb file")
+	}
+
+	header := make([]byte, arHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil, errors.New("no control.tar")
+			}
+			return nil, err
+		}
+		if string(header[58:60]) != "`\n" {
+			return nil, errors.New("invalid ar header")
+		}
+		name := strings.TrimRight(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid ar header")
+		}
+		member := io.LimitReader(r, size)
+
+		switch name {
+		case "control.tar":
+			return readControlTar(member)
+		case "control.tar.gz":
+			gz, err := gzip.NewReader(member)
+			if err != nil {
+				return nil, err
+			}
+			return readControlTar(gz)
+		case "control.tar.xz":
+			xr, err := xz.NewReader(member)
+			if err != nil {
+				return nil, err
+			}
+			return readControlTar(xr)
+		}
+		if strings.HasPrefix(name, "control.tar.") {
+			return nil, errors.New("unsupported control.tar compression: " + name)
+		}
+
+		// members are aligned to even offsets.
+		if _, err := io.CopyN(ioutil.Discard, r, size+size%2); err != nil {
+			return nil, err
+		}
+	}
+}
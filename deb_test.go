@@ -0,0 +1,104 @@
+package aptcacher
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// makeDeb creates a minimal .deb file with a control file.
+func makeDeb(control string) []byte {
+	var ctar bytes.Buffer
+	gz := gzip.NewWriter(&ctar)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "./", Mode: 0755, Typeflag: tar.TypeDir})
+	tw.WriteHeader(&tar.Header{Name: "./control", Mode: 0644, Size: int64(len(control))})
+	tw.Write([]byte(control))
+	tw.Close()
+	gz.Close()
+
+	var buf bytes.Buffer
+	buf.WriteString(arMagic)
+	member := func(name string, data []byte) {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", name, 0, 0, 0, "100644", len(data))
+		buf.Write(data)
+		if len(data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	member("debian-binary", []byte("2.0\n"))
+	member("control.tar.gz", ctar.Bytes())
+	member("data.tar.xz", []byte{})
+	return buf.Bytes()
+}
+
+func TestReadDebControl(t *testing.T) {
+	t.Parallel()
+
+	deb := makeDeb(`Package: hoge
+Version: 1.0-1
+Architecture: amd64
+Description: test package
+ This is a test.
+`)
+
+	d, err := ReadDebControl(bytes.NewReader(deb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.get("Package") != "hoge" {
+		t.Error(`d.get("Package") != "hoge"`)
+	}
+	if d.get("Version") != "1.0-1" {
+		t.Error(`d.get("Version") != "1.0-1"`)
+	}
+	if len(d["Description"]) != 2 {
+		t.Error(`len(d["Description"]) != 2`)
+	}
+
+	_, err = ReadDebControl(bytes.NewReader([]byte("not a deb")))
+	if err == nil {
+		t.Error(`err == nil`)
+	}
+}
+
+func TestReadDebControlFixtures(t *testing.T) {
+	t.Parallel()
+
+	// built by dpkg-deb -Zgzip, -Zxz and -Zzstd respectively.
+	for _, name := range []string{"t/hoge-gz.deb", "t/hoge-xz.deb"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := ReadDebControl(f)
+		f.Close()
+		if err != nil {
+			t.Error(name, err)
+			continue
+		}
+		if d.get("Package") != "hoge" {
+			t.Error(name, `d.get("Package") != "hoge"`)
+		}
+		if d.get("Maintainer") != "Test <test@example.com>" {
+			t.Error(name, `d.get("Maintainer") != "Test <test@example.com>"`)
+		}
+	}
+
+	f, err := os.Open("t/hoge-zst.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = ReadDebControl(f)
+	if err == nil {
+		t.Fatal(`err == nil`)
+	}
+	if !strings.Contains(err.Error(), "control.tar.zst") {
+		t.Error(`!strings.Contains(err.Error(), "control.tar.zst")`)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package aptcacher
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// freeSpace returns the available bytes of the file system for dir.
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free space is not supported on this platform")
+}
+
+// diskSize returns the bytes of blocks allocated for a file.
+func diskSize(fi os.FileInfo) uint64 {
+	return uint64(fi.Size())
+}
@@ -0,0 +1,26 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package aptcacher
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the available bytes of the file system for dir.
+func freeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// diskSize returns the bytes of blocks allocated for a file.
+func diskSize(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Blocks) * 512
+	}
+	return uint64(fi.Size())
+}
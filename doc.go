@@ -1,5 +1,25 @@
 /*
 Package aptcacher provides utilities for Debian repository as well as
 the core logics for go-apt-cacher.
+
+Cacher can be embedded in other programs.  Create it with NewCacher,
+optionally with Options to replace the HTTP client, the logger, the
+clock or storages, and serve c.Handler() with your own http.Server:
+
+	c, err := aptcacher.NewCacher(ctx, config,
+		aptcacher.WithHTTPClient(client),
+		aptcacher.WithLogger(logger))
+	if err != nil {
+		return err
+	}
+	mux.Handle("/", c.Handler())
+
+Storages for meta data and other items can be replaced with any
+Store implementations such as MemoryStore by WithStorage.
+
+Items can also be retrieved directly by GetContext, which returns
+details of the item such as checksums and whether it was a cache hit.
+
+Set CacherConfig.Observer to receive events of Cacher.
 */
 package aptcacher
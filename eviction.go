@@ -0,0 +1,348 @@
+package aptcacher
+
+// This file implements eviction policies of Storage.
+
+import (
+	"container/heap"
+	"container/list"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Names of eviction policies.
+const (
+	EvictionLRU = "lru"
+	EvictionLFU = "lfu"
+	Eviction2Q  = "2q"
+)
+
+// evictionPolicy decides the order to evict entries of Storage.
+//
+// Pinned entries are never added to policies.
+// Methods are called with Storage.mu held.
+type evictionPolicy interface {
+	// add adds an entry.  Entries are added in the order of
+	// atime when loaded.
+	add(e *entry)
+
+	// touch is called after e is accessed.
+	// e.atime and e.hits are updated beforehand.
+	touch(e *entry)
+
+	// remove removes e.
+	remove(e *entry)
+
+	// evict removes and returns the entry to be evicted next.
+	// If empty, nil is returned.
+	evict() *entry
+
+	// len returns the number of entries.
+	len() int
+
+	// walk calls fn for entries in the order of eviction
+	// until fn returns false.
+	walk(fn func(e *entry) bool)
+}
+
+func newEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case EvictionLRU:
+		return newLRUPolicy(), nil
+	case EvictionLFU:
+		return newLFUPolicy(), nil
+	case Eviction2Q:
+		return newTwoQPolicy(), nil
+	}
+	return nil, errors.New("unknown eviction policy: " + name)
+}
+
+// heapPolicy evicts entries in the order of less.
+// It uses entry.index.
+type heapPolicy struct {
+	entries []*entry
+	less    func(a, b *entry) bool
+}
+
+// Len implements heap.Interface.
+func (p *heapPolicy) Len() int {
+	return len(p.entries)
+}
+
+// Less implements heap.Interface.
+func (p *heapPolicy) Less(i, j int) bool {
+	return p.less(p.entries[i], p.entries[j])
+}
+
+// Swap implements heap.Interface.
+func (p *heapPolicy) Swap(i, j int) {
+	p.entries[i], p.entries[j] = p.entries[j], p.entries[i]
+	p.entries[i].index = i
+	p.entries[j].index = j
+}
+
+// Push implements heap.Interface.
+func (p *heapPolicy) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(p.entries)
+	p.entries = append(p.entries, e)
+}
+
+// Pop implements heap.Interface.
+func (p *heapPolicy) Pop() interface{} {
+	n := len(p.entries)
+	e := p.entries[n-1]
+	e.index = -1 // for safety
+	p.entries = p.entries[0 : n-1]
+	return e
+}
+
+func (p *heapPolicy) add(e *entry) {
+	heap.Push(p, e)
+}
+
+func (p *heapPolicy) touch(e *entry) {
+	heap.Fix(p, e.index)
+}
+
+func (p *heapPolicy) remove(e *entry) {
+	heap.Remove(p, e.index)
+}
+
+func (p *heapPolicy) evict() *entry {
+	if len(p.entries) == 0 {
+		return nil
+	}
+	return heap.Pop(p).(*entry)
+}
+
+func (p *heapPolicy) len() int {
+	return len(p.entries)
+}
+
+func (p *heapPolicy) walk(fn func(e *entry) bool) {
+	l := make([]*entry, len(p.entries))
+	copy(l, p.entries)
+	sort.Sort(entrySorter{l, p.less})
+	for _, e := range l {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
+// entrySorter implements sort.Interface.
+type entrySorter struct {
+	entries []*entry
+	less    func(a, b *entry) bool
+}
+
+func (s entrySorter) Len() int {
+	return len(s.entries)
+}
+
+func (s entrySorter) Less(i, j int) bool {
+	return s.less(s.entries[i], s.entries[j])
+}
+
+func (s entrySorter) Swap(i, j int) {
+	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
+}
+
+// newLRUPolicy returns a policy to evict the least recently used
+// entry first.
+func newLRUPolicy() *heapPolicy {
+	return &heapPolicy{
+		less: func(a, b *entry) bool {
+			return a.atime < b.atime
+		},
+	}
+}
+
+// lfuPolicy evicts the least frequently used entry first.
+//
+// To evict entries that were popular long ago, this implements
+// LFU with dynamic aging (LFUDA); the priority of an entry is the
+// number of hits plus the priority of the last evicted entry.
+type lfuPolicy struct {
+	heapPolicy
+	age uint64
+}
+
+func newLFUPolicy() *lfuPolicy {
+	p := &lfuPolicy{}
+	p.heapPolicy.less = func(a, b *entry) bool {
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		return a.atime < b.atime
+	}
+	return p
+}
+
+func (p *lfuPolicy) add(e *entry) {
+	e.priority = p.age + e.hits
+	p.heapPolicy.add(e)
+}
+
+func (p *lfuPolicy) touch(e *entry) {
+	e.priority = p.age + e.hits
+	p.heapPolicy.touch(e)
+}
+
+func (p *lfuPolicy) evict() *entry {
+	e := p.heapPolicy.evict()
+	if e != nil {
+		p.age = e.priority
+	}
+	return e
+}
+
+// twoQPolicy is a scan resistant policy based on 2Q.
+//
+// New entries are put in a FIFO queue (A1in).  Entries evicted from
+// A1in are remembered by their paths (A1out), and if they are cached
+// again, they are put in an LRU queue (Am).  Entries in A1in are
+// evicted first while A1in has more than a quarter of the total size.
+//
+// As a result, a burst of accesses to rarely used items does not
+// flush frequently used items in Am.
+type twoQPolicy struct {
+	a1in  *list.List
+	am    *list.List
+	elems map[*entry]*list.Element
+	inAm  map[*entry]bool
+
+	a1inSize  uint64
+	totalSize uint64
+
+	// A1out; paths of entries evicted from A1in.
+	ghosts    *list.List
+	ghostElem map[string]*list.Element
+}
+
+const (
+	minTwoQGhosts = 100
+)
+
+func newTwoQPolicy() *twoQPolicy {
+	return &twoQPolicy{
+		a1in:      list.New(),
+		am:        list.New(),
+		elems:     make(map[*entry]*list.Element),
+		inAm:      make(map[*entry]bool),
+		ghosts:    list.New(),
+		ghostElem: make(map[string]*list.Element),
+	}
+}
+
+func (p *twoQPolicy) add(e *entry) {
+	p.totalSize += e.size
+
+	// entries loaded with hits were used frequently.
+	ghost, ok := p.ghostElem[e.path]
+	if ok || e.hits > 1 {
+		if ok {
+			p.ghosts.Remove(ghost)
+			delete(p.ghostElem, e.path)
+		}
+		p.elems[e] = p.am.PushBack(e)
+		p.inAm[e] = true
+		return
+	}
+
+	p.a1inSize += e.size
+	p.elems[e] = p.a1in.PushBack(e)
+}
+
+func (p *twoQPolicy) touch(e *entry) {
+	// accesses to entries in A1in are considered correlated.
+	if p.inAm[e] {
+		p.am.MoveToBack(p.elems[e])
+	}
+}
+
+func (p *twoQPolicy) remove(e *entry) {
+	elem, ok := p.elems[e]
+	if !ok {
+		return
+	}
+	delete(p.elems, e)
+	p.totalSize -= e.size
+	if p.inAm[e] {
+		delete(p.inAm, e)
+		p.am.Remove(elem)
+		return
+	}
+	p.a1inSize -= e.size
+	p.a1in.Remove(elem)
+}
+
+// aboveTarget returns true if A1in of a1inSize is above its target
+// size, a quarter of totalSize.
+func aboveTarget(a1inSize, totalSize uint64) bool {
+	return a1inSize > totalSize/4
+}
+
+func (p *twoQPolicy) evictA1in() bool {
+	return p.a1in.Len() > 0 && (p.am.Len() == 0 || aboveTarget(p.a1inSize, p.totalSize))
+}
+
+func (p *twoQPolicy) evict() *entry {
+	var e *entry
+	switch {
+	case p.evictA1in():
+		e = p.a1in.Front().Value.(*entry)
+		p.remember(e.path)
+	case p.am.Len() > 0:
+		e = p.am.Front().Value.(*entry)
+	default:
+		return nil
+	}
+	p.remove(e)
+	return e
+}
+
+// remember adds p to A1out.
+func (p *twoQPolicy) remember(path string) {
+	if _, ok := p.ghostElem[path]; ok {
+		return
+	}
+	p.ghostElem[path] = p.ghosts.PushBack(path)
+
+	max := len(p.elems) / 2
+	if max < minTwoQGhosts {
+		max = minTwoQGhosts
+	}
+	for p.ghosts.Len() > max {
+		front := p.ghosts.Front()
+		delete(p.ghostElem, front.Value.(string))
+		p.ghosts.Remove(front)
+	}
+}
+
+func (p *twoQPolicy) len() int {
+	return len(p.elems)
+}
+
+// walk visits entries in the same order as successive evict calls,
+// that is, A1in is visited only while it is above its target size.
+func (p *twoQPolicy) walk(fn func(e *entry) bool) {
+	in, am := p.a1in.Front(), p.am.Front()
+	a1inSize, totalSize := p.a1inSize, p.totalSize
+	for in != nil || am != nil {
+		var e *entry
+		if in != nil && (am == nil || aboveTarget(a1inSize, totalSize)) {
+			e = in.Value.(*entry)
+			in = in.Next()
+			a1inSize -= e.size
+		} else {
+			e = am.Value.(*entry)
+			am = am.Next()
+		}
+		totalSize -= e.size
+		if !fn(e) {
+			return
+		}
+	}
+}
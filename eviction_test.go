@@ -0,0 +1,163 @@
+package aptcacher
+
+import (
+	"testing"
+)
+
+// testEntries adds entries of size 1 to p in the order of names.
+func testEntries(p evictionPolicy, names ...string) map[string]*entry {
+	m := make(map[string]*entry)
+	for i, n := range names {
+		e := &entry{
+			FileInfo: &FileInfo{path: n, size: 1},
+			atime:    uint64(i),
+			index:    -1,
+		}
+		m[n] = e
+		p.add(e)
+	}
+	return m
+}
+
+func testAccess(p evictionPolicy, e *entry, atime uint64) {
+	e.atime = atime
+	e.hits++
+	p.touch(e)
+}
+
+func testEvict(t *testing.T, p evictionPolicy, expected ...string) {
+	for _, n := range expected {
+		e := p.evict()
+		if e == nil {
+			t.Fatal(`e == nil`)
+		}
+		if e.path != n {
+			t.Error(`e.path != n`, e.path, n)
+		}
+	}
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{EvictionLRU, EvictionLFU, Eviction2Q} {
+		p, err := newEvictionPolicy(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := testEntries(p, "a", "b", "c")
+		if p.len() != 3 {
+			t.Error(name, `p.len() != 3`)
+		}
+
+		var walked []string
+		p.walk(func(e *entry) bool {
+			walked = append(walked, e.path)
+			return true
+		})
+		if len(walked) != 3 || walked[0] != "a" || walked[2] != "c" {
+			t.Error(name, `wrong walk order`, walked)
+		}
+
+		p.remove(m["a"])
+		if p.len() != 2 {
+			t.Error(name, `p.len() != 2`)
+		}
+		testEvict(t, p, "b", "c")
+		if p.evict() != nil {
+			t.Error(name, `p.evict() != nil`)
+		}
+	}
+
+	if _, err := newEvictionPolicy("mru"); err == nil {
+		t.Error(`mru should be an error`)
+	}
+}
+
+func TestLRUPolicy(t *testing.T) {
+	t.Parallel()
+
+	p := newLRUPolicy()
+	m := testEntries(p, "a", "b", "c")
+	testAccess(p, m["a"], 10)
+	testEvict(t, p, "b", "c", "a")
+}
+
+func TestLFUPolicy(t *testing.T) {
+	t.Parallel()
+
+	p := newLFUPolicy()
+	m := testEntries(p, "a", "b", "c")
+	testAccess(p, m["a"], 10)
+	testAccess(p, m["a"], 11)
+	testAccess(p, m["b"], 12)
+	testEvict(t, p, "c")
+
+	// with aging, new entries can outlive popular but stale ones.
+	d := &entry{FileInfo: &FileInfo{path: "d", size: 1}, atime: 13, index: -1}
+	p.add(d)
+	testAccess(p, d, 14)
+	testAccess(p, d, 15)
+	testEvict(t, p, "b", "a", "d")
+}
+
+func TestTwoQPolicy(t *testing.T) {
+	t.Parallel()
+
+	p := newTwoQPolicy()
+	m := testEntries(p, "hot1", "hot2")
+	p.evict()
+	p.evict()
+
+	// re-inserted entries are put in Am.
+	p.add(m["hot1"])
+	p.add(m["hot2"])
+	if !p.inAm[m["hot1"]] || !p.inAm[m["hot2"]] {
+		t.Fatal(`hot entries are not in Am`)
+	}
+
+	// a scan of new entries does not flush hot entries.
+	scan := testEntries(p, "s1", "s2", "s3", "s4", "s5", "s6")
+	for _, e := range scan {
+		testAccess(p, e, 100)
+	}
+	testEvict(t, p, "s1", "s2", "s3", "s4", "s5", "s6", "hot1", "hot2")
+
+	// entries loaded with hits go to Am.
+	e := &entry{FileInfo: &FileInfo{path: "x", size: 1}, hits: 5}
+	p.add(e)
+	if !p.inAm[e] {
+		t.Error(`entry with hits is not in Am`)
+	}
+}
+
+func TestTwoQPolicyWalk(t *testing.T) {
+	t.Parallel()
+
+	p := newTwoQPolicy()
+	var hot []*entry
+	for _, n := range []string{"hot1", "hot2", "hot3", "hot4"} {
+		e := &entry{FileInfo: &FileInfo{path: n, size: 1}, hits: 5}
+		hot = append(hot, e)
+		p.add(e)
+	}
+	testEntries(p, "new")
+
+	// A1in is below its target until two entries in Am are evicted.
+	expected := []string{"hot1", "hot2", "new", "hot3", "hot4"}
+	var walked []string
+	p.walk(func(e *entry) bool {
+		walked = append(walked, e.path)
+		return true
+	})
+	if len(walked) != len(expected) {
+		t.Fatal(`wrong walk order`, walked)
+	}
+	for i := range expected {
+		if walked[i] != expected[i] {
+			t.Error(`wrong walk order`, walked)
+			break
+		}
+	}
+	testEvict(t, p, expected...)
+}
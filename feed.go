@@ -0,0 +1,261 @@
+package aptcacher
+
+// This file implements the update feed.
+//
+// When an index is updated, changes of packages between the previous
+// and the new index are recorded for each suite, and served as JSON
+// or Atom feed.
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PackageChange represents a change of a package in an index.
+type PackageChange struct {
+	Package      string `json:"package"`
+	Architecture string `json:"architecture"`
+
+	// OldVersion is empty for added packages.
+	OldVersion string `json:"old_version,omitempty"`
+
+	// NewVersion is empty for removed packages.
+	NewVersion string `json:"new_version,omitempty"`
+}
+
+// FeedEntry represents changes of packages by an update of an index.
+type FeedEntry struct {
+	// Time is the time when the update was detected.
+	Time time.Time `json:"time"`
+
+	// Index is the path of the updated index.
+	Index string `json:"index"`
+
+	Added      []*PackageChange `json:"added"`
+	Removed    []*PackageChange `json:"removed"`
+	Upgraded   []*PackageChange `json:"upgraded"`
+	Downgraded []*PackageChange `json:"downgraded"`
+}
+
+func (e *FeedEntry) empty() bool {
+	return len(e.Added) == 0 && len(e.Removed) == 0 &&
+		len(e.Upgraded) == 0 && len(e.Downgraded) == 0
+}
+
+// filter returns a copy of e that contains only changes of packages
+// matching pattern.
+func (e *FeedEntry) filter(pattern string) *FeedEntry {
+	f := func(l []*PackageChange) []*PackageChange {
+		l2 := []*PackageChange{}
+		for _, pc := range l {
+			if matchPattern(pattern, pc.Package) {
+				l2 = append(l2, pc)
+			}
+		}
+		return l2
+	}
+	return &FeedEntry{
+		Time:       e.Time,
+		Index:      e.Index,
+		Added:      f(e.Added),
+		Removed:    f(e.Removed),
+		Upgraded:   f(e.Upgraded),
+		Downgraded: f(e.Downgraded),
+	}
+}
+
+// diffPackages compares packages in the previous and the new index.
+func diffPackages(older, newer map[string]*binaryPackage) *FeedEntry {
+	e := &FeedEntry{
+		Added:      []*PackageChange{},
+		Removed:    []*PackageChange{},
+		Upgraded:   []*PackageChange{},
+		Downgraded: []*PackageChange{},
+	}
+
+	keys := make([]string, 0, len(older)+len(newer))
+	for k := range newer {
+		keys = append(keys, k)
+	}
+	for k := range older {
+		if _, ok := newer[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		obp, oldOk := older[k]
+		bp, newOk := newer[k]
+		switch {
+		case !oldOk:
+			e.Added = append(e.Added, &PackageChange{bp.name, bp.arch, "", bp.version})
+		case !newOk:
+			e.Removed = append(e.Removed, &PackageChange{obp.name, obp.arch, obp.version, ""})
+		default:
+			pc := &PackageChange{bp.name, bp.arch, obp.version, bp.version}
+			switch c := CompareVersion(bp.version, obp.version); {
+			case c > 0:
+				e.Upgraded = append(e.Upgraded, pc)
+			case c < 0:
+				e.Downgraded = append(e.Downgraded, pc)
+			}
+		}
+	}
+	return e
+}
+
+// suiteDir returns the suite directory of an index p.
+func suiteDir(p string) string {
+	t := strings.SplitN(p, "/", 4)
+	if len(t) < 3 {
+		return path.Dir(p)
+	}
+	return path.Join(t[0], t[1], t[2])
+}
+
+// recordUpdate records changes of packages in an updated index p.
+func (c *Cacher) recordUpdate(p string, older, newer map[string]*binaryPackage) {
+	e := diffPackages(older, newer)
+	if e.empty() {
+		return
+	}
+	e.Time = c.now().UTC()
+	e.Index = p
+
+	dir := suiteDir(p)
+	c.feedLock.Lock()
+	l := append(c.feeds[dir], e)
+	if len(l) > c.feedSize {
+		l = l[len(l)-c.feedSize:]
+	}
+	c.feeds[dir] = l
+	c.feedLock.Unlock()
+
+	c.logger.Info("feed: index updated", map[string]interface{}{
+		"_path":       p,
+		"_added":      len(e.Added),
+		"_removed":    len(e.Removed),
+		"_upgraded":   len(e.Upgraded),
+		"_downgraded": len(e.Downgraded),
+	})
+}
+
+// Feed returns recorded updates of indices in a suite, newest first.
+//
+// If pattern is not empty, only changes of packages whose names
+// match pattern are returned.
+func (c *Cacher) Feed(prefix, suite, pattern string) []*FeedEntry {
+	c.feedLock.Lock()
+	l := c.feeds[path.Join(prefix, "dists", suite)]
+	c.feedLock.Unlock()
+
+	entries := []*FeedEntry{}
+	for i := len(l) - 1; i >= 0; i-- {
+		e := l[i]
+		if pattern != "" {
+			e = e.filter(pattern)
+			if e.empty() {
+				continue
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Content atomContent `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Link    atomLink     `xml:"link"`
+	Author  atomAuthor   `xml:"author"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+// content returns a plain text description of changes.
+func (e *FeedEntry) content() string {
+	var buf bytes.Buffer
+	write := func(title string, l []*PackageChange) {
+		if len(l) == 0 {
+			return
+		}
+		fmt.Fprintf(&buf, "%s:\n", title)
+		for _, pc := range l {
+			switch {
+			case pc.OldVersion == "":
+				fmt.Fprintf(&buf, "  %s (%s) %s\n", pc.Package, pc.Architecture, pc.NewVersion)
+			case pc.NewVersion == "":
+				fmt.Fprintf(&buf, "  %s (%s) %s\n", pc.Package, pc.Architecture, pc.OldVersion)
+			default:
+				fmt.Fprintf(&buf, "  %s (%s) %s -> %s\n", pc.Package, pc.Architecture, pc.OldVersion, pc.NewVersion)
+			}
+		}
+	}
+	write("Upgraded", e.Upgraded)
+	write("Downgraded", e.Downgraded)
+	write("Added", e.Added)
+	write("Removed", e.Removed)
+	return buf.String()
+}
+
+// makeAtom renders entries as an Atom feed.
+//
+// self is the URL of the feed.  The URL without the query string
+// is used as the feed ID.
+func makeAtom(self, title string, entries []*FeedEntry) ([]byte, error) {
+	id := strings.SplitN(self, "?", 2)[0]
+	feed := &atomFeed{
+		ID:     id,
+		Title:  title,
+		Link:   atomLink{Href: self, Rel: "self"},
+		Author: atomAuthor{Name: "go-apt-cacher"},
+	}
+	updated := time.Unix(0, 0).UTC()
+	for _, e := range entries {
+		if e.Time.After(updated) {
+			updated = e.Time
+		}
+		feed.Entries = append(feed.Entries, &atomEntry{
+			ID: fmt.Sprintf("%s#%s@%d", id, e.Index, e.Time.UnixNano()),
+			Title: fmt.Sprintf("%s: %d upgraded, %d added, %d removed",
+				e.Index, len(e.Upgraded), len(e.Added), len(e.Removed)),
+			Updated: e.Time.Format(time.RFC3339),
+			Content: atomContent{Type: "text", Body: e.content()},
+		})
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
@@ -0,0 +1,84 @@
+package aptcacher
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestDiffPackages(t *testing.T) {
+	t.Parallel()
+
+	index := func(l ...*binaryPackage) map[string]*binaryPackage {
+		m := make(map[string]*binaryPackage)
+		for _, bp := range l {
+			m[bp.key()] = bp
+		}
+		return m
+	}
+	pkg := func(name, version string) *binaryPackage {
+		return &binaryPackage{name: name, version: version, arch: "amd64"}
+	}
+
+	older := index(pkg("openssl", "3.0.2-0ubuntu1.9"), pkg("bash", "5.1-6ubuntu1"),
+		pkg("zsh", "5.8.1-1"), pkg("vim", "2:8.2.3995-1ubuntu2"))
+	newer := index(pkg("openssl", "3.0.2-0ubuntu1.10"), pkg("bash", "5.1-6ubuntu1"),
+		pkg("tmux", "3.2a-4"), pkg("vim", "2:8.2.3995-1ubuntu1"))
+
+	e := diffPackages(older, newer)
+	if len(e.Added) != 1 || e.Added[0].Package != "tmux" || e.Added[0].NewVersion != "3.2a-4" {
+		t.Error(`wrong Added`)
+	}
+	if len(e.Removed) != 1 || e.Removed[0].Package != "zsh" || e.Removed[0].OldVersion != "5.8.1-1" {
+		t.Error(`wrong Removed`)
+	}
+	if len(e.Upgraded) != 1 || e.Upgraded[0].NewVersion != "3.0.2-0ubuntu1.10" {
+		t.Error(`wrong Upgraded`)
+	}
+	if len(e.Downgraded) != 1 || e.Downgraded[0].Package != "vim" {
+		t.Error(`wrong Downgraded`)
+	}
+
+	f := e.filter("open*")
+	if len(f.Added) != 0 || len(f.Removed) != 0 || len(f.Upgraded) != 1 || len(f.Downgraded) != 0 {
+		t.Error(`wrong filter`)
+	}
+	if !diffPackages(older, older).empty() {
+		t.Error(`!diffPackages(older, older).empty()`)
+	}
+}
+
+func TestMakeAtom(t *testing.T) {
+	t.Parallel()
+
+	e := &FeedEntry{
+		Time:  time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC),
+		Index: "ubuntu/dists/jammy-updates/main/binary-amd64/Packages.gz",
+		Upgraded: []*PackageChange{
+			{"openssl", "amd64", "3.0.2-0ubuntu1.9", "3.0.2-0ubuntu1.10"},
+		},
+	}
+	data, err := makeAtom("http://localhost:3142/_api/feed/ubuntu/jammy-updates/atom?package=openssl",
+		"test", []*FeedEntry{e})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var feed atomFeed
+	if err := xml.NewDecoder(bytes.NewReader(data)).Decode(&feed); err != nil {
+		t.Fatal(err)
+	}
+	if feed.ID != "http://localhost:3142/_api/feed/ubuntu/jammy-updates/atom" {
+		t.Error(`wrong feed.ID: ` + feed.ID)
+	}
+	if feed.Updated != "2026-10-18T00:00:00Z" {
+		t.Error(`feed.Updated != "2026-10-18T00:00:00Z"`)
+	}
+	if len(feed.Entries) != 1 {
+		t.Fatal(`len(feed.Entries) != 1`)
+	}
+	if feed.Entries[0].Content.Body != "Upgraded:\n  openssl (amd64) 3.0.2-0ubuntu1.9 -> 3.0.2-0ubuntu1.10\n" {
+		t.Error(`wrong content: ` + feed.Entries[0].Content.Body)
+	}
+}
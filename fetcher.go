@@ -0,0 +1,86 @@
+package aptcacher
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// Fetcher fetches items from upstream repositories.
+//
+// Fetchers are selected by the scheme of the mapped URL.
+// Fetched data are validated with checksums by Cacher regardless
+// of the fetcher.
+type Fetcher interface {
+	// Fetch fetches the contents of u.
+	//
+	// status is an HTTP status code such as 200 or 404.
+	// If status is 200, the caller is responsible to close body.
+	// err is returned only when the upstream cannot be reached.
+	Fetch(ctx context.Context, u *url.URL) (status int, body io.ReadCloser, err error)
+}
+
+// HTTPFetcher is a Fetcher for http and https URLs.
+type HTTPFetcher struct {
+	// Client is used to send requests.
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Fetch implements Fetcher.
+func (f *HTTPFetcher) Fetch(ctx context.Context, u *url.URL) (int, io.ReadCloser, error) {
+	resp, err := ctxhttp.Get(ctx, f.Client, u.String())
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return resp.StatusCode, nil, nil
+	}
+	return resp.StatusCode, headerBody{resp.Body, cachedHeader(resp.Header)}, nil
+}
+
+// headerBody is a response body that implements headerReader.
+type headerBody struct {
+	io.ReadCloser
+	header http.Header
+}
+
+// Header implements headerReader.
+func (b headerBody) Header() http.Header {
+	return b.header
+}
+
+// FileFetcher is a Fetcher for file URLs.
+//
+// It reads files in a local directory tree such as an NFS mount.
+type FileFetcher struct{}
+
+// Fetch implements Fetcher.
+func (f FileFetcher) Fetch(ctx context.Context, u *url.URL) (int, io.ReadCloser, error) {
+	file, err := os.Open(filepath.FromSlash(u.Path))
+	switch {
+	case os.IsNotExist(err):
+		return http.StatusNotFound, nil, nil
+	case os.IsPermission(err):
+		return http.StatusForbidden, nil, nil
+	case err != nil:
+		return 0, nil, err
+	}
+
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+	if !st.Mode().IsRegular() {
+		file.Close()
+		return http.StatusNotFound, nil, nil
+	}
+	return http.StatusOK, file, nil
+}
@@ -0,0 +1,107 @@
+package aptcacher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestHTTPFetcher(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repo/Release" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Server", "test")
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	f := &HTTPFetcher{Client: &http.Client{}}
+	u, _ := url.Parse(ts.URL + "/repo/Release")
+	status, body, err := f.Fetch(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal(`status != http.StatusOK`)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Error(`string(data) != "hello"`)
+	}
+	h := body.(headerReader).Header()
+	if h.Get("ETag") != `"abc"` || h.Get("Server") != "" {
+		t.Error(`wrong headers`, h)
+	}
+
+	u, _ = url.Parse(ts.URL + "/repo/InRelease")
+	status, _, err = f.Fetch(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusNotFound {
+		t.Error(`status != http.StatusNotFound`)
+	}
+}
+
+func TestFileFetcher(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.MkdirAll(filepath.Join(dir, "dists", "stable"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "dists", "stable", "Release"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := FileFetcher{}
+	u := &url.URL{Scheme: "file", Path: filepath.ToSlash(dir) + "/dists/stable/Release"}
+	status, body, err := f.Fetch(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Fatal(`status != http.StatusOK`)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Error(`string(data) != "hello"`)
+	}
+
+	for _, p := range []string{"/dists/stable/InRelease", "/dists/stable"} {
+		u.Path = filepath.ToSlash(dir) + p
+		status, _, err = f.Fetch(context.Background(), u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusNotFound {
+			t.Errorf("status for %s: %d", p, status)
+		}
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"io"
+	"net/http"
+	"os"
 )
 
 // FileInfo is a set of meta data of a file.
@@ -14,6 +17,9 @@ type FileInfo struct {
 	md5sum    []byte // nil means no MD5 checksum to be checked.
 	sha1sum   []byte // nil means no SHA1 ...
 	sha256sum []byte // nil means no SHA256 ...
+
+	// upstream headers in cachedHeaders; not compared by Same.
+	header http.Header
 }
 
 // Same returns true if t has the same checksum values.
@@ -49,6 +55,13 @@ func (fi *FileInfo) Size() uint64 {
 	return fi.size
 }
 
+// withPath returns a copy of fi whose path is p.
+func (fi *FileInfo) withPath(p string) *FileInfo {
+	fi2 := *fi
+	fi2.path = p
+	return &fi2
+}
+
 // MakeFileInfo constructs a FileInfo for a given data.
 func MakeFileInfo(path string, data []byte) *FileInfo {
 	md5sum := md5.Sum(data)
@@ -62,3 +75,27 @@ func MakeFileInfo(path string, data []byte) *FileInfo {
 		sha256sum: sha256sum[:],
 	}
 }
+
+// fileInfo calculates checksums of a file.
+func fileInfo(p, fname string) (*FileInfo, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	md5hash := md5.New()
+	sha1hash := sha1.New()
+	sha256hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5hash, sha1hash, sha256hash), f)
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{
+		path:      p,
+		size:      uint64(size),
+		md5sum:    md5hash.Sum(nil),
+		sha1sum:   sha1hash.Sum(nil),
+		sha256sum: sha256hash.Sum(nil),
+	}, nil
+}
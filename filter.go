@@ -0,0 +1,649 @@
+package aptcacher
+
+// This file implements filtered views of mappings.
+//
+// For a filtered mapping, Packages and Sources indices are rewritten
+// to omit packages matching filter rules, and Release is regenerated
+// and re-signed.  Generated files are kept in meta storage under
+// "<prefix>+filtered/dists/<suite>/", and are regenerated from the
+// upstream indices at startup and whenever Release is updated.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	filteredSuffix = "+filtered"
+)
+
+var versionOperators = []string{"<<", "<=", ">>", ">=", "="}
+
+// filteredPath returns the path in meta storage of a generated file
+// for p.
+func filteredPath(p string) string {
+	t := strings.SplitN(p, "/", 2)
+	if len(t) == 1 {
+		return t[0] + filteredSuffix
+	}
+	return t[0] + filteredSuffix + "/" + t[1]
+}
+
+// isFilteredPath returns true if p is a path of a generated file.
+func isFilteredPath(p string) bool {
+	return strings.HasSuffix(strings.SplitN(p, "/", 2)[0], filteredSuffix)
+}
+
+// filteredIndex returns the suite directory if p is a path of
+// Release files or Packages/Sources indices served from a filtered view.
+func filteredIndex(p string) (string, bool) {
+	t := strings.SplitN(p, "/", 4)
+	if len(t) != 4 || t[1] != "dists" {
+		return "", false
+	}
+	switch base := indexBase(t[3]); {
+	case t[3] == "Release", t[3] == "InRelease", t[3] == "Release.gpg":
+	case base == "Packages", base == "Sources":
+	default:
+		return "", false
+	}
+	return path.Join(t[0], t[1], t[2]), true
+}
+
+func validPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+func matchPattern(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+// validConstraint returns true if constraint can be used for matchVersion.
+func validConstraint(constraint string) bool {
+	for _, op := range versionOperators {
+		if strings.HasPrefix(constraint, op) {
+			return strings.TrimSpace(constraint[len(op):]) != ""
+		}
+	}
+	return validPattern(constraint)
+}
+
+// matchVersion returns true if version v satisfies constraint.
+//
+// constraint is either a relation such as "<< 1.0-1" or a pattern.
+func matchVersion(constraint, v string) bool {
+	for _, op := range versionOperators {
+		if !strings.HasPrefix(constraint, op) {
+			continue
+		}
+		c := CompareVersion(v, strings.TrimSpace(constraint[len(op):]))
+		switch op {
+		case "<<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">>":
+			return c > 0
+		case ">=":
+			return c >= 0
+		}
+		return c == 0
+	}
+	return matchPattern(constraint, v)
+}
+
+// validate checks a rule and fills the default name.
+func (r *FilterRule) validate(i int) error {
+	if r.Name == "" {
+		r.Name = fmt.Sprintf("rules[%d]", i)
+	}
+	if r.Package == "" && r.Source == "" && r.Version == "" && r.Section == "" && r.Priority == "" {
+		return errors.New(r.Name + ": no conditions")
+	}
+	for _, pattern := range []string{r.Package, r.Source, r.Section, r.Priority} {
+		if !validPattern(pattern) {
+			return errors.New(r.Name + ": invalid pattern: " + pattern)
+		}
+	}
+	if !validConstraint(r.Version) {
+		return errors.New(r.Name + ": invalid version: " + r.Version)
+	}
+	return nil
+}
+
+// match returns true if a paragraph in Packages or Sources matches
+// all conditions of the rule.
+func (r *FilterRule) match(d Paragraph, sources bool) bool {
+	name := d.get("Package")
+	source := name
+	if !sources {
+		source = sourcePackage(d)
+	}
+	return matchPattern(r.Package, name) &&
+		matchPattern(r.Source, source) &&
+		(r.Version == "" || matchVersion(r.Version, d.get("Version"))) &&
+		matchPattern(r.Section, d.get("Section")) &&
+		matchPattern(r.Priority, d.get("Priority"))
+}
+
+// filter keeps the state of a filtered mapping.
+type filter struct {
+	prefix  string
+	config  *FilterConfig
+	signer  *signer
+	trigger chan struct{}
+
+	// mu serializes generation of views.
+	mu        sync.Mutex
+	generated map[string]bool // suite directories
+
+	pendingLock sync.Mutex
+	pending     map[string]bool // suite directories to be regenerated
+
+	blockLock sync.RWMutex
+	blocked   map[string]map[string]string // index -> path -> rule name
+}
+
+func newFilter(prefix string, config *FilterConfig) (*filter, error) {
+	if len(config.Rules) == 0 {
+		return nil, errors.New("no rules")
+	}
+	for i, r := range config.Rules {
+		if err := r.validate(i); err != nil {
+			return nil, err
+		}
+	}
+
+	f := &filter{
+		prefix:    prefix,
+		config:    config,
+		trigger:   make(chan struct{}, 1),
+		generated: make(map[string]bool),
+		pending:   make(map[string]bool),
+		blocked:   make(map[string]map[string]string),
+	}
+	if config.SigningKey != "" {
+		s, err := newSigner(config.SigningKey, config.SigningPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		f.signer = s
+	}
+	return f, nil
+}
+
+// notify requests regeneration of the view of a suite directory.
+func (f *filter) notify(dir string) {
+	f.pendingLock.Lock()
+	f.pending[dir] = true
+	f.pendingLock.Unlock()
+
+	select {
+	case f.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// match returns the name of the first rule that matches d.
+func (f *filter) match(d Paragraph, sources bool) (string, bool) {
+	for _, r := range f.config.Rules {
+		if r.match(d, sources) {
+			return r.Name, true
+		}
+	}
+	return "", false
+}
+
+// indexKey returns the path of an index p without compression
+// extensions.
+func indexKey(p string) string {
+	return path.Join(path.Dir(p), indexBase(p))
+}
+
+// setBlocked records files blocked by rules in an index p.
+func (f *filter) setBlocked(p string, blocked map[string]string) {
+	f.blockLock.Lock()
+	f.blocked[indexKey(p)] = blocked
+	f.blockLock.Unlock()
+}
+
+// forgetBlocked removes records of indices under dir.
+func (f *filter) forgetBlocked(dir string) {
+	f.blockLock.Lock()
+	defer f.blockLock.Unlock()
+
+	for p := range f.blocked {
+		if strings.HasPrefix(p, dir+"/") {
+			delete(f.blocked, p)
+		}
+	}
+}
+
+// blockedBy returns the name of the rule that blocks p.
+func (f *filter) blockedBy(p string) (string, bool) {
+	f.blockLock.RLock()
+	defer f.blockLock.RUnlock()
+
+	for _, m := range f.blocked {
+		if rule, ok := m[p]; ok {
+			return rule, true
+		}
+	}
+	return "", false
+}
+
+// filterIndex returns an index without paragraphs matching rules,
+// and paths of files of omitted packages with the names of rules.
+func (f *filter) filterIndex(p string, data []byte) ([]byte, map[string]string, error) {
+	base, r, err := decompress(p, bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sources := base == "Sources"
+	order, lists := packagesOrder, []string(nil)
+	if sources {
+		order, lists = sourcesOrder, sourcesLists
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, order, lists)
+	parser := NewParser(r)
+	blocked := make(map[string]string)
+	for {
+		d, err := parser.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, p)
+		}
+		rule, ok := f.match(d, sources)
+		if !ok {
+			w.Write(d)
+			continue
+		}
+
+		if !sources {
+			blocked[path.Join(f.prefix, d.get("Filename"))] = rule
+			continue
+		}
+		for _, l := range d["Files"] {
+			fname, _, _, err := parseChecksum(l)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, p)
+			}
+			blocked[path.Join(f.prefix, d.get("Directory"), fname)] = rule
+		}
+	}
+	return buf.Bytes(), blocked, nil
+}
+
+// filterFor returns the filter for p in a filtered mapping or
+// its snapshots.
+func (c *Cacher) filterFor(p string) (*filter, bool) {
+	f, ok := c.filters[strings.SplitN(upstreamPath(p), "/", 2)[0]]
+	return f, ok
+}
+
+// scanIndex records files blocked by rules in an index p stored in
+// meta storage.  p may be an index of a snapshot.
+//
+// This is called for every Packages and Sources index of filtered
+// mappings so that files are blocked even before the filtered views
+// are generated.
+func (c *Cacher) scanIndex(p string, data []byte) {
+	f, ok := c.filterFor(p)
+	if !ok || isFilteredPath(p) || !IsSupported(p) {
+		return
+	}
+	switch indexBase(p) {
+	case "Packages", "Sources":
+	default:
+		return
+	}
+
+	_, blocked, err := f.filterIndex(p, data)
+	if err != nil {
+		c.logger.Warn("filter: invalid index", map[string]interface{}{
+			"_path": p,
+			"_err":  err.Error(),
+		})
+		return
+	}
+	f.setBlocked(p, blocked)
+}
+
+// blockedBy returns the name of the filter rule that blocks p.
+//
+// Files in filtered mappings and their snapshots are checked by
+// their upstream paths.  Files outside of dists/ that are not listed
+// in cached indices are also blocked as rules cannot be applied.
+func (c *Cacher) blockedBy(p string) (string, bool) {
+	f, ok := c.filterFor(p)
+	if !ok {
+		return "", false
+	}
+	t := strings.SplitN(p, "/", 3)
+	if len(t) < 2 || t[1] == "dists" {
+		return "", false
+	}
+	if rule, ok := f.blockedBy(upstreamPath(p)); ok {
+		return rule, true
+	}
+	if _, ok := c.lookupInfo(p); !ok {
+		return "unlisted", true
+	}
+	return "", false
+}
+
+// upstreamRelease returns the paragraph of InRelease or Release
+// in dir cached in meta storage.
+func (c *Cacher) upstreamRelease(dir string) (Paragraph, error) {
+	for _, name := range []string{"InRelease", "Release"} {
+		fi, ok := c.lookupInfo(path.Join(dir, name))
+		if !ok {
+			continue
+		}
+		f, err := c.meta.LookupItem(fi)
+		if err != nil {
+			continue
+		}
+		d, err := NewParser(f).Read()
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, fi.path)
+		}
+		return d, nil
+	}
+	return nil, errors.New("no Release file for " + dir)
+}
+
+// readIndex returns the contents of the first available index in fil.
+func (c *Cacher) readIndex(fil []*FileInfo) (*FileInfo, []byte, error) {
+	err := errors.New("no supported index")
+	for _, fi := range fil {
+		if !IsSupported(fi.path) {
+			continue
+		}
+		var f Item
+		f, err = c.meta.LookupItem(fi)
+		if err != nil {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		_, err = buf.ReadFrom(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		return fi, buf.Bytes(), nil
+	}
+	return nil, nil, err
+}
+
+// indexGroups groups Packages and Sources indices in fil by the path
+// without compression extensions.  The returned keys are sorted.
+func indexGroups(fil []*FileInfo) (map[string][]*FileInfo, []string) {
+	groups := make(map[string][]*FileInfo)
+	var keys []string
+	for _, fi := range fil {
+		base := indexBase(fi.path)
+		if base != "Packages" && base != "Sources" {
+			continue
+		}
+		key := path.Join(path.Dir(fi.path), base)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], fi)
+	}
+	sort.Strings(keys)
+	return groups, keys
+}
+
+// fetchSuite downloads Release and Packages/Sources indices of a suite
+// directory from upstream for filterSuite.
+//
+// This must be called without f.mu so that downloads do not block
+// generation of other views.
+func (c *Cacher) fetchSuite(dir string) {
+	for _, name := range []string{"InRelease", "Release"} {
+		// some of them may not exist.
+		c.fetch(path.Join(dir, name))
+	}
+	fil, err := c.releaseIndices(dir)
+	if err != nil {
+		return
+	}
+	groups, keys := indexGroups(fil)
+	for _, key := range keys {
+		for _, fi := range groups[key] {
+			if IsSupported(fi.path) && c.fetch(fi.path) == nil {
+				break
+			}
+		}
+	}
+}
+
+// filterSuite generates the filtered view of a suite directory from
+// files cached in meta storage.
+//
+// If partial is true, indices not available are omitted from the view
+// as Release may list indices that do not exist.  Otherwise, they are
+// treated as errors.
+//
+// f.mu must be locked beforehand.
+func (c *Cacher) filterSuite(f *filter, dir string, partial bool) error {
+	release, err := c.upstreamRelease(dir)
+	if err != nil {
+		return err
+	}
+	fil, err := c.releaseIndices(dir)
+	if err != nil {
+		return err
+	}
+	groups, keys := indexGroups(fil)
+
+	blocked := 0
+	var files []indexFile
+	for _, key := range keys {
+		fi, data, err := c.readIndex(groups[key])
+		if err != nil {
+			if !partial {
+				return errors.Wrap(err, key)
+			}
+			if c.logger.Enabled(log.LvDebug) {
+				c.logger.Debug("filter: index not available", map[string]interface{}{
+					"_path": key,
+					"_err":  err.Error(),
+				})
+			}
+			continue
+		}
+		filtered, l, err := f.filterIndex(fi.path, data)
+		if err != nil {
+			return err
+		}
+		f.setBlocked(fi.path, l)
+		blocked += len(l)
+		files = append(files, withGzip(strings.TrimPrefix(key, dir+"/"), filtered)...)
+	}
+
+	// Release lists checksums of generated indices and checksums of
+	// other files as is.  By-hash retrieval is disabled because
+	// generated indices are not available by hash.
+	fields := make(Paragraph)
+	for k, v := range release {
+		fields[k] = v
+	}
+	delete(fields, "Acquire-By-Hash")
+	delete(fields, "SHA512")
+	for _, k := range []string{"MD5Sum", "SHA1", "SHA256"} {
+		var l []string
+		for _, line := range release[k] {
+			p, _, _, err := parseChecksum(line)
+			if err != nil {
+				return errors.Wrap(err, dir)
+			}
+			if _, ok := groups[path.Join(dir, path.Dir(p), indexBase(p))]; ok {
+				continue
+			}
+			l = append(l, line)
+		}
+		fields[k] = l
+	}
+
+	err = c.publishSuite(filteredPath(dir), files, fields, f.signer)
+	if err != nil {
+		return err
+	}
+
+	f.generated[dir] = true
+
+	c.logger.Info("filter: view generated", map[string]interface{}{
+		"_path":    dir,
+		"_blocked": blocked,
+	})
+	return nil
+}
+
+// loadFilter records files blocked by rules in indices cached in
+// meta storage, and regenerates views from them.
+//
+// c.info must be populated beforehand.
+func (c *Cacher) loadFilter(f *filter, metas []*FileInfo) {
+	for _, fi := range metas {
+		switch indexBase(fi.path) {
+		case "Packages", "Sources":
+		default:
+			continue
+		}
+		if g, ok := c.filterFor(fi.path); !ok || g != f {
+			continue
+		}
+		_, data, err := c.readIndex([]*FileInfo{fi})
+		if err != nil {
+			continue
+		}
+		c.scanIndex(fi.path, data)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, fi := range metas {
+		if !strings.HasPrefix(fi.path, f.prefix+"/dists/") {
+			continue
+		}
+		switch path.Base(fi.path) {
+		case "Release", "InRelease":
+		default:
+			continue
+		}
+		dir := path.Dir(fi.path)
+		if f.generated[dir] {
+			continue
+		}
+		if err := c.filterSuite(f, dir, false); err != nil {
+			// will be generated on demand.
+			if c.logger.Enabled(log.LvDebug) {
+				c.logger.Debug("filter: view not generated", map[string]interface{}{
+					"_path": dir,
+					"_err":  err.Error(),
+				})
+			}
+		}
+	}
+}
+
+// runFilter is a goroutine to regenerate views when Release is updated.
+func (c *Cacher) runFilter(f *filter) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-f.trigger:
+		}
+
+		f.pendingLock.Lock()
+		dirs := f.pending
+		f.pending = make(map[string]bool)
+		f.pendingLock.Unlock()
+
+		for dir := range dirs {
+			f.mu.Lock()
+			generated := f.generated[dir]
+			f.mu.Unlock()
+			if !generated {
+				continue
+			}
+
+			c.fetchSuite(dir)
+			f.mu.Lock()
+			err := c.filterSuite(f, dir, true)
+			f.mu.Unlock()
+			if err != nil {
+				c.logger.Warn("filter: failed to regenerate a view", map[string]interface{}{
+					"_path": dir,
+					"_err":  err.Error(),
+				})
+			}
+		}
+	}
+}
+
+// generateView generates the filtered view of a suite directory
+// unless it has been generated.
+func (c *Cacher) generateView(f *filter, dir string) error {
+	f.mu.Lock()
+	generated := f.generated[dir]
+	f.mu.Unlock()
+	if generated {
+		return nil
+	}
+
+	c.fetchSuite(dir)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// may have been generated while downloading.
+	if f.generated[dir] {
+		return nil
+	}
+	return c.filterSuite(f, dir, true)
+}
+
+// getFiltered looks up an item in a filtered mapping.
+//
+// Release files and indices are served from the generated view.
+// Files of omitted packages are refused by GetContext beforehand.
+func (c *Cacher) getFiltered(ctx context.Context, f *filter, p string) (*Result, error) {
+	dir, ok := filteredIndex(p)
+	if !ok {
+		return c.get(ctx, p)
+	}
+
+	if err := c.generateView(f, dir); err != nil {
+		c.logger.Warn("filter: failed to generate a view", map[string]interface{}{
+			"_path": dir,
+			"_err":  err.Error(),
+		})
+	}
+	return c.getKnown(ctx, filteredPath(p))
+}
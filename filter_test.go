@@ -0,0 +1,159 @@
+package aptcacher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilteredIndex(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		p   string
+		dir string
+		ok  bool
+	}{
+		{"ubuntu/dists/jammy/Release", "ubuntu/dists/jammy", true},
+		{"ubuntu/dists/jammy/InRelease", "ubuntu/dists/jammy", true},
+		{"ubuntu/dists/jammy/main/binary-amd64/Packages.gz", "ubuntu/dists/jammy", true},
+		{"ubuntu/dists/jammy/main/source/Sources.xz", "ubuntu/dists/jammy", true},
+		{"ubuntu/dists/jammy/main/i18n/Translation-en.bz2", "", false},
+		{"ubuntu/pool/main/a/apt/apt_2.4.5_amd64.deb", "", false},
+		{"ubuntu/dists/Release", "", false},
+	}
+	for _, c := range cases {
+		dir, ok := filteredIndex(c.p)
+		if dir != c.dir || ok != c.ok {
+			t.Errorf("filteredIndex(%q) = %q, %v", c.p, dir, ok)
+		}
+	}
+
+	if filteredPath("ubuntu/dists/jammy/Release") != "ubuntu+filtered/dists/jammy/Release" {
+		t.Error(`wrong filteredPath`)
+	}
+	if !isFilteredPath("ubuntu+filtered/dists/jammy/Release") {
+		t.Error(`!isFilteredPath("ubuntu+filtered/dists/jammy/Release")`)
+	}
+	if isFilteredPath("ubuntu/dists/jammy/Release") {
+		t.Error(`isFilteredPath("ubuntu/dists/jammy/Release")`)
+	}
+}
+
+func TestMatchVersion(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		constraint string
+		v          string
+		match      bool
+	}{
+		{"<< 1.1", "1.0", true},
+		{"<< 1.1", "1.1", false},
+		{"<= 1.1", "1.1", true},
+		{">> 1.1", "1.1~rc1", false},
+		{">= 1.1", "1:0.1", true},
+		{"= 3.0.2-0ubuntu1.9", "3.0.2-0ubuntu1.9", true},
+		{"=3.0.2-0ubuntu1.9", "3.0.2-0ubuntu1.10", false},
+		{"3.0.2-*", "3.0.2-0ubuntu1.9", true},
+		{"3.0.2-*", "3.0.3-0ubuntu1", false},
+	}
+	for _, c := range cases {
+		if matchVersion(c.constraint, c.v) != c.match {
+			t.Errorf("matchVersion(%q, %q) != %v", c.constraint, c.v, c.match)
+		}
+	}
+}
+
+func TestFilterRule(t *testing.T) {
+	t.Parallel()
+
+	r := &FilterRule{Source: "openssl", Version: "= 3.0.2-0ubuntu1.9"}
+	if err := r.validate(3); err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "rules[3]" {
+		t.Error(`r.Name != "rules[3]"`)
+	}
+
+	libssl := Paragraph{
+		"Package": {"libssl3"},
+		"Source":  {"openssl"},
+		"Version": {"3.0.2-0ubuntu1.9"},
+		"Section": {"libs"},
+	}
+	if !r.match(libssl, false) {
+		t.Error(`rule must match libssl3`)
+	}
+	libssl["Version"] = []string{"3.0.2-0ubuntu1.10"}
+	if r.match(libssl, false) {
+		t.Error(`rule must not match libssl3 3.0.2-0ubuntu1.10`)
+	}
+
+	src := Paragraph{
+		"Package": {"openssl"},
+		"Version": {"3.0.2-0ubuntu1.9"},
+	}
+	if !r.match(src, true) {
+		t.Error(`rule must match source openssl`)
+	}
+
+	r = &FilterRule{Section: "*/games"}
+	if err := r.validate(0); err != nil {
+		t.Fatal(err)
+	}
+	if r.match(libssl, false) {
+		t.Error(`rule must not match libssl3`)
+	}
+
+	bad := []*FilterRule{
+		{Name: "empty"},
+		{Package: "[a-"},
+		{Version: "<<"},
+	}
+	for i, r := range bad {
+		if r.validate(i) == nil {
+			t.Errorf("%s must be invalid", r.Name)
+		}
+	}
+}
+
+func TestGenerateViewUnlocked(t *testing.T) {
+	t.Parallel()
+
+	repo := &testRepo{hold: make(chan struct{}), holdSuffix: "/Release"}
+	repo.setPackages(map[string]string{"a": "1.0", "b": "2.0"})
+	c, done := newTestCacher(t, repo, func(config *CacherConfig) {
+		config.Filter = map[string]*FilterConfig{
+			"up": {Rules: []*FilterRule{{Name: "no-b", Package: "b"}}},
+		}
+	})
+	defer done()
+	f := c.filters["up"]
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.generateView(f, "up/dists/s")
+	}()
+	repo.waitHolding(t, 1)
+
+	// f.mu is not held while Release is being downloaded.
+	locked := make(chan struct{})
+	go func() {
+		f.mu.Lock()
+		f.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`f.mu is held during downloads`)
+	}
+
+	close(repo.hold)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.blockedBy("up/pool/main/b_2.0_amd64.deb"); !ok {
+		t.Error(`b must be blocked`)
+	}
+}
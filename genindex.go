@@ -0,0 +1,166 @@
+package aptcacher
+
+// This file implements generation of repository indices for
+// suites whose indices are generated by go-apt-cacher itself.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	packagesOrder = []string{
+		"Package", "Source", "Version", "Installed-Size", "Maintainer",
+		"Architecture", "Replaces", "Provides", "Depends", "Pre-Depends",
+		"Recommends", "Suggests", "Conflicts", "Breaks", "Filename", "Size",
+		"MD5sum", "SHA1", "SHA256", "Section", "Priority", "Homepage",
+		"Description",
+	}
+	sourcesOrder = []string{
+		"Package", "Binary", "Version", "Maintainer", "Uploaders",
+		"Build-Depends", "Architecture", "Standards-Version", "Format",
+		"Files", "Checksums-Sha1", "Checksums-Sha256", "Homepage",
+		"Package-List", "Directory", "Priority", "Section",
+	}
+	sourcesLists = []string{
+		"Files", "Checksums-Sha1", "Checksums-Sha256", "Checksums-Sha512",
+		"Package-List",
+	}
+	releaseOrder = []string{
+		"Origin", "Label", "Suite", "Version", "Codename", "Date",
+		"Valid-Until", "Architectures", "Components", "Description",
+		"MD5Sum", "SHA1", "SHA256",
+	}
+	releaseLists = []string{"MD5Sum", "SHA1", "SHA256", "SHA512"}
+)
+
+// indexFile is a generated file in a suite.
+type indexFile struct {
+	name string // relative path from the suite directory
+	data []byte
+}
+
+// writeIndex writes paragraphs in debian control file format.
+func writeIndex(l []Paragraph, order, lists []string) []byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, order, lists)
+	for _, d := range l {
+		// writing to bytes.Buffer never fails.
+		w.Write(d)
+	}
+	return buf.Bytes()
+}
+
+// withGzip returns an index file and its gzip compressed version.
+func withGzip(name string, data []byte) []indexFile {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+	return []indexFile{
+		{name, data},
+		{name + ".gz", buf.Bytes()},
+	}
+}
+
+// makeRelease generates a Release file listing checksums of files.
+//
+// fields are additional fields such as Origin or Codename.
+// date is the value of Date field.
+func makeRelease(fields Paragraph, files []indexFile, date time.Time) []byte {
+	d := make(Paragraph)
+	for k, v := range fields {
+		d[k] = v
+	}
+	d["Date"] = []string{date.UTC().Format(time.RFC1123)}
+
+	for _, f := range files {
+		md5sum := md5.Sum(f.data)
+		sha1sum := sha1.Sum(f.data)
+		sha256sum := sha256.Sum256(f.data)
+		size := len(f.data)
+		d["MD5Sum"] = append(d["MD5Sum"], fmt.Sprintf("%x %d %s", md5sum, size, f.name))
+		d["SHA1"] = append(d["SHA1"], fmt.Sprintf("%x %d %s", sha1sum, size, f.name))
+		d["SHA256"] = append(d["SHA256"], fmt.Sprintf("%x %d %s", sha256sum, size, f.name))
+	}
+
+	return writeIndex([]Paragraph{d}, releaseOrder, releaseLists)
+}
+
+// suiteFields returns fields of Release for a generated suite.
+func suiteFields(codename, origin, label string, components, architectures []string) Paragraph {
+	d := Paragraph{
+		"Suite":         {codename},
+		"Codename":      {codename},
+		"Components":    {strings.Join(components, " ")},
+		"Architectures": {strings.Join(architectures, " ")},
+	}
+	if origin != "" {
+		d["Origin"] = []string{origin}
+	}
+	if label != "" {
+		d["Label"] = []string{label}
+	}
+	return d
+}
+
+// publishSuite stores generated indices of a suite in meta storage
+// along with Release, and InRelease and Release.gpg if s is not nil.
+//
+// dir is the path of the suite such as "prefix/dists/stable".
+// fields are additional fields of Release.
+func (c *Cacher) publishSuite(dir string, files []indexFile, fields Paragraph, s *signer) error {
+	release := makeRelease(fields, files, c.now())
+	files = append(files, indexFile{"Release", release})
+	if s != nil {
+		inRelease, err := s.clearSign(release)
+		if err != nil {
+			return err
+		}
+		sig, err := s.detachSign(release)
+		if err != nil {
+			return err
+		}
+		files = append(files,
+			indexFile{"InRelease", inRelease},
+			indexFile{"Release.gpg", sig})
+	}
+
+	c.fiLock.Lock()
+	defer c.fiLock.Unlock()
+
+	// Release files are stored last so that they always
+	// refer to stored indices.
+	fis := make([]*FileInfo, len(files))
+	for i, f := range files {
+		p := path.Join(dir, f.name)
+		fi := MakeFileInfo(p, f.data)
+		if err := c.meta.InsertItem(bytes.NewReader(f.data), fi); err != nil {
+			return err
+		}
+		fil, err := ExtractFileInfo(p, bytes.NewReader(f.data))
+		if err != nil {
+			return err
+		}
+		for _, fi2 := range fil {
+			c.info[fi2.path] = fi2
+		}
+		fis[i] = fi
+	}
+	for _, fi := range fis {
+		c.info[fi.path] = fi
+	}
+	c.notifyRelease(path.Join(dir, "Release"))
+
+	c.logger.Info("published generated indices", map[string]interface{}{
+		"_path": dir,
+	})
+	return nil
+}
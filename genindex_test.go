@@ -0,0 +1,42 @@
+package aptcacher
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMakeRelease(t *testing.T) {
+	t.Parallel()
+
+	files := withGzip("main/binary-amd64/Packages", []byte("Package: hoge\n"))
+	release := makeRelease(Paragraph{
+		"Suite":    {"stable"},
+		"Codename": {"stable"},
+	}, files, time.Date(2006, 1, 2, 15, 4, 5, 0, time.FixedZone("JST", 9*3600)))
+
+	d, err := NewParser(bytes.NewReader(release)).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.get("Codename") != "stable" {
+		t.Error(`d.get("Codename") != "stable"`)
+	}
+	if d.get("Date") != "Mon, 02 Jan 2006 06:04:05 UTC" {
+		t.Error(`wrong Date:`, d.get("Date"))
+	}
+
+	fil, err := ExtractFileInfo("internal/dists/stable/Release", bytes.NewReader(release))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fil) != 2 {
+		t.Fatal(`len(fil) != 2`)
+	}
+	for _, f := range files {
+		fi := MakeFileInfo("internal/dists/stable/"+f.name, f.data)
+		if !containsFileInfo(fi, fil) {
+			t.Error(f.name)
+		}
+	}
+}
@@ -4,37 +4,121 @@ import (
 	"fmt"
 	"mime"
 	"net/http"
+	"os"
 	"path"
 	"strconv"
 	"time"
 
 	"github.com/cybozu-go/log"
+	"golang.org/x/net/context"
 )
 
 type cacheHandler struct {
 	*Cacher
 }
 
+// Handler returns an http.Handler to serve cached items and
+// API endpoints under /_api/.
+//
+// The handler can be used with any http.Server or wrapped by
+// middlewares.  Serve is a convenience that runs a server with it.
+func (c *Cacher) Handler() http.Handler {
+	return cacheHandler{c}
+}
+
 func (c cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	accepted := c.now()
+	p := path.Clean(r.URL.Path[1:])
+
+	if c.logger.Enabled(log.LvDebug) {
+		c.logger.Debug("request path", map[string]interface{}{
+			"_path": p,
+		})
+	}
+
+	var status int
+	if denied, st := c.checkAccess(w, r, p); denied {
+		status = st
+	} else if isAPIPath(p) {
+		status = c.serveAPI(w, r, p)
+	} else {
+		status = c.serveItem(w, r, p)
+	}
+
+	took := c.now().Sub(accepted)
+	c.logger.Info("[http]", map[string]interface{}{
+		"_method":      r.Method,
+		"_elapsed":     took.String(),
+		"_path":        p,
+		"_status":      status,
+		"_remote_addr": r.RemoteAddr,
+	})
+}
+
+// checkAccess checks the access control rules for r.
+// If r is denied, it writes an error response and returns true
+// with the HTTP status code.
+func (c cacheHandler) checkAccess(w http.ResponseWriter, r *http.Request, p string) (bool, int) {
+	if c.access == nil {
+		return false, 0
+	}
+
+	ip := c.access.clientIP(r)
+	status, reason := c.access.check(r, p, ip)
+	if status == http.StatusOK {
+		return false, 0
+	}
+
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="go-apt-cacher"`)
+	}
+	http.Error(w, http.StatusText(status), status)
+	c.logger.Warn("access denied", map[string]interface{}{
+		"_path":        p,
+		"_status":      status,
+		"_reason":      reason,
+		"_client":      ip.String(),
+		"_remote_addr": r.RemoteAddr,
+	})
+	return true, status
+}
+
+// requestContext returns a context that is canceled when the client
+// closes the connection or the context of r is canceled otherwise.
+func requestContext(parent context.Context, r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	done := r.Context().Done()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// serveItem serves a cached item for p.
+// The return value is the HTTP status code of the response.
+func (c cacheHandler) serveItem(w http.ResponseWriter, r *http.Request, p string) int {
 	switch r.Method {
 	case "GET", "HEAD":
 		// later on
 	default:
 		http.Error(w, "bad method", http.StatusNotImplemented)
-		return
+		return http.StatusNotImplemented
 	}
 
-	accepted := time.Now()
-	p := path.Clean(r.URL.Path[1:])
+	ctx, cancel := requestContext(c.ctx, r)
+	defer cancel()
 
-	if log.Enabled(log.LvDebug) {
-		log.Debug("request path", map[string]interface{}{
-			"_path": p,
-		})
+	var f Item
+	status := http.StatusInternalServerError
+	res, err := c.GetContext(ctx, p)
+	if err == nil {
+		status, f = res.Status, res.Item
 	}
 
-	status, f, err := c.Get(p)
-
 	switch {
 	case err != nil:
 		http.Error(w, err.Error(), status)
@@ -45,33 +129,35 @@ func (c cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	default:
 		// http.StatusOK
 		defer f.Close()
+
+		// upstream validators allow conditional requests.
+		var modTime time.Time
+		if etag := res.Header.Get("ETag"); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+			modTime = t
+		}
 		if r.Method == "GET" {
-			var zeroTime time.Time
-			http.ServeContent(w, r, path.Base(p), zeroTime, f)
-			goto LOG
+			http.ServeContent(w, r, path.Base(p), modTime, f)
+			return status
 		}
-		stat, err := f.Stat()
+		if !modTime.IsZero() {
+			w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		}
+		size, err := f.Seek(0, os.SEEK_END)
 		if err != nil {
 			status = http.StatusInternalServerError
 			http.Error(w, err.Error(), status)
-			goto LOG
+			return status
 		}
 		ct := mime.TypeByExtension(path.Ext(p))
 		if ct == "" {
 			ct = "application/octet-stream"
 		}
 		w.Header().Set("Content-Type", ct)
-		w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 		w.WriteHeader(http.StatusOK)
 	}
-
-LOG:
-	took := time.Now().Sub(accepted)
-	log.Info("[http]", map[string]interface{}{
-		"_method":      r.Method,
-		"_elapsed":     took.String(),
-		"_path":        p,
-		"_status":      status,
-		"_remote_addr": r.RemoteAddr,
-	})
+	return status
 }
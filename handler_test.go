@@ -0,0 +1,562 @@
+package aptcacher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testRepo is an upstream repository with suite "s" that has
+// component "main" for amd64.
+type testRepo struct {
+	mu    sync.Mutex
+	files map[string][]byte
+
+	// if not nil, requests for paths ending with holdSuffix wait
+	// until it is closed.  holdSuffix is ".deb" if empty.
+	hold       chan struct{}
+	holdSuffix string
+	holding    int // number of requests waiting for hold
+}
+
+// waitHolding waits until n requests wait for r.hold.
+func (r *testRepo) waitHolding(t *testing.T, n int) {
+	for i := 0; i < 500; i++ {
+		r.mu.Lock()
+		holding := r.holding
+		r.mu.Unlock()
+		if holding >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(`requests are not held`)
+}
+
+func (r *testRepo) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	data, ok := r.files[req.URL.Path]
+	hold, suffix := r.hold, r.holdSuffix
+	r.mu.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if suffix == "" {
+		suffix = ".deb"
+	}
+	if hold != nil && strings.HasSuffix(req.URL.Path, suffix) {
+		r.mu.Lock()
+		r.holding++
+		r.mu.Unlock()
+		<-hold
+	}
+	w.Write(data)
+}
+
+// setPackages replaces the repository with packages of given versions.
+func (r *testRepo) setPackages(versions map[string]string) {
+	files := make(map[string][]byte)
+	var packages bytes.Buffer
+	for name, version := range versions {
+		fname := fmt.Sprintf("pool/main/%s_%s_amd64.deb", name, version)
+		data := []byte(name + " " + version)
+		files["/"+fname] = data
+		fmt.Fprintf(&packages, "Package: %s\nVersion: %s\nArchitecture: amd64\nFilename: %s\nSize: %d\nSHA256: %x\n\n",
+			name, version, fname, len(data), sha256.Sum256(data))
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(packages.Bytes())
+	w.Close()
+
+	var release bytes.Buffer
+	release.WriteString("Suite: s\nCodename: s\nComponents: main\nArchitectures: amd64\nMD5Sum:\n")
+	indices := map[string][]byte{
+		"main/binary-amd64/Packages":    packages.Bytes(),
+		"main/binary-amd64/Packages.gz": gz.Bytes(),
+	}
+	for name, data := range indices {
+		fmt.Fprintf(&release, " %x %d %s\n", md5.Sum(data), len(data), name)
+		files["/dists/s/"+name] = data
+	}
+	files["/dists/s/Release"] = release.Bytes()
+
+	r.mu.Lock()
+	r.files = files
+	r.mu.Unlock()
+}
+
+// newTestCacher creates a Cacher with mapping "up" for repo.
+// config can be modified by mod before the Cacher is created.
+func newTestCacher(t *testing.T, repo *testRepo, mod func(config *CacherConfig)) (*Cacher, func()) {
+	ts := httptest.NewServer(repo)
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &CacherConfig{
+		CheckInterval:  60,
+		MetaDirectory:  filepath.Join(dir, "meta"),
+		CacheDirectory: filepath.Join(dir, "cache"),
+		Mapping: map[string]string{
+			"up": ts.URL,
+		},
+	}
+	os.Mkdir(config.MetaDirectory, 0755)
+	os.Mkdir(config.CacheDirectory, 0755)
+	if mod != nil {
+		mod(config)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := NewCacher(ctx, config)
+	if err != nil {
+		cancel()
+		ts.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, func() {
+		cancel()
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// doRequest sends a request to h from 10.0.0.1.
+// If form is not nil, it is sent as the request body.
+func doRequest(h http.Handler, method, target string, form url.Values, auth string) *httptest.ResponseRecorder {
+	var r *http.Request
+	if form != nil {
+		r, _ = http.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r, _ = http.NewRequest(method, target, nil)
+	}
+	r.RemoteAddr = "10.0.0.1:12345"
+	if auth != "" {
+		r.Header.Set("Authorization", "Bearer "+auth)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandlerSnapshotAdmin(t *testing.T) {
+	t.Parallel()
+
+	repo := &testRepo{}
+	repo.setPackages(map[string]string{"a": "1.0"})
+	c, done := newTestCacher(t, repo, func(config *CacherConfig) {
+		config.Access = &AccessConfig{
+			BearerTokens: []string{"user"},
+			AdminTokens:  []string{"admin"},
+		}
+	})
+	defer done()
+	h := c.Handler()
+
+	form := url.Values{"prefix": {"up"}, "suite": {"s"}, "id": {"one"}}
+	if w := doRequest(h, "GET", "/_api/snapshots", nil, "user"); w.Code != http.StatusOK {
+		t.Error(`listing snapshots must be permitted for users`, w.Code)
+	}
+	if w := doRequest(h, "POST", "/_api/snapshots", form, ""); w.Code != http.StatusUnauthorized {
+		t.Error(`creating a snapshot without credentials must be unauthorized`, w.Code)
+	}
+	if w := doRequest(h, "POST", "/_api/snapshots", form, "user"); w.Code != http.StatusForbidden {
+		t.Error(`creating a snapshot by a user must be forbidden`, w.Code)
+	}
+	if len(c.Snapshots()) != 0 {
+		t.Fatal(`snapshot must not be created`)
+	}
+	if w := doRequest(h, "POST", "/_api/snapshots", form, "admin"); w.Code != http.StatusCreated {
+		t.Fatal(`creating a snapshot by an admin must succeed`, w.Code, w.Body.String())
+	}
+
+	if w := doRequest(h, "DELETE", "/_api/snapshots/up@one", nil, ""); w.Code != http.StatusUnauthorized {
+		t.Error(`deleting a snapshot without credentials must be unauthorized`, w.Code)
+	}
+	if w := doRequest(h, "DELETE", "/_api/snapshots/up@one", nil, "user"); w.Code != http.StatusForbidden {
+		t.Error(`deleting a snapshot by a user must be forbidden`, w.Code)
+	}
+	if len(c.Snapshots()) != 1 {
+		t.Fatal(`snapshot must not be deleted`)
+	}
+	if w := doRequest(h, "DELETE", "/_api/snapshots/up@one", nil, "admin"); w.Code != http.StatusNoContent {
+		t.Error(`deleting a snapshot by an admin must succeed`, w.Code)
+	}
+}
+
+func TestHandlerPinAdmin(t *testing.T) {
+	t.Parallel()
+
+	repo := &testRepo{}
+	repo.setPackages(map[string]string{"a": "1.0"})
+	c, done := newTestCacher(t, repo, func(config *CacherConfig) {
+		config.Access = &AccessConfig{
+			BearerTokens: []string{"user"},
+			AdminTokens:  []string{"admin"},
+		}
+	})
+	defer done()
+	h := c.Handler()
+
+	form := url.Values{"path": {"up/pool/*"}}
+	if w := doRequest(h, "GET", "/_api/pins", nil, "user"); w.Code != http.StatusOK {
+		t.Error(`listing pin rules must be permitted for users`, w.Code)
+	}
+	if w := doRequest(h, "POST", "/_api/pins", form, ""); w.Code != http.StatusUnauthorized {
+		t.Error(`adding a rule without credentials must be unauthorized`, w.Code)
+	}
+	if w := doRequest(h, "POST", "/_api/pins", form, "user"); w.Code != http.StatusForbidden {
+		t.Error(`adding a rule by a user must be forbidden`, w.Code)
+	}
+	if len(c.PinStatus().Paths) != 0 {
+		t.Fatal(`rule must not be added`)
+	}
+	if w := doRequest(h, "POST", "/_api/pins", form, "admin"); w.Code != http.StatusOK {
+		t.Fatal(`adding a rule by an admin must succeed`, w.Code, w.Body.String())
+	}
+
+	if w := doRequest(h, "DELETE", "/_api/pins?path=up/pool/*", nil, "user"); w.Code != http.StatusForbidden {
+		t.Error(`removing a rule by a user must be forbidden`, w.Code)
+	}
+	if len(c.PinStatus().Paths) != 1 {
+		t.Fatal(`rule must not be removed`)
+	}
+	if w := doRequest(h, "DELETE", "/_api/pins?path=up/pool/*", nil, "admin"); w.Code != http.StatusOK {
+		t.Error(`removing a rule by an admin must succeed`, w.Code)
+	}
+	if len(c.PinStatus().Paths) != 0 {
+		t.Error(`rule must be removed`)
+	}
+}
+
+func TestHandlerAdminNotConfigured(t *testing.T) {
+	t.Parallel()
+
+	repo := &testRepo{}
+	repo.setPackages(map[string]string{"a": "1.0"})
+	c, done := newTestCacher(t, repo, nil)
+	defer done()
+	h := c.Handler()
+
+	form := url.Values{"prefix": {"up"}, "suite": {"s"}}
+	if w := doRequest(h, "POST", "/_api/snapshots", form, "admin"); w.Code != http.StatusForbidden {
+		t.Error(`admin API must be forbidden without administrators`, w.Code)
+	}
+	if w := doRequest(h, "POST", "/_api/pins", url.Values{"package": {"a"}}, "admin"); w.Code != http.StatusForbidden {
+		t.Error(`admin API must be forbidden without administrators`, w.Code)
+	}
+	if w := doRequest(h, "GET", "/_api/snapshots", nil, ""); w.Code != http.StatusOK {
+		t.Error(`listing snapshots must be permitted`, w.Code)
+	}
+}
+
+func TestHandlerFilterBlocked(t *testing.T) {
+	t.Parallel()
+
+	repo := &testRepo{}
+	repo.setPackages(map[string]string{"a": "1.0", "b": "2.0"})
+	c, done := newTestCacher(t, repo, func(config *CacherConfig) {
+		config.Filter = map[string]*FilterConfig{
+			"up": {Rules: []*FilterRule{{Name: "no-b", Package: "b"}}},
+		}
+		config.Union = map[string]*UnionConfig{
+			"all": {
+				Codename:      "u",
+				Members:       []string{"up/s"},
+				Architectures: []string{"amd64"},
+			},
+		}
+	})
+	defer done()
+	h := c.Handler()
+
+	if w := doRequest(h, "GET", "/up/pool/main/b_2.0_amd64.deb", nil, ""); w.Code != http.StatusForbidden {
+		t.Error(`files not listed in indices must be forbidden`, w.Code)
+	}
+
+	// indices cached without generating the filtered view.
+	for _, p := range []string{"up/dists/s/Release", "up/dists/s/main/binary-amd64/Packages.gz"} {
+		if err := c.fetch(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w := doRequest(h, "GET", "/up/pool/main/b_2.0_amd64.deb", nil, ""); w.Code != http.StatusForbidden {
+		t.Error(`blocked file must be forbidden before the view is generated`, w.Code)
+	}
+	if w := doRequest(h, "GET", "/up/pool/main/a_1.0_amd64.deb", nil, ""); w.Code != http.StatusOK {
+		t.Error(`not blocked file must be served`, w.Code)
+	}
+
+	if _, err := c.CreateSnapshot("up", "s", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if w := doRequest(h, "GET", "/up@one/pool/main/b_2.0_amd64.deb", nil, ""); w.Code != http.StatusForbidden {
+		t.Error(`blocked file in a snapshot must be forbidden`, w.Code)
+	}
+	if w := doRequest(h, "GET", "/up@one/pool/main/a_1.0_amd64.deb", nil, ""); w.Code != http.StatusOK {
+		t.Error(`not blocked file in a snapshot must be served`, w.Code)
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, ok := c.lookupInfo("all/dists/u/Release"); ok {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	w := doRequest(h, "GET", "/all/dists/u/main/binary-amd64/Packages", nil, "")
+	if w.Code != http.StatusOK {
+		t.Fatal(`union index must be served`, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Package: a\n") {
+		t.Error(`union index must list not blocked packages`)
+	}
+	if strings.Contains(w.Body.String(), "Package: b\n") {
+		t.Error(`union index must not list blocked packages`)
+	}
+	if w := doRequest(h, "GET", "/all/up/pool/main/b_2.0_amd64.deb", nil, ""); w.Code != http.StatusForbidden {
+		t.Error(`blocked file in a union must be forbidden`, w.Code)
+	}
+	if w := doRequest(h, "GET", "/all/up/pool/main/a_1.0_amd64.deb", nil, ""); w.Code != http.StatusOK {
+		t.Error(`not blocked file in a union must be served`, w.Code)
+	}
+}
+
+func TestHandlerSnapshot(t *testing.T) {
+	t.Parallel()
+
+	repo := &testRepo{}
+	repo.setPackages(map[string]string{"a": "1.0"})
+	c, done := newTestCacher(t, repo, func(config *CacherConfig) {
+		config.Access = &AccessConfig{
+			AdminTokens: []string{"admin"},
+		}
+	})
+	defer done()
+	h := c.Handler()
+
+	deb := "/up/pool/main/a_1.0_amd64.deb"
+	if w := doRequest(h, "GET", deb, nil, ""); w.Code != http.StatusOK {
+		t.Fatal(`package must be served`, w.Code)
+	}
+	release := doRequest(h, "GET", "/up/dists/s/Release", nil, "").Body.String()
+
+	form := url.Values{"prefix": {"up"}, "suite": {"s"}, "id": {"one"}}
+	if w := doRequest(h, "POST", "/_api/snapshots", form, "admin"); w.Code != http.StatusCreated {
+		t.Fatal(`snapshot must be created`, w.Code, w.Body.String())
+	}
+	if w := doRequest(h, "GET", "/_api/snapshots", nil, ""); !strings.Contains(w.Body.String(), `"id":"one"`) {
+		t.Error(`snapshot must be listed`, w.Body.String())
+	}
+
+	// the snapshot is not affected by updates of the upstream.
+	repo.setPackages(map[string]string{"a": "2.0"})
+	w := doRequest(h, "GET", "/up@one/dists/s/Release", nil, "")
+	if w.Code != http.StatusOK || w.Body.String() != release {
+		t.Error(`Release of the snapshot must be the old one`, w.Code)
+	}
+	w = doRequest(h, "GET", "/up@one/dists/s/main/binary-amd64/Packages", nil, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Version: 1.0\n") {
+		t.Error(`Packages of the snapshot must be the old one`, w.Code)
+	}
+	w = doRequest(h, "GET", "/up@one/pool/main/a_1.0_amd64.deb", nil, "")
+	if w.Code != http.StatusOK || w.Body.String() != "a 1.0" {
+		t.Error(`package in the snapshot must be served from the cache`, w.Code)
+	}
+	if u := c.items.Usage(); u.Pinned == 0 {
+		t.Error(`package in the snapshot must be pinned`)
+	}
+
+	if w := doRequest(h, "DELETE", "/_api/snapshots/up@one", nil, "admin"); w.Code != http.StatusNoContent {
+		t.Fatal(`snapshot must be deleted`, w.Code)
+	}
+	if w := doRequest(h, "GET", "/up@one/dists/s/Release", nil, ""); w.Code != http.StatusNotFound {
+		t.Error(`deleted snapshot must not be served`, w.Code)
+	}
+	if u := c.items.Usage(); u.Pinned != 0 {
+		t.Error(`package must be unpinned`)
+	}
+}
+
+func TestHandlerCancel(t *testing.T) {
+	t.Parallel()
+
+	repo := &testRepo{hold: make(chan struct{})}
+	repo.setPackages(map[string]string{"a": "1.0", "b": "1.0"})
+	c, done := newTestCacher(t, repo, nil)
+	defer done()
+	defer close(repo.hold)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := c.GetContext(ctx, "up/pool/main/a_1.0_amd64.deb")
+	if err != context.DeadlineExceeded {
+		t.Error(`GetContext must return when ctx is done`, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	r, _ := http.NewRequest("GET", "/up/pool/main/b_1.0_amd64.deb", nil)
+	r = r.WithContext(ctx)
+	r.RemoteAddr = "10.0.0.1:12345"
+	w := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		c.Handler().ServeHTTP(w, r)
+		close(served)
+	}()
+
+	repo.waitHolding(t, 2)
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`handler must return when the request is canceled`)
+	}
+	if w.Code == http.StatusOK {
+		t.Error(`canceled request must not succeed`)
+	}
+}
+
+func TestHandlerLocalUpload(t *testing.T) {
+	t.Parallel()
+
+	c, done := newTestCacher(t, &testRepo{}, func(config *CacherConfig) {
+		config.Local = map[string]*LocalConfig{
+			"internal": {
+				Codename:      "c",
+				Architectures: []string{"amd64"},
+				UploadTokens:  []string{"uploader"},
+			},
+		}
+	})
+	defer done()
+	h := c.Handler()
+
+	upload := func(fname, token string) *httptest.ResponseRecorder {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := http.NewRequest("PUT", "/_api/local/internal", bytes.NewReader(data))
+		r.RemoteAddr = "10.0.0.1:12345"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := upload("t/hoge-xz.deb", ""); w.Code != http.StatusUnauthorized {
+		t.Error(`uploading without a token must be unauthorized`, w.Code)
+	}
+	if w := upload("t/hoge-xz.deb", "uploader"); w.Code != http.StatusCreated {
+		t.Fatal(`uploading must succeed`, w.Code, w.Body.String())
+	}
+	w := upload("t/hoge-zst.deb", "uploader")
+	if w.Code != http.StatusBadRequest {
+		t.Error(`uploading zstd compressed package must be rejected`, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "control.tar.zst") {
+		t.Error(`error must tell the compression`, w.Body.String())
+	}
+
+	w = doRequest(h, "GET", "/_api/local/internal", nil, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"package":"hoge"`) {
+		t.Error(`uploaded package must be listed`, w.Code, w.Body.String())
+	}
+	w = doRequest(h, "GET", "/internal/dists/c/main/binary-amd64/Packages", nil, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Package: hoge\n") {
+		t.Error(`Packages must list the uploaded package`, w.Code)
+	}
+	if w := doRequest(h, "GET", "/internal/dists/c/Release", nil, ""); w.Code != http.StatusOK {
+		t.Error(`Release must be served`, w.Code)
+	}
+
+	deb, err := ioutil.ReadFile("t/hoge-xz.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = doRequest(h, "GET", "/internal/pool/main/h/hoge/hoge_1.0-1_amd64.deb", nil, "")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), deb) {
+		t.Error(`uploaded package must be served`, w.Code)
+	}
+}
+
+func TestHandlerUnionAccess(t *testing.T) {
+	t.Parallel()
+
+	repo := &testRepo{}
+	repo.setPackages(map[string]string{"a": "1.0"})
+	c, done := newTestCacher(t, repo, func(config *CacherConfig) {
+		config.Local = map[string]*LocalConfig{
+			"internal": {
+				Codename:      "c",
+				Architectures: []string{"amd64"},
+			},
+		}
+		config.Union = map[string]*UnionConfig{
+			"all": {
+				Codename:      "u",
+				Members:       []string{"internal/c", "up/s"},
+				Architectures: []string{"amd64"},
+			},
+		}
+		config.Access = &AccessConfig{
+			Mapping: map[string]*NetworkConfig{
+				"internal": {Allow: []string{"10.2.0.0/16"}},
+			},
+		}
+	})
+	defer done()
+	h := c.Handler()
+
+	f, err := os.Open("t/hoge-xz.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := c.Upload("internal", "", f); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(ip, target string) int {
+		r, _ := http.NewRequest("GET", target, nil)
+		r.RemoteAddr = ip + ":12345"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	deb := "/all/internal/pool/main/h/hoge/hoge_1.0-1_amd64.deb"
+	if code := get("10.0.0.1", deb); code != http.StatusForbidden {
+		t.Error(`files of a denied member must be forbidden through the union`, code)
+	}
+	if code := get("10.0.0.1", "/all/dists/u/Release"); code != http.StatusForbidden {
+		t.Error(`indices merged from a denied member must be forbidden`, code)
+	}
+	if code := get("10.0.0.1", "/all/up/pool/main/a_1.0_amd64.deb"); code == http.StatusForbidden {
+		t.Error(`files of a permitted member must not be forbidden`, code)
+	}
+	if code := get("10.2.0.1", deb); code != http.StatusOK {
+		t.Error(`files of a member must be served to permitted clients`, code)
+	}
+}
@@ -0,0 +1,176 @@
+package aptcacher
+
+// This file implements hooks fired on cache events.
+//
+// Events are queued for each hook and processed asynchronously,
+// so that slow hooks never block downloading or serving items.
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	defaultHookRetries   = 3
+	defaultHookTimeout   = 30
+	defaultHookQueueSize = 1000
+	hookRetryInterval    = time.Second
+)
+
+// hookEventTypes is a list of event types that can be hooked.
+var hookEventTypes = []string{
+	EventReleaseChanged,
+	EventIndexUpdated,
+	EventDownloaded,
+	EventValidationFailed,
+	EventEvicted,
+	EventUpstreamError,
+}
+
+// hook keeps the state of a hook.
+type hook struct {
+	config *HookConfig
+	events map[string]bool
+	queue  chan *Event
+	client *http.Client
+	logger *log.Logger
+}
+
+func newHook(config *HookConfig, logger *log.Logger) (*hook, error) {
+	if (config.URL == "") == (len(config.Command) == 0) {
+		return nil, errors.New("either url or command must be specified")
+	}
+	if config.Retries == 0 {
+		config.Retries = defaultHookRetries
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultHookTimeout
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = defaultHookQueueSize
+	}
+
+	h := &hook{
+		config: config,
+		queue:  make(chan *Event, config.QueueSize),
+		client: &http.Client{},
+		logger: logger,
+		events: make(map[string]bool),
+	}
+	events := config.Events
+	if len(events) == 0 {
+		events = hookEventTypes
+	}
+	for _, t := range events {
+		if !contains(hookEventTypes, t) {
+			return nil, errors.New("unknown event: " + t)
+		}
+		h.events[t] = true
+	}
+	return h, nil
+}
+
+// name returns a string to identify the hook in logs.
+func (h *hook) name() string {
+	if h.config.URL != "" {
+		return h.config.URL
+	}
+	return h.config.Command[0]
+}
+
+// Observe implements Observer.
+//
+// The event is queued without blocking.
+func (h *hook) Observe(e *Event) {
+	if !h.events[e.Type] {
+		return
+	}
+	select {
+	case h.queue <- e:
+	default:
+		h.logger.Warn("hook: queue is full", map[string]interface{}{
+			"_hook":  h.name(),
+			"_event": e.Type,
+			"_path":  e.Path,
+		})
+	}
+}
+
+// fire invokes the hook once.
+func (h *hook) fire(ctx context.Context, e *Event, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.config.Timeout)*time.Second)
+	defer cancel()
+
+	if h.config.URL != "" {
+		resp, err := ctxhttp.Post(ctx, h.client, h.config.URL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return errors.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, h.config.Command[0], h.config.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"GO_APT_CACHER_EVENT="+e.Type,
+		"GO_APT_CACHER_PATH="+e.Path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrap(err, string(bytes.TrimSpace(out)))
+	}
+	return nil
+}
+
+// run is a goroutine to process queued events.
+//
+// Failed invocations are retried with exponential backoff.
+func (h *hook) run(ctx context.Context) {
+	for {
+		var e *Event
+		select {
+		case <-ctx.Done():
+			return
+		case e = <-h.queue:
+		}
+
+		payload, err := json.Marshal(e)
+		if err != nil {
+			panic(err)
+		}
+
+		interval := hookRetryInterval
+		for i := 0; ; i++ {
+			err = h.fire(ctx, e, payload)
+			if err == nil || i >= h.config.Retries {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			interval *= 2
+		}
+		if err != nil {
+			h.logger.Error("hook: failed", map[string]interface{}{
+				"_hook":  h.name(),
+				"_event": e.Type,
+				"_path":  e.Path,
+				"_err":   err.Error(),
+			})
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package aptcacher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"golang.org/x/net/context"
+)
+
+func TestNewHook(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newHook(&HookConfig{}, log.DefaultLogger()); err == nil {
+		t.Error(`hook without url nor command`)
+	}
+	if _, err := newHook(&HookConfig{URL: "http://localhost/", Command: []string{"true"}}, log.DefaultLogger()); err == nil {
+		t.Error(`hook with both url and command`)
+	}
+	if _, err := newHook(&HookConfig{URL: "http://localhost/", Events: []string{"unknown"}}, log.DefaultLogger()); err == nil {
+		t.Error(`hook with unknown event`)
+	}
+
+	h, err := newHook(&HookConfig{Command: []string{"true"}}, log.DefaultLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.config.Retries != defaultHookRetries {
+		t.Error(`h.config.Retries != defaultHookRetries`)
+	}
+	if h.config.Timeout != defaultHookTimeout {
+		t.Error(`h.config.Timeout != defaultHookTimeout`)
+	}
+	if cap(h.queue) != defaultHookQueueSize {
+		t.Error(`cap(h.queue) != defaultHookQueueSize`)
+	}
+}
+
+func TestHookEnqueue(t *testing.T) {
+	t.Parallel()
+
+	h, err := newHook(&HookConfig{
+		URL:       "http://localhost/",
+		Events:    []string{EventEvicted},
+		QueueSize: 1,
+	}, log.DefaultLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.Observe(&Event{Type: EventDownloaded, Path: "a"})
+	if len(h.queue) != 0 {
+		t.Error(`unsubscribed event is queued`)
+	}
+	h.Observe(&Event{Type: EventEvicted, Path: "a"})
+	h.Observe(&Event{Type: EventEvicted, Path: "b"})
+	if len(h.queue) != 1 {
+		t.Fatal(`len(h.queue) != 1`)
+	}
+	if e := <-h.queue; e.Path != "a" {
+		t.Error(`e.Path != "a"`)
+	}
+}
+
+func TestHookWebhook(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var calls int
+	received := make(chan *Event, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		n := calls
+		mu.Unlock()
+
+		// fail the first request to test retries.
+		if n == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		e := new(Event)
+		if err := json.NewDecoder(r.Body).Decode(e); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	}))
+	defer ts.Close()
+
+	h, err := newHook(&HookConfig{URL: ts.URL}, log.DefaultLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.run(ctx)
+
+	h.Observe(&Event{Type: EventDownloaded, Path: "ubuntu/pool/a.deb", Size: 10})
+
+	select {
+	case e := <-received:
+		if e.Type != EventDownloaded || e.Path != "ubuntu/pool/a.deb" || e.Size != 10 {
+			t.Errorf("unexpected event: %#v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal(`webhook was not invoked`)
+	}
+}
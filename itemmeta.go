@@ -0,0 +1,166 @@
+package aptcacher
+
+// This file implements meta data persisted with cached files.
+//
+// Checksums and upstream headers of a cached file are kept in an
+// extended attribute of the file, or in a sidecar file if extended
+// attributes are not available.  They are trusted only when the size
+// and the modification time of the file are the same as recorded.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const (
+	// metaSuffix is appended to the name of a cached file for
+	// its sidecar file.
+	metaSuffix = ".meta"
+
+	// metaXattr is the name of the extended attribute.
+	metaXattr = "user.go-apt-cacher"
+)
+
+// cachedHeaders are upstream headers kept with cached files.
+var cachedHeaders = []string{"Last-Modified", "ETag"}
+
+// itemMeta is meta data of a cached file.
+type itemMeta struct {
+	Size      uint64      `json:"size"`
+	ModTime   int64       `json:"mtime"`
+	MD5Sum    string      `json:"md5sum"`
+	SHA1Sum   string      `json:"sha1"`
+	SHA256Sum string      `json:"sha256"`
+	Header    http.Header `json:"header,omitempty"`
+}
+
+func newItemMeta(fi *FileInfo, st os.FileInfo) *itemMeta {
+	return &itemMeta{
+		Size:      uint64(st.Size()),
+		ModTime:   st.ModTime().UnixNano(),
+		MD5Sum:    hex.EncodeToString(fi.md5sum),
+		SHA1Sum:   hex.EncodeToString(fi.sha1sum),
+		SHA256Sum: hex.EncodeToString(fi.sha256sum),
+		Header:    fi.header,
+	}
+}
+
+// apply sets checksums and headers to fi if m is for the file
+// described by st.  It returns false if m is stale.
+func (m *itemMeta) apply(fi *FileInfo, st os.FileInfo) bool {
+	if m.Size != uint64(st.Size()) || m.ModTime != st.ModTime().UnixNano() {
+		return false
+	}
+	md5sum, err1 := hex.DecodeString(m.MD5Sum)
+	sha1sum, err2 := hex.DecodeString(m.SHA1Sum)
+	sha256sum, err3 := hex.DecodeString(m.SHA256Sum)
+	if err1 != nil || err2 != nil || err3 != nil || len(md5sum) == 0 {
+		return false
+	}
+	fi.md5sum = md5sum
+	fi.sha1sum = sha1sum
+	fi.sha256sum = sha256sum
+	fi.header = m.Header
+	return true
+}
+
+// writeItemMeta writes m for a file fname.  The extended attribute is
+// set to fname, or the sidecar file is created for fname.  dir is used
+// for a temporary file.
+//
+// If fname is a temporary file, it must be renamed by moveItemFile
+// so that the sidecar file follows it.
+func writeItemMeta(dir, fname string, m *itemMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if setXattr(fname, metaXattr, data) == nil {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(dir, "_tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fname+metaSuffix)
+}
+
+// readItemMeta reads meta data of a cached file fname.
+func readItemMeta(fname string) (*itemMeta, error) {
+	data, err := getXattr(fname, metaXattr)
+	if err != nil {
+		data, err = ioutil.ReadFile(fname + metaSuffix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m := new(itemMeta)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// removeItemFile removes a cached file and its sidecar file.
+func removeItemFile(fname string) error {
+	os.Remove(fname + metaSuffix)
+	return os.Remove(fname)
+}
+
+// moveItemFile renames a cached file and its sidecar file.
+//
+// The sidecar file is renamed after the cached file so that it is
+// never left without the cached file.
+func moveItemFile(fname, dest string) error {
+	if err := os.Rename(fname, dest); err != nil {
+		return err
+	}
+	return moveSidecar(fname, dest)
+}
+
+// moveSidecar renames the sidecar file of fname for dest.
+// If fname has no sidecar file, a stale one for dest is removed.
+func moveSidecar(fname, dest string) error {
+	err := os.Rename(fname+metaSuffix, dest+metaSuffix)
+	if os.IsNotExist(err) {
+		err = os.Remove(dest + metaSuffix)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// cachedHeader returns headers in cachedHeaders, or nil if none.
+func cachedHeader(h http.Header) http.Header {
+	var ch http.Header
+	for _, k := range cachedHeaders {
+		if v := h.Get(k); v != "" {
+			if ch == nil {
+				ch = make(http.Header)
+			}
+			ch.Set(k, v)
+		}
+	}
+	return ch
+}
+
+// headerReader is implemented by bodies returned by fetchers that
+// can tell upstream headers.
+type headerReader interface {
+	Header() http.Header
+}
@@ -0,0 +1,168 @@
+package aptcacher
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestItemMeta(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := NewStorage(dir, 0)
+	data := []byte("data")
+	fi := MakeFileInfo("path/to/data", data)
+	fi.header = http.Header{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}
+	if err := cm.Insert(data, fi); err != nil {
+		t.Fatal(err)
+	}
+
+	// checksums are restored without reading the file.
+	cm = NewStorage(dir, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	e := cm.cache["path/to/data"]
+	if !bytes.Equal(e.sha256sum, fi.sha256sum) || !bytes.Equal(e.md5sum, fi.md5sum) {
+		t.Error(`checksums are not restored`)
+	}
+	if e.header.Get("Last-Modified") != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Error(`headers are not restored`)
+	}
+	item, err := cm.LookupItem(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.(headerReader).Header().Get("Last-Modified") == "" {
+		t.Error(`LookupItem does not return headers`)
+	}
+	item.Close()
+
+	// stale meta data is ignored.
+	fname := filepath.Join(dir, "path/to/data"+fileSuffix)
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(fname, future, future); err != nil {
+		t.Fatal(err)
+	}
+	cm = NewStorage(dir, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if cm.cache["path/to/data"].md5sum != nil {
+		t.Error(`stale checksums are used`)
+	}
+
+	// checksums calculated by Lookup are saved.
+	item, err = cm.Lookup(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Close()
+	cm = NewStorage(dir, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if cm.cache["path/to/data"].md5sum == nil {
+		t.Error(`calculated checksums are not saved`)
+	}
+
+	if err := cm.Delete("path/to/data"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fname + metaSuffix); !os.IsNotExist(err) {
+		t.Error(`sidecar file is not removed`)
+	}
+}
+
+func TestItemMetaSidecar(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("data")
+	fname := filepath.Join(dir, "data"+fileSuffix)
+	if err := ioutil.WriteFile(fname, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(newItemMeta(MakeFileInfo("data", data), st))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fname+metaSuffix, j, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := readItemMeta(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := &FileInfo{path: "data", size: 4}
+	if !m.apply(fi, st) {
+		t.Fatal(`m.apply returned false`)
+	}
+	if !fi.Same(MakeFileInfo("data", data)) || fi.sha1sum == nil {
+		t.Error(`wrong checksums`)
+	}
+}
+
+func TestMoveItemFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "_tmp")
+	dest := filepath.Join(dir, "data"+fileSuffix)
+	for _, fname := range []string{src, src + metaSuffix, dest + metaSuffix} {
+		if err := ioutil.WriteFile(fname, []byte(fname), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := moveItemFile(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dest + metaSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != src+metaSuffix {
+		t.Error(`sidecar file is not moved`)
+	}
+	if _, err := os.Stat(src + metaSuffix); !os.IsNotExist(err) {
+		t.Error(`sidecar file is left`)
+	}
+
+	// a stale sidecar file is removed if the source has none.
+	if err := ioutil.WriteFile(src, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveItemFile(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dest + metaSuffix); !os.IsNotExist(err) {
+		t.Error(`stale sidecar file is not removed`)
+	}
+}
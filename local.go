@@ -0,0 +1,352 @@
+package aptcacher
+
+// This file implements local repositories hosted by go-apt-cacher.
+//
+// Uploaded binary packages are stored in items storage and pinned.
+// Indices are generated from control data of the packages and stored
+// in meta storage.
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxUploadSize limits the size of an uploaded package.
+	// Uploads are spooled in temporary files, not in memory.
+	maxUploadSize = 1 << 30
+)
+
+var (
+	validPackageName = regexp.MustCompile(`^[a-z0-9][a-z0-9.+-]+$`)
+	validVersion     = regexp.MustCompile(`^[A-Za-z0-9.+~:-]+$`)
+
+	// ErrPackageExists is returned by Upload if a different file
+	// of the same package, version, and architecture exists.
+	ErrPackageExists = errors.New("package already exists")
+)
+
+// localRepo keeps the state of a local repository.
+type localRepo struct {
+	prefix string
+	config *LocalConfig
+	signer *signer
+
+	mu       sync.Mutex
+	packages map[string]Paragraph // keyed by Filename
+}
+
+func newLocalRepo(prefix string, config *LocalConfig) (*localRepo, error) {
+	if config.Codename == "" || strings.Contains(config.Codename, "/") {
+		return nil, errors.New("invalid codename: " + config.Codename)
+	}
+	if len(config.Components) == 0 {
+		config.Components = []string{"main"}
+	}
+	if len(config.Architectures) == 0 {
+		return nil, errors.New("no architectures")
+	}
+
+	l := &localRepo{
+		prefix:   prefix,
+		config:   config,
+		packages: make(map[string]Paragraph),
+	}
+	if config.SigningKey != "" {
+		s, err := newSigner(config.SigningKey, config.SigningPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		l.signer = s
+	}
+	return l, nil
+}
+
+// dir returns the path of the suite directory.
+func (l *localRepo) dir() string {
+	return path.Join(l.prefix, "dists", l.config.Codename)
+}
+
+// packagesPath returns the path of Packages relative to dir().
+func packagesPath(component, arch string) string {
+	return path.Join(component, "binary-"+arch, "Packages")
+}
+
+// authorized returns true if r has a valid upload token.
+func (l *localRepo) authorized(r *http.Request) bool {
+	return matchToken(l.config.UploadTokens, requestToken(r))
+}
+
+// indices generates Packages for all components and architectures.
+// l.mu must be locked beforehand.
+func (l *localRepo) indices() []indexFile {
+	filenames := make([]string, 0, len(l.packages))
+	for filename := range l.packages {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	var files []indexFile
+	for _, component := range l.config.Components {
+		poolDir := path.Join("pool", component) + "/"
+		for _, arch := range l.config.Architectures {
+			var pl []Paragraph
+			for _, filename := range filenames {
+				if !strings.HasPrefix(filename, poolDir) {
+					continue
+				}
+				d := l.packages[filename]
+				if a := d.get("Architecture"); a == arch || a == "all" {
+					pl = append(pl, d)
+				}
+			}
+			data := writeIndex(pl, packagesOrder, nil)
+			files = append(files, withGzip(packagesPath(component, arch), data)...)
+		}
+	}
+	return files
+}
+
+// releaseFields returns fields of Release.
+func (l *localRepo) releaseFields() Paragraph {
+	return suiteFields(l.config.Codename, l.config.Origin, l.config.Label,
+		l.config.Components, l.config.Architectures)
+}
+
+// loadLocalRepo restores packages of a local repository from
+// Packages indices in meta storage, and pins package files.
+//
+// If indices have not been generated, empty indices are published.
+func (c *Cacher) loadLocalRepo(l *localRepo) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dir := l.dir()
+	if _, ok := c.lookupInfo(path.Join(dir, "Release")); !ok {
+		return c.publishSuite(dir, l.indices(), l.releaseFields(), l.signer)
+	}
+
+	for _, component := range l.config.Components {
+		for _, arch := range l.config.Architectures {
+			p := path.Join(dir, packagesPath(component, arch))
+			fi, ok := c.lookupInfo(p)
+			if !ok {
+				continue
+			}
+			f, err := c.meta.LookupItem(fi)
+			if err != nil {
+				return errors.Wrap(err, p)
+			}
+			parser := NewParser(f)
+			for {
+				d, err := parser.Read()
+				if err != nil {
+					break
+				}
+				filename := d.get("Filename")
+				if _, ok := l.packages[filename]; ok {
+					continue
+				}
+				l.packages[filename] = d
+				c.items.Pin(path.Join(l.prefix, filename))
+			}
+			f.Close()
+		}
+	}
+	return nil
+}
+
+// poolFilename returns Filename of a binary package.
+func poolFilename(component string, d Paragraph) string {
+	name := d.get("Package")
+	source := sourcePackage(d)
+	dir := source[:1]
+	if strings.HasPrefix(source, "lib") && len(source) > 3 {
+		dir = source[:4]
+	}
+
+	version := d.get("Version")
+	if i := strings.IndexByte(version, ':'); i >= 0 {
+		version = version[i+1:]
+	}
+	base := fmt.Sprintf("%s_%s_%s.deb", name, version, d.get("Architecture"))
+	return path.Join("pool", component, dir, source, base)
+}
+
+// spoolUpload copies an uploaded file into a temporary file while
+// calculating its checksums.  The returned FileInfo has no path.
+//
+// The caller must close and remove the returned file.
+func spoolUpload(r io.Reader) (*os.File, *FileInfo, error) {
+	f, err := ioutil.TempFile("", "go-apt-cacher-upload")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	md5hash := md5.New()
+	sha1hash := sha1.New()
+	sha256hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, md5hash, sha1hash, sha256hash), r)
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_SET)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	return f, &FileInfo{
+		size:      uint64(size),
+		md5sum:    md5hash.Sum(nil),
+		sha1sum:   sha1hash.Sum(nil),
+		sha256sum: sha256hash.Sum(nil),
+	}, nil
+}
+
+// Upload adds a binary package read from r to a local repository.
+//
+// The package is spooled in a temporary file rather than memory.
+// If component is empty, the first component of the repository is used.
+// The returned Paragraph is the entry in Packages for the package.
+func (c *Cacher) Upload(prefix, component string, r io.Reader) (Paragraph, error) {
+	l, ok := c.locals[prefix]
+	if !ok {
+		return nil, errors.New("not a local repository: " + prefix)
+	}
+	if component == "" {
+		component = l.config.Components[0]
+	}
+	if !contains(l.config.Components, component) {
+		return nil, errors.New("unknown component: " + component)
+	}
+
+	f, fi, err := spoolUpload(r)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	d, err := ReadDebControl(f)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range []string{"Package", "Version", "Architecture"} {
+		if d.get(k) == "" {
+			return nil, errors.New("no " + k + " in control")
+		}
+	}
+	source := sourcePackage(d)
+	for _, name := range []string{d.get("Package"), source} {
+		if !validPackageName.MatchString(name) {
+			return nil, errors.New("invalid package name: " + name)
+		}
+	}
+	if !validVersion.MatchString(d.get("Version")) {
+		return nil, errors.New("invalid version: " + d.get("Version"))
+	}
+	if arch := d.get("Architecture"); arch != "all" && !contains(l.config.Architectures, arch) {
+		return nil, errors.New("unsupported architecture: " + arch)
+	}
+
+	filename := poolFilename(component, d)
+	p := path.Join(prefix, filename)
+	fi = fi.withPath(p)
+	d["Filename"] = []string{filename}
+	d["Size"] = []string{strconv.FormatUint(fi.size, 10)}
+	d["MD5sum"] = []string{hex.EncodeToString(fi.md5sum)}
+	d["SHA1"] = []string{hex.EncodeToString(fi.sha1sum)}
+	d["SHA256"] = []string{hex.EncodeToString(fi.sha256sum)}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if existing, ok := l.packages[filename]; ok {
+		if existing.get("SHA256") == d.get("SHA256") {
+			return existing, nil
+		}
+		return nil, ErrPackageExists
+	}
+
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	c.items.Pin(p)
+	if err := c.items.InsertItem(f, fi); err != nil {
+		c.items.Unpin(p)
+		return nil, err
+	}
+
+	l.packages[filename] = d
+	err = c.publishSuite(l.dir(), l.indices(), l.releaseFields(), l.signer)
+	if err != nil {
+		delete(l.packages, filename)
+		c.items.Unpin(p)
+		return nil, err
+	}
+
+	c.logger.Info("package uploaded", map[string]interface{}{
+		"_path": p,
+	})
+	return d, nil
+}
+
+// LocalPackage represents a package in a local repository.
+type LocalPackage struct {
+	Package      string `json:"package"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture"`
+	Filename     string `json:"filename"`
+	SHA256       string `json:"sha256"`
+}
+
+func makeLocalPackage(d Paragraph) *LocalPackage {
+	return &LocalPackage{
+		Package:      d.get("Package"),
+		Version:      d.get("Version"),
+		Architecture: d.get("Architecture"),
+		Filename:     d.get("Filename"),
+		SHA256:       d.get("SHA256"),
+	}
+}
+
+// LocalPackages returns packages in a local repository sorted
+// by their file names.
+func (c *Cacher) LocalPackages(prefix string) ([]*LocalPackage, error) {
+	l, ok := c.locals[prefix]
+	if !ok {
+		return nil, errors.New("not a local repository: " + prefix)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	filenames := make([]string, 0, len(l.packages))
+	for filename := range l.packages {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	pl := make([]*LocalPackage, 0, len(filenames))
+	for _, filename := range filenames {
+		pl = append(pl, makeLocalPackage(l.packages[filename]))
+	}
+	return pl, nil
+}
@@ -0,0 +1,45 @@
+package aptcacher
+
+import "testing"
+
+func TestPoolFilename(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		d        Paragraph
+		filename string
+	}{
+		{
+			Paragraph{
+				"Package":      {"hoge"},
+				"Version":      {"1.0-1"},
+				"Architecture": {"amd64"},
+			},
+			"pool/main/h/hoge/hoge_1.0-1_amd64.deb",
+		},
+		{
+			Paragraph{
+				"Package":      {"libfoo1"},
+				"Source":       {"foo (2.0-1)"},
+				"Version":      {"1:2.0-1+b1"},
+				"Architecture": {"arm64"},
+			},
+			"pool/main/f/foo/libfoo1_2.0-1+b1_arm64.deb",
+		},
+		{
+			Paragraph{
+				"Package":      {"libbar-dev"},
+				"Source":       {"libbar"},
+				"Version":      {"3"},
+				"Architecture": {"all"},
+			},
+			"pool/main/libb/libbar/libbar-dev_3_all.deb",
+		},
+	}
+
+	for _, c := range cases {
+		if filename := poolFilename("main", c.d); filename != c.filename {
+			t.Errorf("%s != %s", filename, c.filename)
+		}
+	}
+}
@@ -17,6 +17,18 @@ import (
 // IsMeta returns true if p points a debian repository index file
 // containing checksums for other files.
 func IsMeta(p string) bool {
+	switch indexBase(p) {
+	case "Release", "Release.gpg", "InRelease":
+		return true
+	case "Packages", "Sources", "Index":
+		return true
+	}
+
+	return false
+}
+
+// indexBase returns the base name of p without compression extensions.
+func indexBase(p string) string {
 	base := path.Base(p)
 
 	// https://wiki.debian.org/RepositoryFormat#Compression_of_indices
@@ -32,15 +44,7 @@ func IsMeta(p string) bool {
 	case strings.HasSuffix(base, ".lz"):
 		base = base[0 : len(base)-3]
 	}
-
-	switch base {
-	case "Release", "Release.gpg", "InRelease":
-		return true
-	case "Packages", "Sources", "Index":
-		return true
-	}
-
-	return false
+	return base
 }
 
 // IsSupported returns true if the meta data is compressed that can be
@@ -155,14 +159,87 @@ func getFilesFromRelease(p string, r io.Reader) ([]*FileInfo, error) {
 	return l, nil
 }
 
-// getFilesFromPackages parses Packages file and returns
-// a list of *FileInfo pointed in the file.
-func getFilesFromPackages(p string, r io.Reader) ([]*FileInfo, error) {
+// packageFileInfo returns *FileInfo for a binary package described
+// in a paragraph of Packages file.
+//
+// prefix is the mapping prefix of the Packages file.
+func packageFileInfo(prefix string, d Paragraph) (*FileInfo, error) {
+	filename, ok := d["Filename"]
+	if !ok {
+		return nil, errors.New("no Filename")
+	}
+	p := path.Join(prefix, path.Clean(filename[0]))
+
+	strsize, ok := d["Size"]
+	if !ok {
+		return nil, errors.New("no Size in " + p)
+	}
+	size, err := strconv.ParseUint(strsize[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	fi := &FileInfo{
+		path: p,
+		size: size,
+	}
+	if csum, ok := d["MD5sum"]; ok {
+		b, err := hex.DecodeString(csum[0])
+		if err != nil {
+			return nil, err
+		}
+		fi.md5sum = b
+	}
+	if csum, ok := d["SHA1"]; ok {
+		b, err := hex.DecodeString(csum[0])
+		if err != nil {
+			return nil, err
+		}
+		fi.sha1sum = b
+	}
+	if csum, ok := d["SHA256"]; ok {
+		b, err := hex.DecodeString(csum[0])
+		if err != nil {
+			return nil, err
+		}
+		fi.sha256sum = b
+	}
+	return fi, nil
+}
+
+// sourcePackage returns the source package name of a paragraph
+// in Packages file.
+func sourcePackage(d Paragraph) string {
+	return strings.Fields(d.get("Source") + " " + d.get("Package"))[0]
+}
+
+// binaryPackage is an entry of Packages or Sources file.
+type binaryPackage struct {
+	name    string
+	version string
+	arch    string
+	fi      *FileInfo
+}
+
+// key returns a string to identify the package in a Packages file.
+func (bp *binaryPackage) key() string {
+	return bp.name + "/" + bp.arch
+}
+
+// readPackages parses (compressed) Packages or Sources file p and
+// returns the listed packages keyed by binaryPackage.key().
+//
+// For Sources, arch of packages is "source" and fi is nil.
+func readPackages(p string, r io.Reader) (map[string]*binaryPackage, error) {
 	prefix := strings.SplitN(p, "/", 2)[0]
 
-	var l []*FileInfo
-	parser := NewParser(r)
+	base, r, err := decompress(p, r)
+	if err != nil {
+		return nil, err
+	}
 
+	m := make(map[string]*binaryPackage)
+	parser := NewParser(r)
 	for {
 		d, err := parser.Read()
 		if err == io.EOF {
@@ -172,55 +249,56 @@ func getFilesFromPackages(p string, r io.Reader) ([]*FileInfo, error) {
 			return nil, errors.Wrap(err, "parser.Read")
 		}
 
-		filename, ok := d["Filename"]
-		if !ok {
-			return nil, errors.New("no Filename in " + p)
+		if base == "Sources" {
+			bp := &binaryPackage{
+				name:    d.get("Package"),
+				version: d.get("Version"),
+				arch:    "source",
+			}
+			m[bp.key()] = bp
+			continue
 		}
-		p := path.Join(prefix, path.Clean(filename[0]))
 
-		strsize, ok := d["Size"]
-		if !ok {
-			return nil, errors.New("no Size in " + p)
-		}
-		size, err := strconv.ParseUint(strsize[0], 10, 64)
+		fi, err := packageFileInfo(prefix, d)
 		if err != nil {
-			return nil, err
-		}
-
-		fi := &FileInfo{
-			path: p,
-			size: size,
+			return nil, errors.Wrap(err, p)
 		}
-		if csum, ok := d["MD5sum"]; ok {
-			b, err := hex.DecodeString(csum[0])
-			if err != nil {
-				return nil, err
-			}
-			fi.md5sum = b
+		bp := &binaryPackage{
+			name:    d.get("Package"),
+			version: d.get("Version"),
+			arch:    d.get("Architecture"),
+			fi:      fi,
 		}
-		if csum, ok := d["SHA1"]; ok {
-			b, err := hex.DecodeString(csum[0])
-			if err != nil {
-				return nil, err
-			}
-			fi.sha1sum = b
+		m[bp.key()] = bp
+	}
+	return m, nil
+}
+
+// readParagraphs reads all paragraphs in a (compressed) index p.
+func readParagraphs(p string, r io.Reader) ([]Paragraph, error) {
+	_, r, err := decompress(p, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var l []Paragraph
+	parser := NewParser(r)
+	for {
+		d, err := parser.Read()
+		if err == io.EOF {
+			break
 		}
-		if csum, ok := d["SHA256"]; ok {
-			b, err := hex.DecodeString(csum[0])
-			if err != nil {
-				return nil, err
-			}
-			fi.sha256sum = b
+		if err != nil {
+			return nil, errors.Wrap(err, "parser.Read")
 		}
-		l = append(l, fi)
+		l = append(l, d)
 	}
-
 	return l, nil
 }
 
-// getFilesFromSources parses Sources file and returns
+// getFilesFromPackages parses Packages file and returns
 // a list of *FileInfo pointed in the file.
-func getFilesFromSources(p string, r io.Reader) ([]*FileInfo, error) {
+func getFilesFromPackages(p string, r io.Reader) ([]*FileInfo, error) {
 	prefix := strings.SplitN(p, "/", 2)[0]
 
 	var l []*FileInfo
@@ -235,62 +313,101 @@ func getFilesFromSources(p string, r io.Reader) ([]*FileInfo, error) {
 			return nil, errors.Wrap(err, "parser.Read")
 		}
 
-		dir, ok := d["Directory"]
-		if !ok {
-			return nil, errors.New("no Directory in " + p)
+		fi, err := packageFileInfo(prefix, d)
+		if err != nil {
+			return nil, errors.Wrap(err, p)
 		}
-		files, ok := d["Files"]
-		if !ok {
-			return nil, errors.New("no Files in " + p)
+		l = append(l, fi)
+	}
+
+	return l, nil
+}
+
+// sourceFileInfo returns a list of *FileInfo for files of a source
+// package described in a paragraph of Sources file.
+//
+// prefix is the mapping prefix of the Sources file.
+func sourceFileInfo(prefix string, d Paragraph) ([]*FileInfo, error) {
+	dir, ok := d["Directory"]
+	if !ok {
+		return nil, errors.New("no Directory")
+	}
+	files, ok := d["Files"]
+	if !ok {
+		return nil, errors.New("no Files")
+	}
+
+	var l []*FileInfo
+	m := make(map[string]*FileInfo)
+	for _, line := range files {
+		fname, size, csum, err := parseChecksum(line)
+		if err != nil {
+			return nil, errors.Wrap(err, "parseChecksum for Files")
 		}
 
-		m := make(map[string]*FileInfo)
-		for _, l := range files {
-			fname, size, csum, err := parseChecksum(l)
-			if err != nil {
-				return nil, errors.Wrap(err, "parseChecksum for Files")
-			}
+		fpath := path.Join(prefix, dir[0], fname)
+		fi := &FileInfo{
+			path:   fpath,
+			size:   size,
+			md5sum: csum,
+		}
+		m[fpath] = fi
+		l = append(l, fi)
+	}
 
-			fpath := path.Join(prefix, dir[0], fname)
-			fi := &FileInfo{
-				path:   fpath,
-				size:   size,
-				md5sum: csum,
-			}
-			m[fpath] = fi
+	for _, line := range d["Checksums-Sha1"] {
+		fname, _, csum, err := parseChecksum(line)
+		if err != nil {
+			return nil, errors.Wrap(err, "parseChecksum for Checksums-Sha1")
 		}
 
-		for _, l := range d["Checksums-Sha1"] {
-			fname, _, csum, err := parseChecksum(l)
-			if err != nil {
-				return nil, errors.Wrap(err, "parseChecksum for Checksums-Sha1")
-			}
+		fpath := path.Join(prefix, dir[0], fname)
+		fi, ok := m[fpath]
+		if !ok {
+			return nil, errors.New("mismatch between Files and Checksums-Sha1")
+		}
+		fi.sha1sum = csum
+	}
 
-			fpath := path.Join(prefix, dir[0], fname)
-			fi, ok := m[fpath]
-			if !ok {
-				return nil, errors.New("mismatch between Files and Checksums-Sha1 in " + p)
-			}
-			fi.sha1sum = csum
+	for _, line := range d["Checksums-Sha256"] {
+		fname, _, csum, err := parseChecksum(line)
+		if err != nil {
+			return nil, errors.Wrap(err, "parseChecksum for Checksums-Sha256")
 		}
 
-		for _, l := range d["Checksums-Sha256"] {
-			fname, _, csum, err := parseChecksum(l)
-			if err != nil {
-				return nil, errors.Wrap(err, "parseChecksum for Checksums-Sha256")
-			}
+		fpath := path.Join(prefix, dir[0], fname)
+		fi, ok := m[fpath]
+		if !ok {
+			return nil, errors.New("mismatch between Files and Checksums-Sha256")
+		}
+		fi.sha256sum = csum
+	}
 
-			fpath := path.Join(prefix, dir[0], fname)
-			fi, ok := m[fpath]
-			if !ok {
-				return nil, errors.New("mismatch between Files and Checksums-Sha256 in " + p)
-			}
-			fi.sha256sum = csum
+	return l, nil
+}
+
+// getFilesFromSources parses Sources file and returns
+// a list of *FileInfo pointed in the file.
+func getFilesFromSources(p string, r io.Reader) ([]*FileInfo, error) {
+	prefix := strings.SplitN(p, "/", 2)[0]
+
+	var l []*FileInfo
+	parser := NewParser(r)
+
+	for {
+		d, err := parser.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "parser.Read")
 		}
 
-		for _, fi := range m {
-			l = append(l, fi)
+		fil, err := sourceFileInfo(prefix, d)
+		if err != nil {
+			return nil, errors.Wrap(err, p)
 		}
+		l = append(l, fil...)
 	}
 
 	return l, nil
@@ -302,16 +419,10 @@ func getFilesFromIndex(p string, r io.Reader) ([]*FileInfo, error) {
 	return getFilesFromRelease(p, r)
 }
 
-// ExtractFileInfo parses debian repository index files such as
-// Release, Packages, or Sources and return a list of *FileInfo
-// listed in the file.
-//
-// p is the local path.
-func ExtractFileInfo(p string, r io.Reader) ([]*FileInfo, error) {
-	if !IsMeta(p) {
-		return nil, errors.New("not a meta data file: " + p)
-	}
-
+// decompress returns a reader for the decompressed contents of
+// an index file p, together with the base name of p without
+// the compression extension.
+func decompress(p string, r io.Reader) (string, io.Reader, error) {
 	base := path.Base(p)
 	ext := path.Ext(base)
 	switch ext {
@@ -320,16 +431,32 @@ func ExtractFileInfo(p string, r io.Reader) ([]*FileInfo, error) {
 	case ".gz":
 		gz, err := gzip.NewReader(r)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
-		defer gz.Close()
 		r = gz
 		base = base[:len(base)-3]
 	case ".bz2":
 		r = bzip2.NewReader(r)
 		base = base[:len(base)-4]
 	default:
-		return nil, errors.New("unsupported file extension: " + ext)
+		return "", nil, errors.New("unsupported file extension: " + ext)
+	}
+	return base, r, nil
+}
+
+// ExtractFileInfo parses debian repository index files such as
+// Release, Packages, or Sources and return a list of *FileInfo
+// listed in the file.
+//
+// p is the local path.
+func ExtractFileInfo(p string, r io.Reader) ([]*FileInfo, error) {
+	if !IsMeta(p) {
+		return nil, errors.New("not a meta data file: " + p)
+	}
+
+	base, r, err := decompress(p, r)
+	if err != nil {
+		return nil, err
 	}
 
 	switch base {
@@ -271,3 +271,36 @@ func TestExtractFileInfo(t *testing.T) {
 		t.Error(`len(fil) != 0`)
 	}
 }
+
+func TestReadPackages(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("t/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	m, err := readPackages("ubuntu/dists/testing/main/binary-amd64/Packages", f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 {
+		t.Fatal(`len(m) != 2`)
+	}
+
+	bp, ok := m["cybozu-abc/amd64"]
+	if !ok {
+		t.Fatal(`cybozu-abc/amd64 not found`)
+	}
+	if bp.version != "0.2.2-1" {
+		t.Error(`bp.version != "0.2.2-1"`)
+	}
+	if bp.fi.path != "ubuntu/pool/c/cybozu-abc_0.2.2-1_amd64.deb" {
+		t.Error(`bp.fi.path != "ubuntu/pool/c/cybozu-abc_0.2.2-1_amd64.deb"`)
+	}
+
+	if _, ok := m["cybozu-fuga/all"]; !ok {
+		t.Error(`cybozu-fuga/all not found`)
+	}
+}
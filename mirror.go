@@ -0,0 +1,422 @@
+package aptcacher
+
+// This file implements full mirror mode for selected suites.
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	mirrorWorkers = 4
+)
+
+// MirrorStatus represents the synchronization status of a mirror.
+type MirrorStatus struct {
+	// Prefix is the prefix of the mirrored mapping.
+	Prefix string `json:"prefix"`
+
+	// Syncing is true while synchronization is in progress.
+	Syncing bool `json:"syncing"`
+
+	// LastStarted is the time when the last synchronization started.
+	LastStarted time.Time `json:"last_started"`
+
+	// LastFinished is the time when the last synchronization finished.
+	LastFinished time.Time `json:"last_finished"`
+
+	// Files is the number of files to be mirrored.
+	Files int `json:"files"`
+
+	// Bytes is the total size of files to be mirrored.
+	Bytes uint64 `json:"bytes"`
+
+	// Missing is the number of files that could not be downloaded.
+	Missing int `json:"missing"`
+
+	// Error is the error of the last synchronization, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// mirror keeps the state of a mirrored mapping.
+type mirror struct {
+	prefix  string
+	config  *MirrorConfig
+	trigger chan struct{}
+
+	mu     sync.Mutex
+	files  map[string]*FileInfo // pinned files in items storage
+	status MirrorStatus
+}
+
+func newMirror(prefix string, config *MirrorConfig) (*mirror, error) {
+	if len(config.Suites) == 0 {
+		return nil, errors.New("no suites")
+	}
+	if len(config.Components) == 0 {
+		return nil, errors.New("no components")
+	}
+	if len(config.Architectures) == 0 && !config.Sources {
+		return nil, errors.New("no architectures nor sources")
+	}
+
+	return &mirror{
+		prefix:  prefix,
+		config:  config,
+		trigger: make(chan struct{}, 1),
+		files:   make(map[string]*FileInfo),
+		status:  MirrorStatus{Prefix: prefix},
+	}, nil
+}
+
+// notify requests synchronization of the mirror.
+func (m *mirror) notify() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func contains(l []string, s string) bool {
+	for _, t := range l {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// selectIndex returns true if an index file p listed in Release
+// under dir should be mirrored.
+func (m *mirror) selectIndex(dir, p string) bool {
+	if !IsSupported(p) {
+		return false
+	}
+
+	t := strings.SplitN(strings.TrimPrefix(p, dir+"/"), "/", 3)
+	if len(t) < 2 || !contains(m.config.Components, t[0]) {
+		return false
+	}
+
+	switch {
+	case t[1] == "binary-all":
+		return len(m.config.Architectures) > 0
+	case strings.HasPrefix(t[1], "binary-"):
+		return contains(m.config.Architectures, t[1][len("binary-"):])
+	case t[1] == "source":
+		return m.config.Sources
+	}
+	return true
+}
+
+// fetch makes sure that an item for p is cached.
+//
+// Filters are not applied to p.
+func (c *Cacher) fetch(p string) error {
+	r, err := c.get(c.ctx, p)
+	if err != nil {
+		return err
+	}
+	if r.Status != http.StatusOK {
+		return errors.Errorf("%s: status %d", p, r.Status)
+	}
+	r.Item.Close()
+	return nil
+}
+
+// releaseIndices returns the list of files in InRelease or Release
+// in dir cached in meta storage.
+func (c *Cacher) releaseIndices(dir string) ([]*FileInfo, error) {
+	for _, name := range []string{"InRelease", "Release"} {
+		p := path.Join(dir, name)
+
+		fi, ok := c.lookupInfo(p)
+		if !ok {
+			continue
+		}
+
+		f, err := c.meta.LookupItem(fi)
+		if err != nil {
+			continue
+		}
+		fil, err := ExtractFileInfo(p, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return fil, nil
+	}
+	return nil, errors.New("no Release file for " + dir)
+}
+
+// mirrorFiles returns non-meta data files to be mirrored.
+//
+// If download is true, indices are downloaded from upstream.
+// Otherwise, only indices cached in meta storage are examined.
+//
+// If some indices could not be examined, the returned map is
+// incomplete and complete is false.
+func (c *Cacher) mirrorFiles(m *mirror, download bool) (files map[string]*FileInfo, complete bool, err error) {
+	files = make(map[string]*FileInfo)
+	complete = true
+
+	for _, suite := range m.config.Suites {
+		dir := path.Join(m.prefix, "dists", suite)
+		if download {
+			for _, name := range []string{"InRelease", "Release", "Release.gpg"} {
+				// some of them may not exist.
+				c.fetch(path.Join(dir, name))
+			}
+		}
+
+		fil, err := c.releaseIndices(dir)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// Packages or Sources in the same directory list the same files
+		// regardless of compression, hence parse only one of them.
+		parsed := make(map[string]bool)
+		wanted := make(map[string]bool)
+		for _, fi := range fil {
+			if !m.selectIndex(dir, fi.path) {
+				continue
+			}
+			if !IsMeta(fi.path) {
+				files[fi.path] = fi
+				continue
+			}
+
+			base := indexBase(fi.path)
+			key := path.Join(path.Dir(fi.path), base)
+			if base == "Packages" || base == "Sources" {
+				wanted[key] = true
+			}
+			if download {
+				if err := c.fetch(fi.path); err != nil {
+					// Release may list files that do not exist.
+					if c.logger.Enabled(log.LvDebug) {
+						c.logger.Debug("mirror: index not available", map[string]interface{}{
+							"_path": fi.path,
+							"_err":  err.Error(),
+						})
+					}
+					continue
+				}
+			}
+			if !wanted[key] || parsed[key] {
+				continue
+			}
+
+			f, err := c.meta.LookupItem(fi)
+			if err != nil {
+				continue
+			}
+			fil2, err := ExtractFileInfo(fi.path, f)
+			f.Close()
+			if err != nil {
+				c.logger.Warn("mirror: invalid index", map[string]interface{}{
+					"_path": fi.path,
+					"_err":  err.Error(),
+				})
+				continue
+			}
+			for _, fi2 := range fil2 {
+				files[fi2.path] = fi2
+			}
+			parsed[key] = true
+		}
+
+		for key := range wanted {
+			if !parsed[key] {
+				complete = false
+			}
+		}
+	}
+
+	return files, complete, nil
+}
+
+// pinMirrorFiles pins files to be mirrored in items storage.
+//
+// If complete is true, files no longer listed in indices are
+// unpinned and removed.  Otherwise, they are kept pinned.
+func (c *Cacher) pinMirrorFiles(m *mirror, files map[string]*FileInfo, complete bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for p := range files {
+		if _, ok := m.files[p]; !ok {
+			c.items.Pin(p)
+		}
+	}
+
+	for p, fi := range m.files {
+		if _, ok := files[p]; ok {
+			continue
+		}
+		if !complete {
+			files[p] = fi
+			continue
+		}
+		c.items.Unpin(p)
+
+		// the file may be still pinned by snapshots or pin rules.
+		if err := c.items.Delete(p); err != nil && err != ErrPinned {
+			c.logger.Error("mirror: failed to remove a superseded file", map[string]interface{}{
+				"_path": p,
+				"_err":  err.Error(),
+			})
+		}
+	}
+
+	m.files = files
+}
+
+// downloadMirrorFiles downloads files not in items storage, and
+// returns the number of files that could not be downloaded.
+func (c *Cacher) downloadMirrorFiles(files map[string]*FileInfo) int {
+	ch := make(chan *FileInfo)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	missing := 0
+
+	for i := 0; i < mirrorWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fi := range ch {
+				if c.mirrored(fi) {
+					continue
+				}
+				dl := c.Download(fi.path, fi)
+				if dl != nil {
+					<-dl
+				}
+				if !c.mirrored(fi) {
+					mu.Lock()
+					missing++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+L:
+	for _, fi := range files {
+		select {
+		case <-c.ctx.Done():
+			break L
+		case ch <- fi:
+		}
+	}
+	close(ch)
+	wg.Wait()
+	return missing
+}
+
+// mirrored returns true if fi is cached in items storage.
+//
+// As files in pool are never changed once published, they are
+// checked only for existence to avoid calculating checksums.
+func (c *Cacher) mirrored(fi *FileInfo) bool {
+	if strings.Contains(fi.path, "/pool/") {
+		return c.items.Contains(fi.path)
+	}
+	f, err := c.items.LookupItem(fi)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// syncMirror synchronizes a mirror with the upstream.
+func (c *Cacher) syncMirror(m *mirror) {
+	m.mu.Lock()
+	m.status.Syncing = true
+	m.status.LastStarted = c.now()
+	m.mu.Unlock()
+
+	c.logger.Info("mirror: sync started", map[string]interface{}{
+		"_prefix": m.prefix,
+	})
+
+	var bytes uint64
+	missing := 0
+	files, complete, err := c.mirrorFiles(m, true)
+	if err == nil {
+		c.pinMirrorFiles(m, files, complete)
+		missing = c.downloadMirrorFiles(files)
+		for _, fi := range files {
+			bytes += fi.size
+		}
+		if !complete {
+			err = errors.New("some indices are not available")
+		}
+	}
+
+	m.mu.Lock()
+	m.status.Syncing = false
+	m.status.LastFinished = c.now()
+	m.status.Files = len(files)
+	m.status.Bytes = bytes
+	m.status.Missing = missing
+	m.status.Error = ""
+	if err != nil {
+		m.status.Error = err.Error()
+	}
+	m.mu.Unlock()
+
+	fields := map[string]interface{}{
+		"_prefix":  m.prefix,
+		"_files":   len(files),
+		"_missing": missing,
+	}
+	if err != nil {
+		fields["_err"] = err.Error()
+		c.logger.Warn("mirror: sync finished with errors", fields)
+		return
+	}
+	c.logger.Info("mirror: sync finished", fields)
+}
+
+// runMirror is a goroutine to keep a mirror up to date.
+//
+// Synchronization is triggered by updates of Release files.
+func (c *Cacher) runMirror(m *mirror) {
+	c.syncMirror(m)
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-m.trigger:
+		}
+		c.syncMirror(m)
+	}
+}
+
+// MirrorStatus returns the synchronization status of mirrors.
+func (c *Cacher) MirrorStatus() []MirrorStatus {
+	prefixes := make([]string, 0, len(c.mirrors))
+	for prefix := range c.mirrors {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	l := make([]MirrorStatus, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		m := c.mirrors[prefix]
+		m.mu.Lock()
+		l = append(l, m.status)
+		m.mu.Unlock()
+	}
+	return l
+}
@@ -0,0 +1,44 @@
+package aptcacher
+
+import "testing"
+
+func TestMirrorSelectIndex(t *testing.T) {
+	t.Parallel()
+
+	m, err := newMirror("ubuntu", &MirrorConfig{
+		Suites:        []string{"jammy"},
+		Components:    []string{"main"},
+		Architectures: []string{"amd64"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := "ubuntu/dists/jammy"
+	cases := []struct {
+		p        string
+		selected bool
+	}{
+		{dir + "/main/binary-amd64/Packages.gz", true},
+		{dir + "/main/binary-amd64/Packages.xz", false},
+		{dir + "/main/binary-all/Packages.gz", true},
+		{dir + "/main/binary-i386/Packages.gz", false},
+		{dir + "/main/source/Sources.gz", false},
+		{dir + "/main/i18n/Translation-en.bz2", true},
+		{dir + "/universe/binary-amd64/Packages.gz", false},
+		{dir + "/Contents-amd64.gz", false},
+	}
+	for _, c := range cases {
+		if m.selectIndex(dir, c.p) != c.selected {
+			t.Errorf("selectIndex(%q) != %v", c.p, c.selected)
+		}
+	}
+
+	_, err = newMirror("ubuntu", &MirrorConfig{
+		Suites:     []string{"jammy"},
+		Components: []string{"main"},
+	})
+	if err == nil {
+		t.Error(`mirror without architectures nor sources must be an error`)
+	}
+}
@@ -0,0 +1,76 @@
+package aptcacher
+
+// This file defines events of Cacher and Observer to receive them.
+
+import (
+	"time"
+)
+
+// Event types.
+const (
+	EventHit              = "hit"
+	EventMiss             = "miss"
+	EventDownloadStarted  = "download_started"
+	EventDownloadFinished = "download_finished"
+	EventReleaseChanged   = "release_changed"
+	EventIndexUpdated     = "index_updated"
+	EventDownloaded       = "downloaded"
+	EventValidationFailed = "validation_failed"
+	EventEvicted          = "evicted"
+	EventUpstreamError    = "upstream_error"
+)
+
+// Event represents an event in go-apt-cacher.
+type Event struct {
+	// Type is one of Event* constants.
+	Type string `json:"type"`
+
+	// Time is the time when the event occurred.
+	Time time.Time `json:"time"`
+
+	// Path is the path of the item.
+	Path string `json:"path"`
+
+	// Size is the size of the item, if known.
+	//
+	// For EventDownloadFinished, this is the number of bytes received.
+	Size uint64 `json:"size,omitempty"`
+
+	// Status is the HTTP status code from the upstream, if any.
+	Status int `json:"status,omitempty"`
+
+	// Duration is the time taken for EventDownloadFinished.
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Error describes the error, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Observer receives events of Cacher.
+//
+// Observe is called synchronously from goroutines of Cacher, sometimes
+// with internal locks held.  Implementations must be safe for
+// concurrent use, must not block, and must not call methods of Cacher.
+// The event must not be modified.
+type Observer interface {
+	Observe(e *Event)
+}
+
+// ObserverFunc is an adapter to use a function as Observer.
+type ObserverFunc func(e *Event)
+
+// Observe implements Observer.
+func (f ObserverFunc) Observe(e *Event) {
+	f(e)
+}
+
+// emit notifies observers of an event.
+func (c *Cacher) emit(e *Event) {
+	if len(c.observers) == 0 {
+		return
+	}
+	e.Time = c.now().UTC()
+	for _, o := range c.observers {
+		o.Observe(e)
+	}
+}
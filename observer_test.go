@@ -0,0 +1,34 @@
+package aptcacher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEmit(t *testing.T) {
+	t.Parallel()
+
+	var events []*Event
+	now := time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC)
+	c := &Cacher{
+		now: func() time.Time { return now },
+		observers: []Observer{
+			ObserverFunc(func(e *Event) {
+				events = append(events, e)
+			}),
+		},
+	}
+
+	c.emit(&Event{Type: EventMiss, Path: "ubuntu/pool/a.deb"})
+	c.emit(&Event{Type: EventHit, Path: "ubuntu/pool/a.deb", Size: 10})
+
+	if len(events) != 2 {
+		t.Fatal(`len(events) != 2`)
+	}
+	if events[0].Type != EventMiss || events[1].Type != EventHit {
+		t.Error(`wrong event types`)
+	}
+	if !events[0].Time.Equal(now) {
+		t.Error(`!events[0].Time.Equal(now)`)
+	}
+}
@@ -0,0 +1,68 @@
+package aptcacher
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// Option is an option for NewCacher.
+type Option func(c *Cacher)
+
+// WithHTTPClient specifies the client to download items from upstream.
+//
+// Default is a client with no timeouts; each download is limited to
+// 30 minutes by its context.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Cacher) {
+		c.client = client
+	}
+}
+
+// WithFetcher specifies the fetcher for upstream URLs of the scheme.
+//
+// By default, HTTPFetcher is used for "http" and "https", and
+// FileFetcher for "file".  Mappings to URLs of other schemes can be
+// used if fetchers for them are specified.
+func WithFetcher(scheme string, f Fetcher) Option {
+	return func(c *Cacher) {
+		c.fetchers[scheme] = f
+	}
+}
+
+// WithLogger specifies the logger for Cacher and its handler.
+// Storages created from CacherConfig also use the logger.
+//
+// Default is log.DefaultLogger().
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Cacher) {
+		c.logger = logger
+	}
+}
+
+// WithClock specifies the function to get the current time.
+//
+// It is used to timestamp events, feed entries, snapshots, and
+// Release files of generated suites, and to measure durations of
+// downloads and requests.
+// Default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(c *Cacher) {
+		c.now = now
+	}
+}
+
+// WithStorage specifies storages for meta data and other items.
+//
+// Any Store implementations such as Storage or MemoryStore can be
+// used.  The storages must not have been loaded; NewCacher loads them.
+// If specified, meta_dir, cache_dir, cache_capacity, cache_size,
+// free_space_low, and free_space_high in CacherConfig are ignored.
+// The logger of Storage can be specified by Storage.SetLogger.
+func WithStorage(meta, items Store) Option {
+	return func(c *Cacher) {
+		c.meta = meta
+		c.items = items
+	}
+}
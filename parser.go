@@ -24,6 +24,15 @@ import (
 // Folded fields are treated just the same as multiline fields.
 type Paragraph map[string][]string
 
+// get returns the first value of a field, or an empty string.
+func (d Paragraph) get(field string) string {
+	v := d[field]
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
 // Parser reads debian control file and return Paragraph one by one.
 //
 // PGP preambles and signatures are ignored if any.
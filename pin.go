@@ -0,0 +1,268 @@
+package aptcacher
+
+// This file implements pin rules to exclude cached files from eviction.
+//
+// Rules for paths and mappings are given to Storage as patterns.
+// Rules for packages are resolved to files through Packages indices
+// cached in meta storage, and the files are pinned one by one.
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of pin rules.
+const (
+	PinPath    = "path"
+	PinMapping = "mapping"
+	PinPackage = "package"
+)
+
+// PinStatus represents pin rules and files pinned by them.
+type PinStatus struct {
+	Paths    []string `json:"paths"`
+	Mappings []string `json:"mappings"`
+	Packages []string `json:"packages"`
+
+	// PackageFiles is the number of files pinned by package rules.
+	PackageFiles int `json:"package_files"`
+
+	// Usage is the usage of items storage.  Pinned files are
+	// accounted in Usage.Pinned.
+	Usage Usage `json:"usage"`
+}
+
+// pinner keeps pin rules.
+type pinner struct {
+	trigger chan struct{}
+
+	mu       sync.Mutex
+	paths    []string
+	mappings []string
+	packages []string
+	files    map[string]bool // files pinned by package rules
+}
+
+func newPinner() *pinner {
+	return &pinner{
+		trigger: make(chan struct{}, 1),
+		files:   make(map[string]bool),
+	}
+}
+
+// notify requests to resolve package rules again.
+func (p *pinner) notify() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// rules returns a pointer to the list of rules of kind.
+// p.mu lock must be acquired beforehand.
+func (p *pinner) rules(kind string) (*[]string, error) {
+	switch kind {
+	case PinPath:
+		return &p.paths, nil
+	case PinMapping:
+		return &p.mappings, nil
+	case PinPackage:
+		return &p.packages, nil
+	}
+	return nil, errors.New("unknown kind of pin rule: " + kind)
+}
+
+// validatePinRule checks a rule.
+func (c *Cacher) validatePinRule(kind, rule string) error {
+	if kind == PinPath || kind == PinMapping {
+		if _, ok := c.items.(*Storage); !ok {
+			return errors.New("pin rules of paths need Storage")
+		}
+	}
+	switch kind {
+	case PinPath, PinPackage:
+		if rule == "" || !validPattern(rule) {
+			return errors.New("invalid pattern: " + rule)
+		}
+	case PinMapping:
+		if _, ok := c.um[rule]; !ok {
+			return errors.New("unknown prefix: " + rule)
+		}
+	}
+	return nil
+}
+
+// AddPinRule adds a pin rule.
+//
+// kind is one of PinPath, PinMapping, or PinPackage.
+// For PinPath and PinPackage, rule is a pattern for path.Match.
+// Path patterns match the paths of files and their parent directories.
+// For PinMapping, rule is a prefix of a mapping.
+//
+// Rules added by AddPinRule are not saved, and are lost when the
+// program restarts.
+func (c *Cacher) AddPinRule(kind, rule string) error {
+	if err := c.validatePinRule(kind, rule); err != nil {
+		return err
+	}
+
+	c.pins.mu.Lock()
+	defer c.pins.mu.Unlock()
+
+	l, err := c.pins.rules(kind)
+	if err != nil {
+		return err
+	}
+	if contains(*l, rule) {
+		return nil
+	}
+	*l = append(*l, rule)
+	return c.applyPinRules(kind)
+}
+
+// RemovePinRule removes a pin rule added by AddPinRule or configured.
+//
+// If no such rule exists, ErrNotFound is returned.
+// Like AddPinRule, removals are not saved.
+func (c *Cacher) RemovePinRule(kind, rule string) error {
+	c.pins.mu.Lock()
+	defer c.pins.mu.Unlock()
+
+	l, err := c.pins.rules(kind)
+	if err != nil {
+		return err
+	}
+	var rules []string
+	for _, r := range *l {
+		if r != rule {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == len(*l) {
+		return ErrNotFound
+	}
+	*l = rules
+	return c.applyPinRules(kind)
+}
+
+// applyPinRules applies rules of kind.
+//
+// c.pins.mu lock must be acquired beforehand so that concurrent
+// changes are applied in the same order as they are made.
+func (c *Cacher) applyPinRules(kind string) error {
+	if kind == PinPackage {
+		c.pins.notify()
+		return nil
+	}
+
+	s, ok := c.items.(*Storage)
+	if !ok {
+		return nil
+	}
+	patterns := append(append([]string(nil), c.pins.paths...), c.pins.mappings...)
+	return s.SetPinPatterns(patterns)
+}
+
+// packageFiles returns files of binary packages in Packages indices
+// cached in meta storage whose names match patterns.
+func (c *Cacher) packageFiles(patterns []string) map[string]bool {
+	files := make(map[string]bool)
+	if len(patterns) == 0 {
+		return files
+	}
+
+	for _, fi := range c.searchIndices(&SearchQuery{}) {
+		if indexBase(fi.path) != "Packages" {
+			continue
+		}
+		f, err := c.meta.LookupItem(fi)
+		if err != nil {
+			continue
+		}
+		l, err := readParagraphs(fi.path, f)
+		f.Close()
+		if err != nil {
+			c.logger.Warn("pin: invalid index", map[string]interface{}{
+				"_path": fi.path,
+				"_err":  err.Error(),
+			})
+			continue
+		}
+
+		prefix := strings.SplitN(fi.path, "/", 2)[0]
+		for _, d := range l {
+			name := d.get("Package")
+			matched := false
+			for _, pattern := range patterns {
+				if ok, _ := path.Match(pattern, name); ok {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+			pfi, err := packageFileInfo(prefix, d)
+			if err != nil {
+				continue
+			}
+			files[pfi.path] = true
+		}
+	}
+	return files
+}
+
+// resolvePinnedPackages pins files of packages matching package rules,
+// and unpins files no longer matching.
+func (c *Cacher) resolvePinnedPackages() {
+	c.pins.mu.Lock()
+	patterns := append([]string(nil), c.pins.packages...)
+	c.pins.mu.Unlock()
+
+	files := c.packageFiles(patterns)
+
+	c.pins.mu.Lock()
+	defer c.pins.mu.Unlock()
+
+	for p := range files {
+		if !c.pins.files[p] {
+			c.items.Pin(p)
+		}
+	}
+	for p := range c.pins.files {
+		if !files[p] {
+			c.items.Unpin(p)
+		}
+	}
+	c.pins.files = files
+}
+
+// runPins resolves package rules when notified.
+func (c *Cacher) runPins() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.pins.trigger:
+		}
+		c.resolvePinnedPackages()
+	}
+}
+
+// PinStatus returns the current pin rules.
+func (c *Cacher) PinStatus() *PinStatus {
+	c.pins.mu.Lock()
+	st := &PinStatus{
+		Paths:        append([]string{}, c.pins.paths...),
+		Mappings:     append([]string{}, c.pins.mappings...),
+		Packages:     append([]string{}, c.pins.packages...),
+		PackageFiles: len(c.pins.files),
+	}
+	c.pins.mu.Unlock()
+
+	st.Usage = c.items.Usage()
+	return st
+}
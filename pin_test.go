@@ -0,0 +1,143 @@
+package aptcacher
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/cybozu-go/log"
+)
+
+const testPinPackages = `Package: linux-image-5.15.0-91-generic
+Version: 5.15.0-91.101
+Architecture: amd64
+Filename: pool/main/l/linux-signed/linux-image-5.15.0-91-generic_5.15.0-91.101_amd64.deb
+Size: 100
+
+Package: linux-headers-5.15.0-91
+Version: 5.15.0-91.101
+Architecture: all
+Filename: pool/main/l/linux/linux-headers-5.15.0-91_5.15.0-91.101_all.deb
+Size: 200
+
+Package: vim
+Version: 2:8.2.3995-1ubuntu2
+Architecture: amd64
+Filename: pool/main/v/vim/vim_8.2.3995-1ubuntu2_amd64.deb
+Size: 300
+`
+
+func TestPinRules(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meta := NewMemoryStore()
+	data := []byte(testPinPackages)
+	err = meta.InsertItem(bytes.NewReader(data),
+		MakeFileInfo("ubuntu/dists/jammy/main/binary-amd64/Packages", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Cacher{
+		um:     URLMap{"ubuntu": nil, "security": nil},
+		meta:   meta,
+		items:  NewStorage(dir, 0),
+		logger: log.DefaultLogger(),
+		pins:   newPinner(),
+	}
+
+	if err := c.AddPinRule(PinPackage, "linux-*"); err != nil {
+		t.Fatal(err)
+	}
+	c.resolvePinnedPackages()
+	st := c.PinStatus()
+	if st.PackageFiles != 2 {
+		t.Error(`st.PackageFiles != 2`, st.PackageFiles)
+	}
+	if !c.pins.files["ubuntu/pool/main/l/linux/linux-headers-5.15.0-91_5.15.0-91.101_all.deb"] {
+		t.Error(`linux-headers is not pinned`)
+	}
+
+	if err := c.RemovePinRule(PinPackage, "linux-*"); err != nil {
+		t.Fatal(err)
+	}
+	c.resolvePinnedPackages()
+	if len(c.pins.files) != 0 {
+		t.Error(`len(c.pins.files) != 0`)
+	}
+	if err := c.RemovePinRule(PinPackage, "linux-*"); err != ErrNotFound {
+		t.Error(`err != ErrNotFound`)
+	}
+
+	if err := c.AddPinRule(PinMapping, "security"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddPinRule(PinPath, "ubuntu/pool/main/l/linux-*"); err != nil {
+		t.Fatal(err)
+	}
+	st = c.PinStatus()
+	if len(st.Mappings) != 1 || len(st.Paths) != 1 {
+		t.Error(`rules are not added`, st)
+	}
+
+	if c.AddPinRule(PinMapping, "debian") == nil {
+		t.Error(`unknown prefix must be an error`)
+	}
+	if c.AddPinRule(PinPackage, "[a-") == nil {
+		t.Error(`invalid pattern must be an error`)
+	}
+	if c.AddPinRule("file", "a") == nil {
+		t.Error(`unknown kind must be an error`)
+	}
+
+	c.items = NewMemoryStore()
+	if c.AddPinRule(PinPath, "ubuntu") == nil {
+		t.Error(`path rules for MemoryStore must be an error`)
+	}
+}
+
+func TestPinRulesConcurrent(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewStorage(dir, 0)
+	c := &Cacher{
+		meta:   NewMemoryStore(),
+		items:  s,
+		logger: log.DefaultLogger(),
+		pins:   newPinner(),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := c.AddPinRule(PinPath, fmt.Sprintf("ubuntu/pool/%d/*", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	n := len(s.patterns)
+	s.mu.Unlock()
+	if n != 20 {
+		t.Error(`patterns of storage must have all rules`, n)
+	}
+}
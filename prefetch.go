@@ -0,0 +1,97 @@
+package aptcacher
+
+// This file implements prefetching of upgraded packages.
+//
+// When a Packages index is updated, new versions of packages whose
+// older versions have been cached are downloaded in background so
+// that clients running "apt-get upgrade" hit the cache.
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	prefetchQueueSize = 10000
+	prefetchInterval  = 100 * time.Millisecond
+)
+
+// findUpgrades returns packages in newer that upgrade packages in older.
+//
+// The returned map is keyed by packages in newer, and values are
+// the corresponding packages in older.
+func findUpgrades(older, newer map[string]*binaryPackage) map[*binaryPackage]*binaryPackage {
+	m := make(map[*binaryPackage]*binaryPackage)
+	for k, bp := range newer {
+		obp, ok := older[k]
+		if !ok {
+			continue
+		}
+		if CompareVersion(bp.version, obp.version) <= 0 {
+			continue
+		}
+		m[bp] = obp
+	}
+	return m
+}
+
+// prefetchUpgrades queues new versions of packages in an updated
+// Packages index p whose older versions are cached in items storage.
+func (c *Cacher) prefetchUpgrades(p string, older, newer map[string]*binaryPackage) {
+	queued := 0
+	for bp, obp := range findUpgrades(older, newer) {
+		if !c.items.Contains(obp.fi.path) {
+			continue
+		}
+		select {
+		case c.prefetchQueue <- bp.fi:
+			queued++
+		default:
+			c.logger.Warn("prefetch: queue is full", map[string]interface{}{
+				"_path": bp.fi.path,
+			})
+		}
+	}
+
+	c.logger.Info("prefetch: upgrades queued", map[string]interface{}{
+		"_path":  p,
+		"_count": queued,
+	})
+}
+
+// prefetchWorker is a goroutine to download queued items one by one.
+//
+// As this downloads only one item at a time with intervals,
+// prefetching consumes at most one of the connections to an
+// upstream server, leaving others for clients.
+func (c *Cacher) prefetchWorker(ctx context.Context) {
+	for {
+		var fi *FileInfo
+		select {
+		case <-ctx.Done():
+			return
+		case fi = <-c.prefetchQueue:
+		}
+
+		if c.items.Contains(fi.path) {
+			continue
+		}
+
+		ch := c.Download(fi.path, fi)
+		if ch == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(prefetchInterval):
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package aptcacher
+
+import "testing"
+
+func TestFindUpgrades(t *testing.T) {
+	t.Parallel()
+
+	pkg := func(name, version string) *binaryPackage {
+		return &binaryPackage{
+			name:    name,
+			version: version,
+			arch:    "amd64",
+			fi: &FileInfo{
+				path: "ubuntu/pool/" + name + "_" + version + "_amd64.deb",
+			},
+		}
+	}
+	index := func(l ...*binaryPackage) map[string]*binaryPackage {
+		m := make(map[string]*binaryPackage)
+		for _, bp := range l {
+			m[bp.key()] = bp
+		}
+		return m
+	}
+
+	oldssl := pkg("openssl", "3.0.2-0ubuntu1.9")
+	newssl := pkg("openssl", "3.0.2-0ubuntu1.10")
+	older := index(oldssl, pkg("bash", "5.1-6ubuntu1"), pkg("zsh", "5.8.1-1"))
+	newer := index(newssl, pkg("bash", "5.1-6ubuntu1"), pkg("vim", "2:8.2.3995-1ubuntu2"))
+
+	m := findUpgrades(older, newer)
+	if len(m) != 1 {
+		t.Fatal(`len(m) != 1`)
+	}
+	if m[newssl] != oldssl {
+		t.Error(`m[newssl] != oldssl`)
+	}
+
+	// downgrades are not upgrades.
+	m = findUpgrades(newer, older)
+	if len(m) != 0 {
+		t.Error(`len(m) != 0`)
+	}
+}
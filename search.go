@@ -0,0 +1,267 @@
+package aptcacher
+
+// This file implements search of packages in indices cached in
+// meta storage.
+
+import (
+	"encoding/hex"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSearchLimit = 1000
+)
+
+// SearchQuery is a query to search packages.
+//
+// Package, Source and Architecture are shell patterns as described
+// in path.Match.  Version is a pattern or a relation such as "<< 1.0".
+// Empty conditions match any packages.
+//
+// Source packages in Sources indices have "source" as their
+// architecture.
+type SearchQuery struct {
+	Package      string
+	Source       string
+	Version      string
+	Architecture string
+
+	// Prefix restricts search to indices of the prefix.
+	Prefix string
+
+	// Suite restricts search to indices of the suite.
+	Suite string
+
+	// Limit is the maximum number of results.
+	//
+	// Default is 1000.
+	Limit int
+}
+
+// SearchFile represents a file of a package.
+type SearchFile struct {
+	// Path is the path of the file such as "ubuntu/pool/main/...".
+	Path string `json:"path"`
+
+	Size   uint64 `json:"size"`
+	MD5Sum string `json:"md5sum,omitempty"`
+	SHA1   string `json:"sha1,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Cached is true if the file is in items storage.
+	Cached bool `json:"cached"`
+}
+
+// SearchResult represents a package found by Search.
+type SearchResult struct {
+	// Index is the path of the index that lists the package.
+	Index string `json:"index"`
+
+	Package      string        `json:"package"`
+	Version      string        `json:"version"`
+	Architecture string        `json:"architecture"`
+	Source       string        `json:"source"`
+	Files        []*SearchFile `json:"files"`
+}
+
+func (q *SearchQuery) validate() error {
+	for _, pattern := range []string{q.Package, q.Source, q.Architecture} {
+		if !validPattern(pattern) {
+			return errors.New("invalid pattern: " + pattern)
+		}
+	}
+	if !validConstraint(q.Version) {
+		return errors.New("invalid version: " + q.Version)
+	}
+	return nil
+}
+
+// match returns true if a paragraph in Packages or Sources matches q.
+func (q *SearchQuery) match(d Paragraph, sources bool) bool {
+	name := d.get("Package")
+	source, arch := sourcePackage(d), d.get("Architecture")
+	if sources {
+		source, arch = name, "source"
+	}
+	return matchPattern(q.Package, name) &&
+		matchPattern(q.Source, source) &&
+		(q.Version == "" || matchVersion(q.Version, d.get("Version"))) &&
+		matchPattern(q.Architecture, arch)
+}
+
+// searchIndices returns indices in meta storage to be searched.
+//
+// Only one index is returned for each directory even if the index
+// is cached in multiple compression formats.
+func (c *Cacher) searchIndices(q *SearchQuery) []*FileInfo {
+	groups := make(map[string]*FileInfo)
+	for _, fi := range c.meta.ListAll() {
+		base := indexBase(fi.path)
+		if (base != "Packages" && base != "Sources") || !IsSupported(fi.path) {
+			continue
+		}
+		if isFilteredPath(fi.path) {
+			continue
+		}
+		t := strings.SplitN(fi.path, "/", 4)
+		if len(t) != 4 || t[1] != "dists" {
+			continue
+		}
+		if q.Prefix != "" && t[0] != q.Prefix {
+			continue
+		}
+		if q.Suite != "" && t[2] != q.Suite {
+			continue
+		}
+
+		// prefer uncompressed indices as they are cheap to read.
+		key := path.Join(path.Dir(fi.path), base)
+		if old, ok := groups[key]; ok && len(old.path) < len(fi.path) {
+			continue
+		}
+		groups[key] = fi
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	l := make([]*FileInfo, len(keys))
+	for i, key := range keys {
+		l[i] = groups[key]
+	}
+	return l
+}
+
+// itemPath returns the path of an item in items storage for p.
+func (c *Cacher) itemPath(p string) string {
+	if _, ok := snapshotName(p); ok {
+		return upstreamPath(p)
+	}
+	t := strings.SplitN(p, "/", 2)
+	if _, ok := c.unions[t[0]]; ok && len(t) == 2 {
+		return t[1]
+	}
+	return p
+}
+
+func (c *Cacher) makeSearchFile(fi *FileInfo) *SearchFile {
+	return &SearchFile{
+		Path:   fi.path,
+		Size:   fi.size,
+		MD5Sum: hex.EncodeToString(fi.md5sum),
+		SHA1:   hex.EncodeToString(fi.sha1sum),
+		SHA256: hex.EncodeToString(fi.sha256sum),
+		Cached: c.items.Contains(c.itemPath(fi.path)),
+	}
+}
+
+// searchBlocked returns true if any of fil is blocked by filter rules.
+func (c *Cacher) searchBlocked(fil []*FileInfo) bool {
+	for _, fi := range fil {
+		f, ok := c.filterFor(fi.path)
+		if !ok {
+			continue
+		}
+		if _, ok := f.blockedBy(upstreamPath(fi.path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// searchIndex appends packages in an index matching q to results.
+//
+// Packages blocked by filter rules are omitted.
+func (c *Cacher) searchIndex(q *SearchQuery, fi *FileInfo, results []*SearchResult) ([]*SearchResult, error) {
+	f, err := c.meta.LookupItem(fi)
+	if err != nil {
+		// the index may be updated in the meantime.
+		return results, nil
+	}
+	defer f.Close()
+
+	base, r, err := decompress(fi.path, f)
+	if err != nil {
+		return nil, errors.Wrap(err, fi.path)
+	}
+	sources := base == "Sources"
+	prefix := strings.SplitN(fi.path, "/", 2)[0]
+
+	parser := NewParser(r)
+	for len(results) < q.Limit {
+		d, err := parser.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, fi.path)
+		}
+		if !q.match(d, sources) {
+			continue
+		}
+
+		res := &SearchResult{
+			Index:        fi.path,
+			Package:      d.get("Package"),
+			Version:      d.get("Version"),
+			Architecture: d.get("Architecture"),
+			Source:       sourcePackage(d),
+		}
+		var fil []*FileInfo
+		if sources {
+			res.Architecture = "source"
+			res.Source = res.Package
+			fil, err = sourceFileInfo(prefix, d)
+		} else {
+			var pfi *FileInfo
+			pfi, err = packageFileInfo(prefix, d)
+			fil = []*FileInfo{pfi}
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, fi.path)
+		}
+		if c.searchBlocked(fil) {
+			continue
+		}
+		for _, fi2 := range fil {
+			res.Files = append(res.Files, c.makeSearchFile(fi2))
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// Search searches packages in Packages and Sources indices cached
+// in meta storage.
+//
+// Results are sorted by the index paths, and then ordered as in
+// the indices.  Packages blocked by filter rules are not returned.
+func (c *Cacher) Search(q *SearchQuery) ([]*SearchResult, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultSearchLimit
+	}
+
+	results := []*SearchResult{}
+	for _, fi := range c.searchIndices(q) {
+		var err error
+		results, err = c.searchIndex(q, fi, results)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) >= q.Limit {
+			break
+		}
+	}
+	return results, nil
+}
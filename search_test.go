@@ -0,0 +1,91 @@
+package aptcacher
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchQuery(t *testing.T) {
+	t.Parallel()
+
+	libssl := Paragraph{
+		"Package":      {"libssl3"},
+		"Source":       {"openssl"},
+		"Version":      {"3.0.2-0ubuntu1.10"},
+		"Architecture": {"amd64"},
+	}
+	src := Paragraph{
+		"Package":      {"openssl"},
+		"Version":      {"3.0.2-0ubuntu1.10"},
+		"Architecture": {"any"},
+	}
+
+	cases := []struct {
+		q       SearchQuery
+		binary  bool
+		sources bool
+	}{
+		{SearchQuery{}, true, true},
+		{SearchQuery{Package: "libssl*"}, true, false},
+		{SearchQuery{Source: "openssl"}, true, true},
+		{SearchQuery{Source: "openssl", Architecture: "source"}, false, true},
+		{SearchQuery{Architecture: "amd64"}, true, false},
+		{SearchQuery{Version: ">> 3.0.2-0ubuntu1.9"}, true, true},
+		{SearchQuery{Version: "<< 3.0.2-0ubuntu1.10"}, false, false},
+	}
+	for _, c := range cases {
+		if err := c.q.validate(); err != nil {
+			t.Fatal(err)
+		}
+		if c.q.match(libssl, false) != c.binary {
+			t.Errorf("%+v: match(libssl3) != %v", c.q, c.binary)
+		}
+		if c.q.match(src, true) != c.sources {
+			t.Errorf("%+v: match(openssl) != %v", c.q, c.sources)
+		}
+	}
+
+	q := &SearchQuery{Package: "[a-"}
+	if q.validate() == nil {
+		t.Error(`invalid pattern must be an error`)
+	}
+}
+
+func TestSearchFiltered(t *testing.T) {
+	t.Parallel()
+
+	repo := &testRepo{}
+	repo.setPackages(map[string]string{"a": "1.0", "b": "2.0"})
+	c, done := newTestCacher(t, repo, func(config *CacherConfig) {
+		config.Filter = map[string]*FilterConfig{
+			"up": {Rules: []*FilterRule{{Name: "no-b", Package: "b"}}},
+		}
+	})
+	defer done()
+
+	for _, p := range []string{"up/dists/s/Release", "up/dists/s/main/binary-amd64/Packages"} {
+		if err := c.fetch(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.CreateSnapshot("up", "s", "one"); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := c.Search(&SearchQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, res := range results {
+		names = append(names, res.Index+":"+res.Package)
+	}
+	if len(names) != 2 {
+		t.Fatal(`wrong results:`, names)
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, ":a") {
+			t.Error(`blocked package is found:`, name)
+		}
+	}
+}
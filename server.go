@@ -17,11 +17,14 @@ const (
 )
 
 // Serve runs REST API server until ctx.Done() is closed.
+//
+// This is a convenience to serve c.Handler() with fixed timeouts.
+// Use c.Handler() to customize the server.
 func Serve(ctx context.Context, l net.Listener, c *Cacher) error {
 	hd := httpdown.HTTP{}
-	logger := _log.New(log.DefaultLogger().Writer(log.LvError), "[http]", 0)
+	logger := _log.New(c.logger.Writer(log.LvError), "[http]", 0)
 	s := &http.Server{
-		Handler:      cacheHandler{c},
+		Handler:      c.Handler(),
 		ReadTimeout:  defaultReadTimeout,
 		WriteTimeout: defaultWriteTimeout,
 		ErrorLog:     logger,
@@ -0,0 +1,72 @@
+package aptcacher
+
+// This file implements OpenPGP signing of Release files.
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// signer signs Release files with an OpenPGP private key.
+type signer struct {
+	entity *openpgp.Entity
+}
+
+// newSigner reads an ASCII armored OpenPGP private key from keyFile.
+//
+// If the key is encrypted, passphrase is used to decrypt it.
+func newSigner(keyFile, passphrase string) (*signer, error) {
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	el, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, errors.Wrap(err, keyFile)
+	}
+
+	for _, e := range el {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			if err := e.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, errors.Wrap(err, keyFile)
+			}
+		}
+		return &signer{entity: e}, nil
+	}
+	return nil, errors.New("no private key in " + keyFile)
+}
+
+// clearSign returns InRelease contents for Release data.
+func (s *signer) clearSign(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, s.entity.PrivateKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// detachSign returns Release.gpg contents for Release data.
+func (s *signer) detachSign(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := openpgp.ArmoredDetachSign(&buf, s.entity, bytes.NewReader(data), nil)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
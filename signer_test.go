@@ -0,0 +1,75 @@
+package aptcacher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// writeTestKey generates an OpenPGP key and writes its armored
+// private key to a temporary file.
+func writeTestKey(t *testing.T) (string, openpgp.EntityList) {
+	e, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := armor.Encode(f, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return f.Name(), openpgp.EntityList{e}
+}
+
+func TestSigner(t *testing.T) {
+	t.Parallel()
+
+	keyFile, keyring := writeTestKey(t)
+	defer os.Remove(keyFile)
+
+	s, err := newSigner(keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("Origin: test\nSuite: stable\n")
+
+	inRelease, err := s.clearSign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := clearsign.Decode(inRelease)
+	if b == nil {
+		t.Fatal(`b == nil`)
+	}
+	if !bytes.Equal(bytes.TrimRight(b.Plaintext, "\n"), bytes.TrimRight(data, "\n")) {
+		t.Errorf("unexpected plaintext: %s", b.Plaintext)
+	}
+	_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(b.Bytes), b.ArmoredSignature.Body)
+	if err != nil {
+		t.Error(err)
+	}
+
+	sig, err := s.detachSign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig))
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,73 @@
+package aptcacher
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	unit   float64
+}{
+	// longer suffixes first.
+	{"kib", 1 << 10},
+	{"mib", 1 << 20},
+	{"gib", 1 << 30},
+	{"tib", 1 << 40},
+	{"kb", 1e3},
+	{"mb", 1e6},
+	{"gb", 1e9},
+	{"tb", 1e12},
+	{"b", 1},
+}
+
+// ParseSize parses a human-readable size such as "500MiB" or "1.5TB".
+//
+// Units are case-insensitive.  KiB, MiB, GiB, and TiB are powers
+// of 1024, and KB, MB, GB, and TB are powers of 1000.
+// A number without a unit is in bytes.
+func ParseSize(s string) (uint64, error) {
+	t := strings.ToLower(strings.TrimSpace(s))
+	unit := float64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(t, u.suffix) {
+			t = strings.TrimSpace(t[:len(t)-len(u.suffix)])
+			unit = u.unit
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(t, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size: " + s)
+	}
+	return uint64(n * unit), nil
+}
+
+// ByteSize is a size in bytes.
+//
+// In configuration files, it can be a string parsed by ParseSize,
+// or an integer in bytes.
+type ByteSize uint64
+
+// UnmarshalTOML implements toml.Unmarshaler.
+func (s *ByteSize) UnmarshalTOML(data interface{}) error {
+	switch d := data.(type) {
+	case int64:
+		if d < 0 {
+			return errors.New("negative size")
+		}
+		*s = ByteSize(d)
+	case string:
+		n, err := ParseSize(d)
+		if err != nil {
+			return err
+		}
+		*s = ByteSize(n)
+	default:
+		return errors.New("size must be a string or an integer")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package aptcacher
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestParseSize(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]uint64{
+		"0":        0,
+		"100":      100,
+		"100B":     100,
+		"1KiB":     1024,
+		"1kb":      1000,
+		"500MiB":   500 << 20,
+		"500 MB":   500 * 1000 * 1000,
+		"2GiB":     2 << 30,
+		"1.5TB":    1500 * 1000 * 1000 * 1000,
+		"0.5 TiB":  1 << 39,
+		" 10 gib ": 10 << 30,
+	}
+	for s, expected := range cases {
+		n, err := ParseSize(s)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if n != expected {
+			t.Errorf(`ParseSize(%q) = %d`, s, n)
+		}
+	}
+
+	for _, s := range []string{"", "GiB", "-1GiB", "1.5 PB", "ten"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf(`ParseSize(%q) must fail`, s)
+		}
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	t.Parallel()
+
+	var v struct {
+		Old  ByteSize `toml:"old"`
+		Bare ByteSize `toml:"bare"`
+		New  ByteSize `toml:"new"`
+	}
+	_, err := toml.Decode("old = 3\nbare = \"3\"\nnew = \"1.5GB\"\n", &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Old != 3 {
+		t.Error(`integers must be in bytes`)
+	}
+	if v.Bare != 3 {
+		t.Error(`strings without a unit must be in bytes`)
+	}
+	if v.New != 1500*1000*1000 {
+		t.Error(`v.New != 1.5GB`)
+	}
+
+	_, err = toml.Decode("old = 1.5\n", &v)
+	if err == nil {
+		t.Error(`float must be an error`)
+	}
+}
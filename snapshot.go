@@ -0,0 +1,417 @@
+package aptcacher
+
+// This file implements point-in-time snapshots of suites.
+//
+// A snapshot of a suite is a copy of its Release and indices kept in
+// meta storage under "<prefix>@<id>/dists/<suite>/".  Files listed in
+// the copied indices are resolved to the items of the original mapping
+// and pinned against eviction.
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	snapshotIDFormat = "20060102T150405Z"
+)
+
+var (
+	validSnapshotID = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+	// ErrSnapshotExists is returned by CreateSnapshot if the snapshot
+	// already exists.
+	ErrSnapshotExists = errors.New("snapshot already exists")
+)
+
+// Snapshot represents a snapshot of a suite.
+type Snapshot struct {
+	// Prefix is the prefix of the mapping.
+	Prefix string `json:"prefix"`
+
+	// ID identifies the snapshot among snapshots of the mapping.
+	ID string `json:"id"`
+
+	// Suite is the suite, i.e. directory name under dists/.
+	Suite string `json:"suite"`
+
+	// Indices is the number of Release and index files in the snapshot.
+	Indices int `json:"indices"`
+
+	// Pinned is the number of other files referenced by the snapshot.
+	Pinned int `json:"pinned"`
+
+	files []string        // paths of meta files
+	pins  map[string]bool // paths of pinned items
+}
+
+// pin pins an item referenced by the snapshot.
+func (s *Snapshot) pin(items Store, p string) {
+	if s.pins[p] {
+		return
+	}
+	items.Pin(p)
+	s.pins[p] = true
+}
+
+// Name returns "<prefix>@<id>" that is used as the path prefix
+// of the snapshot.
+func (s *Snapshot) Name() string {
+	return s.Prefix + "@" + s.ID
+}
+
+// snapshotName returns the snapshot name of p if p points
+// a file in a snapshot.
+func snapshotName(p string) (string, bool) {
+	name := strings.SplitN(p, "/", 2)[0]
+	if !strings.ContainsRune(name, '@') {
+		return "", false
+	}
+	return name, true
+}
+
+// upstreamPath returns the path of the original file for
+// a path in a snapshot.
+func upstreamPath(p string) string {
+	t := strings.SplitN(p, "/", 2)
+	prefix := strings.SplitN(t[0], "@", 2)[0]
+	if len(t) == 1 {
+		return prefix
+	}
+	return prefix + "/" + t[1]
+}
+
+// loadSnapshots reconstructs snapshots from meta files in meta storage.
+//
+// c.info must be populated beforehand.
+func (c *Cacher) loadSnapshots(metas []*FileInfo) {
+	for _, fi := range metas {
+		name, ok := snapshotName(fi.path)
+		if !ok {
+			continue
+		}
+		s, ok := c.snapshots[name]
+		if !ok {
+			t := strings.SplitN(name, "@", 2)
+			d := strings.SplitN(fi.path, "/", 4)
+			if len(d) < 4 || d[1] != "dists" {
+				continue
+			}
+			s = &Snapshot{
+				Prefix: t[0],
+				ID:     t[1],
+				Suite:  d[2],
+				pins:   make(map[string]bool),
+			}
+			c.snapshots[name] = s
+		}
+		s.files = append(s.files, fi.path)
+	}
+
+	c.fiLock.RLock()
+	for p := range c.info {
+		name, ok := snapshotName(p)
+		if !ok || IsMeta(p) {
+			continue
+		}
+		s, ok := c.snapshots[name]
+		if !ok {
+			continue
+		}
+		s.pin(c.items, upstreamPath(p))
+	}
+	c.fiLock.RUnlock()
+
+	for _, s := range c.snapshots {
+		s.Indices = len(s.files)
+		s.Pinned = len(s.pins)
+	}
+}
+
+// copyToSnapshot copies a meta file p into the snapshot s.
+//
+// If valid is not nil, the file is copied only if it matches valid.
+// The returned slice is the list of files listed in the copied file.
+// If the file is not cached, ErrNotFound is returned.
+func (c *Cacher) copyToSnapshot(s *Snapshot, p string, valid *FileInfo) ([]byte, error) {
+	if valid == nil {
+		fi, ok := c.lookupInfo(p)
+		if !ok {
+			return nil, ErrNotFound
+		}
+		valid = fi
+	}
+
+	f, err := c.meta.LookupItem(valid)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	target := s.Name() + "/" + strings.SplitN(p, "/", 2)[1]
+	fi := MakeFileInfo(target, data)
+	fil, err := ExtractFileInfo(target, bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, p)
+	}
+
+	c.scanIndex(target, data)
+
+	c.fiLock.Lock()
+	defer c.fiLock.Unlock()
+
+	if err := c.meta.InsertItem(bytes.NewReader(data), fi); err != nil {
+		return nil, err
+	}
+	s.files = append(s.files, target)
+	for _, fi2 := range fil {
+		c.info[fi2.path] = fi2
+		if IsMeta(fi2.path) {
+			continue
+		}
+		s.pin(c.items, upstreamPath(fi2.path))
+	}
+	c.info[target] = fi
+	return data, nil
+}
+
+// CreateSnapshot takes a snapshot of a suite of a mapping.
+//
+// If id is empty, an ID is generated from the current time.
+// Indices of the suite that are not cached are downloaded beforehand.
+func (c *Cacher) CreateSnapshot(prefix, suite, id string) (*Snapshot, error) {
+	if _, ok := c.um[prefix]; !ok {
+		return nil, errors.New("unknown prefix: " + prefix)
+	}
+	if suite == "" || path.Clean(suite) != suite || path.IsAbs(suite) ||
+		strings.HasPrefix(suite, "..") {
+		return nil, errors.New("invalid suite: " + suite)
+	}
+	if id == "" {
+		id = c.now().UTC().Format(snapshotIDFormat)
+	}
+	if !validSnapshotID.MatchString(id) {
+		return nil, errors.New("invalid snapshot id: " + id)
+	}
+
+	s := &Snapshot{
+		Prefix: prefix,
+		ID:     id,
+		Suite:  suite,
+		pins:   make(map[string]bool),
+	}
+
+	// The name is reserved while indices are fetched and copied
+	// so that c.snapLock is not held during downloads.
+	c.snapLock.Lock()
+	_, exists := c.snapshots[s.Name()]
+	exists = exists || c.snapCreating[s.Name()]
+	if !exists {
+		c.snapCreating[s.Name()] = true
+	}
+	c.snapLock.Unlock()
+	if exists {
+		return nil, ErrSnapshotExists
+	}
+	defer func() {
+		c.snapLock.Lock()
+		delete(c.snapCreating, s.Name())
+		c.snapLock.Unlock()
+	}()
+
+	dir := path.Join(prefix, "dists", suite)
+	for _, name := range []string{"InRelease", "Release", "Release.gpg"} {
+		// some of them may not exist.
+		c.fetch(path.Join(dir, name))
+	}
+	fil, err := c.releaseIndices(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fil {
+		if IsMeta(fi.path) && IsSupported(fi.path) {
+			// Release may list files that do not exist.
+			c.fetch(fi.path)
+		}
+	}
+
+	// To keep the snapshot consistent, indices are copied only if
+	// they match checksums in the copied Release file.
+	var release []byte
+	for _, name := range []string{"InRelease", "Release", "Release.gpg"} {
+		data, err := c.copyToSnapshot(s, path.Join(dir, name), nil)
+		switch {
+		case err == ErrNotFound:
+			continue
+		case err != nil:
+			c.removeSnapshot(s)
+			return nil, err
+		}
+		if release == nil && name != "Release.gpg" {
+			release = data
+		}
+	}
+	if release == nil {
+		c.removeSnapshot(s)
+		return nil, errors.New("no Release file for " + dir)
+	}
+
+	fil, err = ExtractFileInfo(path.Join(dir, "Release"), bytes.NewReader(release))
+	if err != nil {
+		c.removeSnapshot(s)
+		return nil, err
+	}
+	for _, fi := range fil {
+		if !IsMeta(fi.path) || !IsSupported(fi.path) {
+			continue
+		}
+		_, err := c.copyToSnapshot(s, fi.path, fi)
+		switch {
+		case err == ErrNotFound:
+			continue
+		case err != nil:
+			c.removeSnapshot(s)
+			return nil, err
+		}
+	}
+
+	s.Indices = len(s.files)
+	s.Pinned = len(s.pins)
+	c.snapLock.Lock()
+	c.snapshots[s.Name()] = s
+	c.snapLock.Unlock()
+
+	c.logger.Info("snapshot created", map[string]interface{}{
+		"_name":  s.Name(),
+		"_suite": suite,
+	})
+	return s, nil
+}
+
+// removeSnapshot removes files of a snapshot.
+// c.snapLock must be locked beforehand unless s is not published.
+func (c *Cacher) removeSnapshot(s *Snapshot) error {
+	for p := range s.pins {
+		c.items.Unpin(p)
+	}
+	if f, ok := c.filters[s.Prefix]; ok {
+		f.forgetBlocked(s.Name())
+	}
+
+	prefix := s.Name() + "/"
+	c.fiLock.Lock()
+	for p := range c.info {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.info, p)
+		}
+	}
+	c.fiLock.Unlock()
+
+	for _, p := range s.files {
+		if err := c.meta.Delete(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes a snapshot named "<prefix>@<id>".
+//
+// If no such snapshot exists, ErrNotFound is returned.
+func (c *Cacher) DeleteSnapshot(name string) error {
+	c.snapLock.Lock()
+	defer c.snapLock.Unlock()
+
+	s, ok := c.snapshots[name]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(c.snapshots, name)
+	if err := c.removeSnapshot(s); err != nil {
+		return err
+	}
+
+	c.logger.Info("snapshot deleted", map[string]interface{}{
+		"_name": name,
+	})
+	return nil
+}
+
+// Snapshots returns the list of snapshots sorted by their names.
+func (c *Cacher) Snapshots() []*Snapshot {
+	c.snapLock.Lock()
+	defer c.snapLock.Unlock()
+
+	names := make([]string, 0, len(c.snapshots))
+	for name := range c.snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	l := make([]*Snapshot, 0, len(names))
+	for _, name := range names {
+		l = append(l, c.snapshots[name])
+	}
+	return l
+}
+
+// getKnown looks up a file in a snapshot or a local repository
+// whose checksums are already known.
+//
+// Files other than meta data are looked up in items storage for
+// the original path, and downloaded from the upstream if not found.
+func (c *Cacher) getKnown(ctx context.Context, p string) (*Result, error) {
+	fi, ok := c.lookupInfo(p)
+	if !ok {
+		return &Result{Status: http.StatusNotFound}, nil
+	}
+
+	storage := c.items
+	var upstream *url.URL
+	if IsMeta(p) {
+		storage = c.meta
+	} else {
+		fi = fi.withPath(upstreamPath(p))
+		upstream = c.um.URL(fi.path)
+	}
+
+	downloaded := false
+	for {
+		f, err := storage.LookupItem(fi)
+		switch err {
+		case nil:
+			return newResult(f, fi, !downloaded, upstream), nil
+		case ErrNotFound:
+		default:
+			c.logger.Error("lookup failure", map[string]interface{}{
+				"_err": err.Error(),
+			})
+			return nil, err
+		}
+
+		if storage == c.meta || downloaded {
+			return &Result{Status: http.StatusNotFound}, nil
+		}
+		ch := c.Download(fi.path, fi)
+		if ch == nil {
+			return &Result{Status: http.StatusNotFound}, nil
+		}
+		if err := wait(ctx, ch); err != nil {
+			return nil, err
+		}
+		downloaded = true
+	}
+}
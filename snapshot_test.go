@@ -0,0 +1,80 @@
+package aptcacher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotPath(t *testing.T) {
+	t.Parallel()
+
+	name, ok := snapshotName("ubuntu@20161018/dists/trusty/Release")
+	if !ok {
+		t.Fatal(`!ok`)
+	}
+	if name != "ubuntu@20161018" {
+		t.Error(`name != "ubuntu@20161018"`)
+	}
+
+	_, ok = snapshotName("ubuntu/dists/trusty/Release")
+	if ok {
+		t.Error(`ubuntu/dists/trusty/Release is not in a snapshot`)
+	}
+
+	p := upstreamPath("ubuntu@20161018/pool/main/a/a_1.0_amd64.deb")
+	if p != "ubuntu/pool/main/a/a_1.0_amd64.deb" {
+		t.Error(`p != "ubuntu/pool/main/a/a_1.0_amd64.deb"`)
+	}
+}
+
+func TestCreateSnapshotUnlocked(t *testing.T) {
+	t.Parallel()
+
+	repo := &testRepo{hold: make(chan struct{}), holdSuffix: "/Release"}
+	repo.setPackages(map[string]string{"a": "1.0"})
+	c, done := newTestCacher(t, repo, nil)
+	defer done()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.CreateSnapshot("up", "s", "one")
+		errCh <- err
+	}()
+
+	// wait until the name is reserved.
+	for i := 0; ; i++ {
+		c.snapLock.Lock()
+		creating := c.snapCreating["up@one"]
+		c.snapLock.Unlock()
+		if creating {
+			break
+		}
+		if i == 500 {
+			t.Fatal(`snapshot is not being created`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// snapshots can be listed while Release is being downloaded.
+	listed := make(chan struct{})
+	go func() {
+		c.Snapshots()
+		close(listed)
+	}()
+	select {
+	case <-listed:
+	case <-time.After(5 * time.Second):
+		t.Fatal(`Snapshots is blocked by CreateSnapshot`)
+	}
+	if _, err := c.CreateSnapshot("up", "s", "one"); err != ErrSnapshotExists {
+		t.Error(`err != ErrSnapshotExists`, err)
+	}
+
+	close(repo.hold)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Snapshots()) != 1 {
+		t.Error(`len(c.Snapshots()) != 1`)
+	}
+}
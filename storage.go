@@ -1,13 +1,19 @@
 package aptcacher
 
 import (
-	"container/heap"
+	"bufio"
+	"bytes"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/cybozu-go/log"
@@ -16,6 +22,14 @@ import (
 
 const (
 	fileSuffix = ".cache"
+
+	// stateFile keeps the eviction order and hits of items, and the
+	// age of LFU policy.
+	stateFile = "_eviction.state"
+
+	// stateAgePrefix precedes the age of LFU policy in stateFile.
+	// Paths of items never begin with "#".
+	stateAgePrefix = "#age "
 )
 
 var (
@@ -24,16 +38,30 @@ var (
 
 	// ErrBadPath is returned by Storage.Insert if path is bad
 	ErrBadPath = errors.New("bad path")
+
+	// ErrPinned is returned by Storage.Delete for pinned items.
+	ErrPinned = errors.New("pinned")
 )
 
 // entry represents an item in the cache.
 type entry struct {
 	*FileInfo
 
-	// for container/heap.
-	// atime is used as priorities.
+	// atime is the logical time of the last access.
+	// hits is the number of accesses.
 	atime uint64
-	index int
+	hits  uint64
+
+	// for eviction policies.
+	index    int
+	priority uint64
+
+	// pinned entries are not in the eviction policy.
+	pinned bool
+
+	// size of blocks on the file system for the file and
+	// its sidecar file.
+	disk uint64
 }
 
 // FilePath returns the filename of the entry.
@@ -42,99 +70,295 @@ func (e *entry) FilePath() string {
 }
 
 // Storage stores cache items in local file system.
+// It implements Store.
+//
+// Cached items will be removed when the disk usage of items exceeds
+// the capacity.  The disk usage includes file system blocks and
+// sidecar files of items.  The order of eviction is decided by a policy, which
+// is LRU by default.  The order is saved by SaveState and restored
+// by Load.
+//
+// Items can be pinned to be excluded from eviction, either by Pin
+// or by patterns of paths.  Pinned items are not counted against
+// the capacity.
 //
-// Cached items will be removed in LRU fashion when the total size of
-// items exceeds the capacity.
+// Usage is also accounted for each prefix, the first element of
+// item paths.  Prefixes can have quotas in addition to the capacity.
+//
+// In addition, items can be evicted when the free space of the file
+// system falls below a watermark.
 type Storage struct {
 	dir      string // directory for cache items
 	capacity uint64
-
-	mu     sync.Mutex
-	used   uint64
-	cache  map[string]*entry
-	lru    []*entry // for container/heap
-	lclock uint64   // ditto
+	logger   *log.Logger
+
+	// watermarks of free space.  Zero freeLow disables them.
+	freeLow   uint64
+	freeHigh  uint64
+	freeSpace func(dir string) (uint64, error)
+
+	// diskUsage returns the disk usage of a cached file.
+	diskUsage func(fname string, st os.FileInfo) uint64
+
+	mu         sync.Mutex
+	used       uint64
+	pinnedUsed uint64
+	diskUsed   uint64
+	usedDisk   uint64 // diskUsed of items subject to eviction
+	cache      map[string]*entry
+	pins       map[string]int // reference counts of pinned paths
+	patterns   []string       // patterns of pinned paths
+	policy     evictionPolicy
+	lclock     uint64
+	prefixes   map[string]*Usage
+
+	// onEvict is called with mu held when an item is evicted.
+	// It must not block.
+	onEvict func(fi *FileInfo)
 }
 
 // NewStorage creates a Storage.
 //
 // dir is the directory for cached items.
-// capacity is the maximum total size (bytes) of items in the cache.
+// capacity is the maximum disk usage (bytes) of items in the cache.
 // If capacity is zero, items will not be evicted.
 func NewStorage(dir string, capacity uint64) *Storage {
 	if !filepath.IsAbs(dir) {
 		panic("dir must be an absolute path")
 	}
 	return &Storage{
-		dir:      dir,
-		cache:    make(map[string]*entry),
-		capacity: capacity,
+		dir:       dir,
+		cache:     make(map[string]*entry),
+		pins:      make(map[string]int),
+		prefixes:  make(map[string]*Usage),
+		policy:    newLRUPolicy(),
+		capacity:  capacity,
+		logger:    log.DefaultLogger(),
+		freeSpace: freeSpace,
+		diskUsage: itemDiskUsage,
 	}
 }
 
-// Len implements heap.Interface.
-func (cm *Storage) Len() int {
-	return len(cm.lru)
+// itemDiskUsage returns the bytes of blocks allocated for a cached
+// file fname and its sidecar file.  st is the status of fname.
+func itemDiskUsage(fname string, st os.FileInfo) uint64 {
+	n := diskSize(st)
+	if mst, err := os.Stat(fname + metaSuffix); err == nil {
+		n += diskSize(mst)
+	}
+	return n
 }
 
-// Less implements heap.Interface.
-func (cm *Storage) Less(i, j int) bool {
-	return cm.lru[i].atime < cm.lru[j].atime
+// prefixUsage returns the usage for the prefix of p.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) prefixUsage(p string) *Usage {
+	prefix := strings.SplitN(p, "/", 2)[0]
+	u, ok := cm.prefixes[prefix]
+	if !ok {
+		u = &Usage{}
+		cm.prefixes[prefix] = u
+	}
+	return u
 }
 
-// Swap implements heap.Interface.
-func (cm *Storage) Swap(i, j int) {
-	cm.lru[i], cm.lru[j] = cm.lru[j], cm.lru[i]
-	cm.lru[i].index = i
-	cm.lru[j].index = j
+// addUsage adds the size of e to the usage.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) addUsage(e *entry, pinned bool) {
+	u := cm.prefixUsage(e.path)
+	u.Items++
+	u.Disk += e.disk
+	cm.diskUsed += e.disk
+	if pinned {
+		cm.pinnedUsed += e.size
+		u.Pinned += e.size
+	} else {
+		cm.used += e.size
+		cm.usedDisk += e.disk
+		u.Used += e.size
+		u.UsedDisk += e.disk
+	}
 }
 
-// Push implements heap.Interface.
-func (cm *Storage) Push(x interface{}) {
-	e, ok := x.(*entry)
-	if !ok {
-		panic("Storage.Push: wrong type")
+// subUsage subtracts the size of e from the usage.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) subUsage(e *entry, pinned bool) {
+	u := cm.prefixUsage(e.path)
+	u.Items--
+	u.Disk -= e.disk
+	cm.diskUsed -= e.disk
+	if pinned {
+		cm.pinnedUsed -= e.size
+		u.Pinned -= e.size
+	} else {
+		cm.used -= e.size
+		cm.usedDisk -= e.disk
+		u.Used -= e.size
+		u.UsedDisk -= e.disk
 	}
-	n := len(cm.lru)
-	e.index = n
-	cm.lru = append(cm.lru, e)
 }
 
-// Pop implements heap.Interface.
-func (cm *Storage) Pop() interface{} {
-	n := len(cm.lru)
-	e := cm.lru[n-1]
-	e.index = -1 // for safety
-	cm.lru = cm.lru[0 : n-1]
-	return e
+// Len returns the number of items subject to eviction.
+func (cm *Storage) Len() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	return cm.policy.len()
 }
 
-// maint removes unused items from cache until used < capacity.
+// maint removes unused items from cache until the disk usage is
+// within the capacity, and that of each prefix is within its quota.
 // cm.mu lock must be acquired beforehand.
 func (cm *Storage) maint() {
-	for cm.capacity > 0 && cm.used > cm.capacity {
-		e := heap.Pop(cm).(*entry)
-		delete(cm.cache, e.Path())
-		cm.used -= e.Size()
-		if err := os.Remove(filepath.Join(cm.dir, e.FilePath())); err != nil {
-			log.Warn("Storage.maint", map[string]interface{}{
-				"_err": err.Error(),
-			})
+	cm.maintQuota()
+
+	for cm.capacity > 0 && cm.usedDisk > cm.capacity {
+		e := cm.policy.evict()
+		if e == nil {
+			break
 		}
-		log.Info("removed", map[string]interface{}{
-			"_path": e.Path(),
-		})
+		cm.evict(e)
+	}
+
+	if cm.freeLow > 0 {
+		cm.maintFreeSpace()
+	}
+}
+
+// maintQuota removes unused items of prefixes exceeding their quotas.
+// Victims of all prefixes are chosen by a single walk of the policy.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) maintQuota() {
+	excess := make(map[string]uint64)
+	for prefix, u := range cm.prefixes {
+		if u.Capacity > 0 && u.UsedDisk > u.Capacity {
+			excess[prefix] = u.UsedDisk - u.Capacity
+		}
+	}
+	if len(excess) == 0 {
+		return
+	}
+
+	var victims []*entry
+	cm.policy.walk(func(e *entry) bool {
+		prefix := strings.SplitN(e.path, "/", 2)[0]
+		n, ok := excess[prefix]
+		if !ok {
+			return true
+		}
+		victims = append(victims, e)
+		if e.disk >= n {
+			delete(excess, prefix)
+		} else {
+			excess[prefix] = n - e.disk
+		}
+		return len(excess) > 0
+	})
+
+	// entries cannot be removed from the policy while walking.
+	for _, e := range victims {
+		cm.policy.remove(e)
+		cm.evict(e)
 	}
 }
 
-func readData(path string) ([]byte, error) {
-	f, err := os.Open(path)
+// maintFreeSpace removes unused items if the free space of the file
+// system is below freeLow, until it reaches freeHigh.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) maintFreeSpace() {
+	free, err := cm.freeSpace(cm.dir)
 	if err != nil {
-		return nil, err
+		cm.logger.Warn("Storage: failed to get free space", map[string]interface{}{
+			"_err": err.Error(),
+		})
+		return
+	}
+	if free >= cm.freeLow {
+		return
+	}
+
+	cm.logger.Info("Storage: free space is low", map[string]interface{}{
+		"_free": free,
+	})
+	for free < cm.freeHigh {
+		e := cm.policy.evict()
+		if e == nil {
+			break
+		}
+		cm.evict(e)
+		// estimate without calling statfs for each item.
+		free += e.disk
+	}
+}
+
+// evict removes e that has been removed from the policy.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) evict(e *entry) {
+	delete(cm.cache, e.Path())
+	cm.subUsage(e, false)
+	if err := removeItemFile(filepath.Join(cm.dir, e.FilePath())); err != nil {
+		cm.logger.Warn("Storage.maint", map[string]interface{}{
+			"_err": err.Error(),
+		})
+	}
+	cm.logger.Info("removed", map[string]interface{}{
+		"_path": e.Path(),
+	})
+	if cm.onEvict != nil {
+		cm.onEvict(e.FileInfo)
+	}
+}
+
+// isPinned returns true if p is pinned by Pin or patterns.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) isPinned(p string) bool {
+	if cm.pins[p] > 0 {
+		return true
+	}
+	for _, pattern := range cm.patterns {
+		for q := p; q != "."; q = path.Dir(q) {
+			if ok, _ := path.Match(pattern, q); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// repin updates the pinned state of e.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) repin(e *entry) {
+	pinned := cm.isPinned(e.path)
+	if pinned == e.pinned {
+		return
+	}
+	cm.subUsage(e, e.pinned)
+	if pinned {
+		cm.policy.remove(e)
+	} else {
+		cm.policy.add(e)
+	}
+	e.pinned = pinned
+	cm.addUsage(e, pinned)
+}
+
+// add adds e to the usage and, unless pinned, to the policy.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) add(e *entry) {
+	e.pinned = cm.isPinned(e.path)
+	cm.addUsage(e, e.pinned)
+	if !e.pinned {
+		cm.policy.add(e)
 	}
-	defer f.Close()
+}
 
-	return ioutil.ReadAll(f)
+// remove removes an entry from internal data structures.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) remove(e *entry) {
+	if !e.pinned {
+		cm.policy.remove(e)
+	}
+	cm.subUsage(e, e.pinned)
+	delete(cm.cache, e.path)
 }
 
 // Load loads existing items in filesystem.
@@ -142,6 +366,7 @@ func (cm *Storage) Load() error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
+	var loaded []*entry
 	wf := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -163,19 +388,20 @@ func (cm *Storage) Load() error {
 
 		size := uint64(info.Size())
 		e := &entry{
-			// delay calculation of checksums.
 			FileInfo: &FileInfo{
 				path: subpath,
 				size: size,
 			},
-			atime: cm.lclock,
-			index: len(cm.lru),
+			index: -1,
+			disk:  cm.diskUsage(path, info),
+		}
+		// checksums are calculated later if not saved.
+		if m, err := readItemMeta(path); err == nil {
+			m.apply(e.FileInfo, info)
 		}
-		cm.used += size
-		cm.lclock++
-		cm.lru = append(cm.lru, e)
 		cm.cache[subpath] = e
-		log.Debug("Storage.Load", map[string]interface{}{
+		loaded = append(loaded, e)
+		cm.logger.Debug("Storage.Load", map[string]interface{}{
 			"_path": subpath,
 		})
 		return nil
@@ -184,7 +410,16 @@ func (cm *Storage) Load() error {
 	if err := filepath.Walk(cm.dir, wf); err != nil {
 		return err
 	}
-	heap.Init(cm)
+
+	order, err := cm.loadState(loaded)
+	if err != nil {
+		return err
+	}
+	for _, e := range order {
+		e.atime = cm.lclock
+		cm.lclock++
+		cm.add(e)
+	}
 
 	cm.maint()
 
@@ -196,6 +431,12 @@ func (cm *Storage) Load() error {
 // fi.Path() must be as clean as filepath.Clean() and
 // must not be filepath.IsAbs().
 func (cm *Storage) Insert(data []byte, fi *FileInfo) error {
+	return cm.InsertItem(bytes.NewReader(data), fi)
+}
+
+// InsertItem is the same as Insert except that the data is read
+// from r.  This implements Store.
+func (cm *Storage) InsertItem(r io.Reader, fi *FileInfo) error {
 	switch {
 	case fi.path != filepath.Clean(fi.path):
 		return ErrBadPath
@@ -211,10 +452,13 @@ func (cm *Storage) Insert(data []byte, fi *FileInfo) error {
 	}
 	defer func() {
 		f.Close()
-		os.Remove(f.Name())
+		removeItemFile(f.Name())
 	}()
 
-	_, err = f.Write(data)
+	md5hash := md5.New()
+	sha1hash := sha1.New()
+	sha256hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, md5hash, sha1hash, sha256hash), r)
 	if err != nil {
 		return err
 	}
@@ -222,8 +466,21 @@ func (cm *Storage) Insert(data []byte, fi *FileInfo) error {
 	if err != nil {
 		return err
 	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
 
+	// keep checksums of the actual data.
 	p := fi.path
+	efi := &FileInfo{
+		path:      p,
+		size:      uint64(st.Size()),
+		md5sum:    md5hash.Sum(nil),
+		sha1sum:   sha1hash.Sum(nil),
+		sha256sum: sha256hash.Sum(nil),
+		header:    fi.header,
+	}
 	destpath := filepath.Join(cm.dir, p+fileSuffix)
 	dirpath := filepath.Dir(destpath)
 
@@ -238,6 +495,13 @@ func (cm *Storage) Insert(data []byte, fi *FileInfo) error {
 		return err
 	}
 
+	// written before renaming so that the data and the meta data
+	// are updated atomically, or the meta data becomes stale.
+	err = writeItemMeta(cm.dir, f.Name(), newItemMeta(efi, st))
+	if err != nil {
+		return err
+	}
+
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
@@ -247,15 +511,13 @@ func (cm *Storage) Insert(data []byte, fi *FileInfo) error {
 			if !os.IsNotExist(err) {
 				return err
 			}
-			log.Warn("cache file was removed already", map[string]interface{}{
+			cm.logger.Warn("cache file was removed already", map[string]interface{}{
 				"_path": p,
 			})
 		}
-		cm.used -= existing.Size()
-		heap.Remove(cm, existing.index)
-		delete(cm.cache, p)
-		if log.Enabled(log.LvDebug) {
-			log.Debug("deleted existing item", map[string]interface{}{
+		cm.remove(existing)
+		if cm.logger.Enabled(log.LvDebug) {
+			cm.logger.Debug("deleted existing item", map[string]interface{}{
 				"_path": p,
 			})
 		}
@@ -265,14 +527,23 @@ func (cm *Storage) Insert(data []byte, fi *FileInfo) error {
 	if err != nil {
 		return err
 	}
+	// the sidecar file follows the data so that it is never left
+	// without the data.  If this fails, checksums are recalculated.
+	if err := moveSidecar(f.Name(), destpath); err != nil {
+		cm.logger.Warn("Storage: failed to save checksums", map[string]interface{}{
+			"_path": p,
+			"_err":  err.Error(),
+		})
+	}
 
 	e := &entry{
-		FileInfo: fi,
+		FileInfo: efi,
 		atime:    cm.lclock,
+		index:    -1,
+		disk:     cm.diskUsage(destpath, st),
 	}
-	cm.used += fi.size
 	cm.lclock++
-	heap.Push(cm, e)
+	cm.add(e)
 	cm.cache[p] = e
 
 	cm.maint()
@@ -280,21 +551,39 @@ func (cm *Storage) Insert(data []byte, fi *FileInfo) error {
 	return nil
 }
 
-func calcChecksum(dir string, e *entry) error {
+// calcChecksum calculates checksums of e if not yet known, and
+// saves them with the file.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) calcChecksum(e *entry) error {
 	if e.FileInfo.md5sum != nil {
 		return nil
 	}
 
-	data, err := readData(filepath.Join(dir, e.FilePath()))
+	fname := filepath.Join(cm.dir, e.FilePath())
+	fi, err := fileInfo(e.path, fname)
 	if err != nil {
 		return err
 	}
-	md5sum := md5.Sum(data)
-	sha1sum := sha1.Sum(data)
-	sha256sum := sha256.Sum256(data)
-	e.FileInfo.md5sum = md5sum[:]
-	e.FileInfo.sha1sum = sha1sum[:]
-	e.FileInfo.sha256sum = sha256sum[:]
+	e.FileInfo.md5sum = fi.md5sum
+	e.FileInfo.sha1sum = fi.sha1sum
+	e.FileInfo.sha256sum = fi.sha256sum
+
+	st, err := os.Stat(fname)
+	if err == nil {
+		err = writeItemMeta(cm.dir, fname, newItemMeta(e.FileInfo, st))
+	}
+	if err != nil {
+		cm.logger.Warn("Storage: failed to save checksums", map[string]interface{}{
+			"_path": e.path,
+			"_err":  err.Error(),
+		})
+		return nil
+	}
+
+	// a sidecar file may have been created.
+	cm.subUsage(e, e.pinned)
+	e.disk = cm.diskUsage(fname, st)
+	cm.addUsage(e, e.pinned)
 	return nil
 }
 
@@ -303,6 +592,17 @@ func calcChecksum(dir string, e *entry) error {
 //
 // The caller is responsible to close the returned os.File.
 func (cm *Storage) Lookup(fi *FileInfo) (*os.File, error) {
+	item, err := cm.LookupItem(fi)
+	if err != nil {
+		return nil, err
+	}
+	return item.(storageItem).File, nil
+}
+
+// LookupItem is the same as Lookup except that it returns an Item,
+// which is an *os.File with upstream headers if any.
+// This implements Store.
+func (cm *Storage) LookupItem(fi *FileInfo) (Item, error) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
@@ -312,7 +612,7 @@ func (cm *Storage) Lookup(fi *FileInfo) (*os.File, error) {
 	}
 
 	// delayed checksum calculation
-	err := calcChecksum(cm.dir, e)
+	err := cm.calcChecksum(e)
 	if err != nil {
 		return nil, err
 	}
@@ -323,9 +623,107 @@ func (cm *Storage) Lookup(fi *FileInfo) (*os.File, error) {
 	}
 
 	e.atime = cm.lclock
+	e.hits++
 	cm.lclock++
-	heap.Fix(cm, e.index)
-	return os.Open(filepath.Join(cm.dir, e.FilePath()))
+	if !e.pinned {
+		cm.policy.touch(e)
+	}
+	f, err := os.Open(filepath.Join(cm.dir, e.FilePath()))
+	if err != nil {
+		return nil, err
+	}
+	return storageItem{f, e.header}, nil
+}
+
+// storageItem is an Item returned by Storage.LookupItem.
+type storageItem struct {
+	*os.File
+	header http.Header
+}
+
+// Header implements headerReader.
+func (i storageItem) Header() http.Header {
+	return i.header
+}
+
+// Contains returns true if an item for p exists in the cache.
+//
+// Unlike Lookup, this neither validates checksums nor affects
+// the eviction order of the item.
+func (cm *Storage) Contains(p string) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	_, ok := cm.cache[p]
+	return ok
+}
+
+// Usage returns the current usage of the storage.
+func (cm *Storage) Usage() Usage {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	return Usage{
+		Items:    len(cm.cache),
+		Used:     cm.used,
+		Pinned:   cm.pinnedUsed,
+		UsedDisk: cm.usedDisk,
+		Capacity: cm.capacity,
+		Disk:     cm.diskUsed,
+	}
+}
+
+// SetLogger specifies the logger for the storage.
+//
+// Default is log.DefaultLogger().
+func (cm *Storage) SetLogger(logger *log.Logger) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.logger = logger
+}
+
+// SetFreeSpaceWatermarks sets watermarks of the free space of the
+// file system for the storage.
+//
+// When the free space falls below low, items are evicted until
+// the free space reaches high.  If high is smaller than low, low is
+// used as high.  Zero low disables the watermarks.
+func (cm *Storage) SetFreeSpaceWatermarks(low, high uint64) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if high < low {
+		high = low
+	}
+	cm.freeLow = low
+	cm.freeHigh = high
+	cm.maint()
+}
+
+// PrefixUsage returns the current usage of items under prefix.
+//
+// Capacity of the returned Usage is the quota of prefix.
+func (cm *Storage) PrefixUsage(prefix string) Usage {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if u, ok := cm.prefixes[prefix]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+// SetQuota sets the maximum total size (bytes) of items under prefix.
+// Items of prefix are evicted when exceeded.
+//
+// Zero removes the quota.
+func (cm *Storage) SetQuota(prefix string, quota uint64) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.prefixUsage(prefix).Capacity = quota
+	cm.maint()
 }
 
 // ListAll returns a list of FileInfo for all cached items.
@@ -333,14 +731,17 @@ func (cm *Storage) ListAll() []*FileInfo {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	l := make([]*FileInfo, cm.Len())
-	for i, e := range cm.lru {
-		l[i] = e.FileInfo
+	l := make([]*FileInfo, 0, len(cm.cache))
+	for _, e := range cm.cache {
+		l = append(l, e.FileInfo)
 	}
 	return l
 }
 
 // Delete deletes an item from the cache.
+//
+// Items pinned by Pin or pin patterns are not deleted, and
+// ErrPinned is returned.
 func (cm *Storage) Delete(p string) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
@@ -349,22 +750,208 @@ func (cm *Storage) Delete(p string) error {
 	if !ok {
 		return nil
 	}
+	if e.pinned {
+		return ErrPinned
+	}
 
-	err := os.Remove(filepath.Join(cm.dir, e.FilePath()))
+	err := removeItemFile(filepath.Join(cm.dir, e.FilePath()))
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return err
 		}
-		log.Warn("cached file was already removed", map[string]interface{}{
+		cm.logger.Warn("cached file was already removed", map[string]interface{}{
 			"_path": p,
 		})
 	}
 
-	cm.used -= e.size
-	heap.Remove(cm, e.index)
-	delete(cm.cache, p)
-	log.Info("deleted item", map[string]interface{}{
+	cm.remove(e)
+	cm.logger.Info("deleted item", map[string]interface{}{
 		"_path": p,
 	})
 	return nil
 }
+
+// Pin excludes an item for p from eviction.
+//
+// p need not be cached at the time of the call; the item will be
+// excluded from eviction once it is inserted.  Pins are counted
+// for each p, so Unpin must be called as many times as Pin.
+func (cm *Storage) Pin(p string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.pins[p]++
+	if cm.pins[p] > 1 {
+		return
+	}
+
+	if e, ok := cm.cache[p]; ok {
+		cm.repin(e)
+	}
+}
+
+// Unpin reverts Pin.
+//
+// When all pins for p are removed, the item becomes a subject to
+// eviction again unless it matches patterns set by SetPinPatterns.
+func (cm *Storage) Unpin(p string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	n, ok := cm.pins[p]
+	if !ok {
+		return
+	}
+	if n > 1 {
+		cm.pins[p] = n - 1
+		return
+	}
+	delete(cm.pins, p)
+
+	if e, ok := cm.cache[p]; ok {
+		cm.repin(e)
+		cm.maint()
+	}
+}
+
+// SetEvictionPolicy sets the policy to decide the order of eviction.
+//
+// name is one of EvictionLRU, EvictionLFU, or Eviction2Q.
+// Items already in the storage are kept in the current order.
+func (cm *Storage) SetEvictionPolicy(name string) error {
+	policy, err := newEvictionPolicy(name)
+	if err != nil {
+		return err
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.policy.walk(func(e *entry) bool {
+		policy.add(e)
+		return true
+	})
+	cm.policy = policy
+	return nil
+}
+
+// SaveState saves the eviction order and the number of hits of
+// items, and the age of LFU policy, into a file in the storage
+// directory so that Load can restore them.
+func (cm *Storage) SaveState() error {
+	f, err := ioutil.TempFile(cm.dir, "_tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	w := bufio.NewWriter(f)
+	cm.mu.Lock()
+	if p, ok := cm.policy.(*lfuPolicy); ok {
+		_, err = w.WriteString(stateAgePrefix + strconv.FormatUint(p.age, 10) + "\n")
+	}
+	if err == nil {
+		cm.policy.walk(func(e *entry) bool {
+			_, err = w.WriteString(strconv.FormatUint(e.hits, 10) + " " + e.path + "\n")
+			return err == nil
+		})
+	}
+	cm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(cm.dir, stateFile))
+}
+
+// loadState sorts loaded entries in the order saved by SaveState
+// and restores their hits, and the age if the policy is LFU.
+// Entries not in the state file come first.
+// cm.mu lock must be acquired beforehand.
+func (cm *Storage) loadState(loaded []*entry) ([]*entry, error) {
+	entries := make(map[string]*entry)
+	for _, e := range loaded {
+		entries[e.path] = e
+	}
+	saved := make(map[string]bool)
+	var order []*entry
+
+	f, err := os.Open(filepath.Join(cm.dir, stateFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := sc.Text()
+			if strings.HasPrefix(line, stateAgePrefix) {
+				age, err := strconv.ParseUint(line[len(stateAgePrefix):], 10, 64)
+				if p, ok := cm.policy.(*lfuPolicy); ok && err == nil {
+					p.age = age
+				}
+				continue
+			}
+			t := strings.SplitN(line, " ", 2)
+			if len(t) != 2 {
+				continue
+			}
+			e, ok := entries[t[1]]
+			if !ok || saved[t[1]] {
+				continue
+			}
+			hits, err := strconv.ParseUint(t[0], 10, 64)
+			if err != nil {
+				continue
+			}
+			e.hits = hits
+			saved[t[1]] = true
+			order = append(order, e)
+		}
+		if err := sc.Err(); err != nil {
+			cm.logger.Warn("Storage: broken state file", map[string]interface{}{
+				"_err": err.Error(),
+			})
+		}
+	}
+
+	var unknown []*entry
+	for _, e := range loaded {
+		if !saved[e.path] {
+			unknown = append(unknown, e)
+		}
+	}
+	return append(unknown, order...), nil
+}
+
+// SetPinPatterns sets patterns of paths of items to be pinned.
+//
+// Patterns are matched by path.Match against the path of an item
+// and its parent directories, hence "ubuntu" pins all items under
+// "ubuntu/".  Patterns previously set are replaced.
+func (cm *Storage) SetPinPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrap(err, pattern)
+		}
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.patterns = patterns
+	for _, e := range cm.cache {
+		cm.repin(e)
+	}
+	cm.maint()
+	return nil
+}
@@ -10,6 +10,12 @@ import (
 	"testing"
 )
 
+// logicalUsage counts only the size of a file as its disk usage
+// so that capacities in tests do not depend on the file system.
+func logicalUsage(fname string, st os.FileInfo) uint64 {
+	return uint64(st.Size())
+}
+
 func TestStorage(t *testing.T) {
 	t.Parallel()
 
@@ -121,6 +127,11 @@ func TestStorageLRU(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	cm := NewStorage(dir, 3)
+	cm.diskUsage = logicalUsage
+	var evicted []string
+	cm.onEvict = func(fi *FileInfo) {
+		evicted = append(evicted, fi.path)
+	}
 
 	err = cm.Insert([]byte{'a'}, &FileInfo{
 		path: "path/to/a",
@@ -154,6 +165,9 @@ func TestStorageLRU(t *testing.T) {
 	if cm.used != 2 {
 		t.Error(`cm.used != 2`)
 	}
+	if len(evicted) != 2 || evicted[0] != "path/to/a" || evicted[1] != "path/to/bc" {
+		t.Errorf("unexpected evicted items: %v", evicted)
+	}
 
 	_, err = cm.Lookup(&FileInfo{
 		path: "path/to/a",
@@ -219,6 +233,271 @@ func TestStorageLRU(t *testing.T) {
 	}
 }
 
+func TestStoragePin(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := NewStorage(dir, 2)
+	cm.diskUsage = logicalUsage
+
+	// pin before insertion
+	cm.Pin("path/to/a")
+	err = cm.Insert([]byte{'a'}, &FileInfo{
+		path: "path/to/a",
+		size: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Len() != 0 {
+		t.Error(`cm.Len() != 0`)
+	}
+	if cm.used != 0 {
+		t.Error(`cm.used != 0`)
+	}
+	if cm.pinnedUsed != 1 {
+		t.Error(`cm.pinnedUsed != 1`)
+	}
+
+	err = cm.Insert([]byte{'b', 'c'}, &FileInfo{
+		path: "path/to/bc",
+		size: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pin after insertion
+	cm.Pin("path/to/bc")
+	cm.Pin("path/to/bc")
+	if cm.used != 0 {
+		t.Error(`cm.used != 0`)
+	}
+	if cm.pinnedUsed != 3 {
+		t.Error(`cm.pinnedUsed != 3`)
+	}
+
+	// pinned items are not evicted
+	err = cm.Insert([]byte{'d', 'e'}, &FileInfo{
+		path: "path/to/de",
+		size: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.ListAll()) != 3 {
+		t.Error(`len(cm.ListAll()) != 3`)
+	}
+
+	// bc is still pinned once
+	cm.Unpin("path/to/bc")
+	if cm.pinnedUsed != 3 {
+		t.Error(`cm.pinnedUsed != 3`)
+	}
+
+	// bc will be evicted as it is older than de
+	cm.Unpin("path/to/bc")
+	if cm.pinnedUsed != 1 {
+		t.Error(`cm.pinnedUsed != 1`)
+	}
+	if cm.used != 2 {
+		t.Error(`cm.used != 2`)
+	}
+	_, err = cm.Lookup(&FileInfo{
+		path: "path/to/bc",
+		size: 2,
+	})
+	if err != ErrNotFound {
+		t.Error(`err != ErrNotFound`)
+	}
+
+	// pinned items are not deleted
+	err = cm.Delete("path/to/a")
+	if err != ErrPinned {
+		t.Error(`err != ErrPinned`)
+	}
+	if !cm.Contains("path/to/a") {
+		t.Error(`pinned item must not be deleted`)
+	}
+
+	cm.Unpin("path/to/a")
+	err = cm.Delete("path/to/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.pinnedUsed != 0 {
+		t.Error(`cm.pinnedUsed != 0`)
+	}
+}
+
+func TestStorageQuota(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := NewStorage(dir, 10)
+	cm.diskUsage = logicalUsage
+	cm.SetQuota("ports", 3)
+
+	insert := func(p string) {
+		err := cm.Insert([]byte{'a', 'b'}, &FileInfo{
+			path: p,
+			size: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert("ubuntu/a")
+	insert("ports/a")
+	insert("ubuntu/b")
+	insert("ports/b")
+
+	// ports/a is evicted by the quota.
+	if cm.Contains("ports/a") {
+		t.Error(`ports/a is not evicted`)
+	}
+	if !cm.Contains("ports/b") || !cm.Contains("ubuntu/a") {
+		t.Error(`items are evicted wrongly`)
+	}
+	u := cm.PrefixUsage("ports")
+	if u.Items != 1 || u.Used != 2 || u.Capacity != 3 {
+		t.Errorf(`wrong usage of ports: %#v`, u)
+	}
+	u = cm.PrefixUsage("ubuntu")
+	if u.Items != 2 || u.Used != 4 {
+		t.Errorf(`wrong usage of ubuntu: %#v`, u)
+	}
+
+	// pinned items are not counted against the quota.
+	cm.Pin("ports/c")
+	insert("ports/c")
+	if !cm.Contains("ports/b") || !cm.Contains("ports/c") {
+		t.Error(`pinned item evicts others`)
+	}
+	u = cm.PrefixUsage("ports")
+	if u.Items != 2 || u.Used != 2 || u.Pinned != 2 {
+		t.Errorf(`wrong usage of ports: %#v`, u)
+	}
+
+	cm.Unpin("ports/c")
+	if cm.Contains("ports/b") || !cm.Contains("ports/c") {
+		t.Error(`ports/b is not evicted`)
+	}
+
+	// the capacity is honoured as well.
+	insert("ubuntu/c")
+	insert("ubuntu/d")
+	insert("ubuntu/e")
+	if cm.Contains("ubuntu/a") {
+		t.Error(`ubuntu/a is not evicted`)
+	}
+	if cm.used > 10 {
+		t.Error(`cm.used > 10`)
+	}
+
+	cm.SetQuota("ubuntu", 4)
+	if u := cm.PrefixUsage("ubuntu"); u.Used != 4 {
+		t.Errorf(`wrong usage of ubuntu: %#v`, u)
+	}
+}
+
+func TestStorageQuotaPrefixes(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := NewStorage(dir, 0)
+	cm.diskUsage = logicalUsage
+	for _, p := range []string{"a/1", "b/1", "a/2", "b/2", "a/3", "a/4"} {
+		err := cm.Insert([]byte{'a', 'b'}, &FileInfo{
+			path: p,
+			size: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// quotas of several prefixes are exceeded at once.
+	cm.mu.Lock()
+	cm.prefixUsage("a").Capacity = 4
+	cm.prefixUsage("b").Capacity = 2
+	cm.maint()
+	cm.mu.Unlock()
+
+	for _, p := range []string{"a/1", "a/2", "b/1"} {
+		if cm.Contains(p) {
+			t.Error(p + ` is not evicted`)
+		}
+	}
+	for _, p := range []string{"a/3", "a/4", "b/2"} {
+		if !cm.Contains(p) {
+			t.Error(p + ` is evicted`)
+		}
+	}
+}
+
+func TestStorageFreeSpace(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := NewStorage(dir, 0)
+	var free uint64 = 100000
+	cm.freeSpace = func(dir string) (uint64, error) {
+		return free, nil
+	}
+	cm.SetFreeSpaceWatermarks(50000, 80000)
+
+	data := make([]byte, 10000)
+	for _, p := range []string{"a", "b", "c", "d"} {
+		err := cm.Insert(data, &FileInfo{
+			path: p,
+			size: uint64(len(data)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := cm.Usage()
+	if u.Items != 4 {
+		t.Fatal(`u.Items != 4`)
+	}
+	if u.Disk < u.Used {
+		t.Error(`u.Disk < u.Used`, u.Disk, u.Used)
+	}
+
+	// items are evicted until free space reaches the high watermark.
+	free = 60000
+	cm.Pin("d")
+	cm.SetFreeSpaceWatermarks(70000, 80000)
+	if cm.Contains("a") || cm.Contains("b") {
+		t.Error(`old items are not evicted`)
+	}
+	if !cm.Contains("c") || !cm.Contains("d") {
+		t.Error(`too many items are evicted`)
+	}
+}
+
 func TestStorageLoad(t *testing.T) {
 	t.Parallel()
 
@@ -344,3 +623,248 @@ func TestStoragePathTraversal(t *testing.T) {
 		t.Error(`. must be a bad path`)
 	}
 }
+
+func TestStorageSaveState(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := NewStorage(dir, 0)
+	for _, p := range []string{"a", "b", "c"} {
+		err := cm.Insert([]byte{'x'}, &FileInfo{
+			path: p,
+			size: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		f, err := cm.Lookup(&FileInfo{path: "a", size: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	if err := cm.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// "d" is not in the state, so it is evicted first.
+	err = ioutil.WriteFile(filepath.Join(dir, "d"+fileSuffix), []byte{'x'}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm = NewStorage(dir, 0)
+	if err := cm.SetEvictionPolicy(EvictionLFU); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if cm.cache["a"].hits != 3 {
+		t.Error(`cm.cache["a"].hits != 3`)
+	}
+
+	var order []string
+	cm.policy.walk(func(e *entry) bool {
+		order = append(order, e.path)
+		return true
+	})
+	expected := []string{"d", "b", "c", "a"}
+	if len(order) != len(expected) {
+		t.Fatal(`len(order) != len(expected)`, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Error(`order[i] != expected[i]`, order)
+		}
+	}
+
+	if err := cm.SetEvictionPolicy("unknown"); err == nil {
+		t.Error(`unknown policy should be an error`)
+	}
+}
+
+func TestStorageSaveStateAge(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := NewStorage(dir, 0)
+	if err := cm.SetEvictionPolicy(EvictionLFU); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a", "b"} {
+		err := cm.Insert([]byte{'x'}, &FileInfo{
+			path: p,
+			size: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cm.policy.(*lfuPolicy).age = 7
+	if err := cm.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	cm = NewStorage(dir, 0)
+	if err := cm.SetEvictionPolicy(EvictionLFU); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if cm.policy.(*lfuPolicy).age != 7 {
+		t.Error(`age is not restored`)
+	}
+	if cm.cache["a"].priority != 7 {
+		t.Error(`priority is not calculated with the restored age`)
+	}
+
+	// other policies ignore the age.
+	cm = NewStorage(dir, 0)
+	if err := cm.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Len() != 2 {
+		t.Error(`cm.Len() != 2`)
+	}
+}
+
+func TestStoragePinPatterns(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cm := NewStorage(dir, 3)
+	cm.diskUsage = logicalUsage
+	for _, p := range []string{"ubuntu/pool/main/l/linux/a.deb", "security/b.deb"} {
+		err := cm.Insert([]byte{'x', 'x'}, &FileInfo{
+			path: p,
+			size: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first item has been evicted.
+	if cm.Len() != 1 {
+		t.Error(`cm.Len() != 1`)
+	}
+
+	if err := cm.SetPinPatterns([]string{"ubuntu/pool/main/l/linux*", "security"}); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Len() != 0 {
+		t.Error(`cm.Len() != 0`)
+	}
+
+	err = cm.Insert([]byte{'x', 'x'}, &FileInfo{
+		path: "ubuntu/pool/main/l/linux/a.deb",
+		size: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := cm.Usage()
+	if u.Items != 2 || u.Pinned != 4 || u.Used != 0 {
+		t.Error(`wrong usage`, u)
+	}
+
+	// pinned by Pin even after patterns are removed.
+	cm.Pin("security/b.deb")
+	if err := cm.SetPinPatterns(nil); err != nil {
+		t.Fatal(err)
+	}
+	u = cm.Usage()
+	if u.Items != 2 || u.Pinned != 2 || u.Used != 2 {
+		t.Error(`wrong usage`, u)
+	}
+
+	if err := cm.SetPinPatterns([]string{"security"}); err != nil {
+		t.Fatal(err)
+	}
+	cm.Unpin("security/b.deb")
+	if cm.Delete("security/b.deb") != ErrPinned {
+		t.Error(`item pinned by patterns must not be deleted`)
+	}
+
+	if cm.SetPinPatterns([]string{"[a-"}) == nil {
+		t.Error(`invalid pattern must be an error`)
+	}
+}
+
+func TestStorageDiskUsage(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(fname, []byte{'a'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if itemDiskUsage(fname, st) != diskSize(st) {
+		t.Error(`itemDiskUsage(fname, st) != diskSize(st)`)
+	}
+
+	// sidecar files are counted.
+	if err := ioutil.WriteFile(fname+metaSuffix, make([]byte, 10000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mst, err := os.Stat(fname + metaSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if itemDiskUsage(fname, st) != diskSize(st)+diskSize(mst) {
+		t.Error(`sidecar file is not counted`)
+	}
+
+	// the capacity limits the disk usage rather than the size.
+	cdir := filepath.Join(dir, "cache")
+	if err := os.Mkdir(cdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cm := NewStorage(cdir, 250)
+	cm.diskUsage = func(fname string, st os.FileInfo) uint64 {
+		return uint64(st.Size()) + 100
+	}
+	for _, p := range []string{"a", "b", "c"} {
+		err := cm.Insert([]byte{'a'}, &FileInfo{
+			path: p,
+			size: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cm.Contains("a") {
+		t.Error(`a is not evicted`)
+	}
+	u := cm.Usage()
+	if u.Items != 2 || u.Used != 2 || u.UsedDisk != 202 {
+		t.Errorf(`wrong usage: %#v`, u)
+	}
+}
@@ -0,0 +1,220 @@
+package aptcacher
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path"
+	"sync"
+)
+
+// Item is a cached item returned by Store.LookupItem.
+type Item interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Usage represents the usage of a Store.
+type Usage struct {
+	// Items is the number of cached items.
+	Items int `json:"items"`
+
+	// Used is the total size of items subject to eviction.
+	Used uint64 `json:"used"`
+
+	// Pinned is the total size of pinned items.
+	Pinned uint64 `json:"pinned"`
+
+	// UsedDisk is the size of blocks allocated for items subject
+	// to eviction including their sidecar files.  Zero if unknown.
+	UsedDisk uint64 `json:"used_disk"`
+
+	// Capacity is the maximum of UsedDisk.  Zero means unlimited.
+	Capacity uint64 `json:"capacity"`
+
+	// Disk is the total size of blocks allocated for items
+	// including pinned ones.  Zero if unknown.
+	Disk uint64 `json:"disk"`
+}
+
+// Store is the interface for backends of cached items.
+//
+// Storage is the default implementation backed by a local file system.
+// All methods must be safe for concurrent use.
+type Store interface {
+	// Load loads items already stored in the backend, if any.
+	Load() error
+
+	// InsertItem inserts or updates an item read from r.
+	//
+	// fi describes the data read from r.  fi.Path() must be as clean
+	// as path.Clean() and must not be an absolute path.
+	InsertItem(r io.Reader, fi *FileInfo) error
+
+	// LookupItem looks up an item matching fi.
+	// If not found, ErrNotFound is returned.
+	//
+	// The caller is responsible to close the returned Item.
+	LookupItem(fi *FileInfo) (Item, error)
+
+	// Contains returns true if an item for p exists.
+	// Unlike LookupItem, this does not validate checksums.
+	Contains(p string) bool
+
+	// Delete deletes an item for p.  Deleting non-existing items
+	// is not an error.  Pinned items are not deleted, and
+	// ErrPinned is returned.
+	Delete(p string) error
+
+	// ListAll returns a list of FileInfo for all items.
+	ListAll() []*FileInfo
+
+	// Pin excludes an item for p from eviction.  Pins are counted
+	// for each p, and p need not exist at the time of the call.
+	Pin(p string)
+
+	// Unpin reverts Pin.
+	Unpin(p string)
+
+	// Usage returns the current usage.
+	Usage() Usage
+}
+
+// validItemPath returns true if p can be used as a path of an item.
+func validItemPath(p string) bool {
+	return p == path.Clean(p) && !path.IsAbs(p) && p != "."
+}
+
+// memoryItem implements Item.
+type memoryItem struct {
+	*bytes.Reader
+}
+
+func (memoryItem) Close() error {
+	return nil
+}
+
+// MemoryStore is a Store that keeps items in memory.
+//
+// Items are never evicted.  This is intended for tests and
+// small repositories.
+type MemoryStore struct {
+	mu    sync.Mutex
+	items map[string]*memoryEntry
+	pins  map[string]int
+}
+
+type memoryEntry struct {
+	fi   *FileInfo
+	data []byte
+}
+
+// NewMemoryStore creates a MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items: make(map[string]*memoryEntry),
+		pins:  make(map[string]int),
+	}
+}
+
+// Load implements Store.  It does nothing.
+func (ms *MemoryStore) Load() error {
+	return nil
+}
+
+// InsertItem implements Store.
+func (ms *MemoryStore) InsertItem(r io.Reader, fi *FileInfo) error {
+	if !validItemPath(fi.path) {
+		return ErrBadPath
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.items[fi.path] = &memoryEntry{fi, data}
+	return nil
+}
+
+// LookupItem implements Store.
+func (ms *MemoryStore) LookupItem(fi *FileInfo) (Item, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	e, ok := ms.items[fi.path]
+	if !ok || !fi.Same(e.fi) {
+		return nil, ErrNotFound
+	}
+	return memoryItem{bytes.NewReader(e.data)}, nil
+}
+
+// Contains implements Store.
+func (ms *MemoryStore) Contains(p string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	_, ok := ms.items[p]
+	return ok
+}
+
+// Delete implements Store.
+func (ms *MemoryStore) Delete(p string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.items[p]; ok && ms.pins[p] > 0 {
+		return ErrPinned
+	}
+	delete(ms.items, p)
+	return nil
+}
+
+// ListAll implements Store.
+func (ms *MemoryStore) ListAll() []*FileInfo {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	l := make([]*FileInfo, 0, len(ms.items))
+	for _, e := range ms.items {
+		l = append(l, e.fi)
+	}
+	return l
+}
+
+// Pin implements Store.
+func (ms *MemoryStore) Pin(p string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.pins[p]++
+}
+
+// Unpin implements Store.
+func (ms *MemoryStore) Unpin(p string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.pins[p] > 1 {
+		ms.pins[p]--
+		return
+	}
+	delete(ms.pins, p)
+}
+
+// Usage implements Store.
+func (ms *MemoryStore) Usage() Usage {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	u := Usage{Items: len(ms.items)}
+	for p, e := range ms.items {
+		if ms.pins[p] > 0 {
+			u.Pinned += e.fi.size
+		} else {
+			u.Used += e.fi.size
+		}
+	}
+	return u
+}
@@ -0,0 +1,93 @@
+package aptcacher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+var (
+	_ Store = (*Storage)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+func TestMemoryStore(t *testing.T) {
+	t.Parallel()
+
+	ms := NewMemoryStore()
+
+	data := []byte("hello")
+	fi := MakeFileInfo("path/to/hello", data)
+	if err := ms.InsertItem(bytes.NewReader(data), fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.InsertItem(bytes.NewReader(data), &FileInfo{path: "/abs"}); err != ErrBadPath {
+		t.Error(`/abs must be a bad path`)
+	}
+
+	if !ms.Contains("path/to/hello") {
+		t.Error(`!ms.Contains("path/to/hello")`)
+	}
+	item, err := ms.LookupItem(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(item)
+	item.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error(`!bytes.Equal(got, data)`)
+	}
+
+	_, err = ms.LookupItem(MakeFileInfo("path/to/hello", []byte("world")))
+	if err != ErrNotFound {
+		t.Error(`checksum mismatch must be ErrNotFound`)
+	}
+
+	ms.Pin("path/to/hello")
+	u := ms.Usage()
+	if u.Items != 1 || u.Pinned != 5 || u.Used != 0 {
+		t.Errorf("unexpected usage: %+v", u)
+	}
+	ms.Unpin("path/to/hello")
+	u = ms.Usage()
+	if u.Pinned != 0 || u.Used != 5 {
+		t.Errorf("unexpected usage: %+v", u)
+	}
+
+	if len(ms.ListAll()) != 1 {
+		t.Error(`len(ms.ListAll()) != 1`)
+	}
+	ms.Pin("path/to/hello")
+	if ms.Delete("path/to/hello") != ErrPinned {
+		t.Error(`pinned item must not be deleted`)
+	}
+	ms.Unpin("path/to/hello")
+	if err := ms.Delete("path/to/hello"); err != nil {
+		t.Fatal(err)
+	}
+	if ms.Contains("path/to/hello") {
+		t.Error(`ms.Contains("path/to/hello")`)
+	}
+}
+
+func TestItemFile(t *testing.T) {
+	t.Parallel()
+
+	data := []byte("hello")
+	f, err := itemFile(memoryItem{bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error(`!bytes.Equal(got, data)`)
+	}
+}
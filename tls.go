@@ -0,0 +1,185 @@
+package aptcacher
+
+// This file implements TLS configurations for the server.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultTLSReloadInterval = 60
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CertReloader keeps a certificate and reloads it from files.
+//
+// Connections already established are not affected by reloading.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	logger   *log.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads a certificate and its private key from
+// PEM encoded files, and returns a CertReloader.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   log.DefaultLogger(),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lastModified returns the latest modification time of the files.
+func (r *CertReloader) lastModified() (time.Time, error) {
+	var t time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		st, err := os.Stat(f)
+		if err != nil {
+			return t, err
+		}
+		if st.ModTime().After(t) {
+			t = st.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// Reload reloads the certificate.
+//
+// If the files are invalid, the current certificate is kept.
+func (r *CertReloader) Reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, r.certFile)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// SetLogger specifies the logger used by Watch.
+//
+// Default is log.DefaultLogger().  This must be called before Watch.
+func (r *CertReloader) SetLogger(logger *log.Logger) {
+	r.logger = logger
+}
+
+// GetCertificate can be used for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch reloads the certificate when the files are modified until
+// ctx.Done() is closed.  The files are checked every interval.
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		modTime, err := r.lastModified()
+		if err != nil {
+			r.logger.Warn("tls: failed to stat certificate", map[string]interface{}{
+				"_err": err.Error(),
+			})
+			continue
+		}
+		r.mu.RLock()
+		changed := !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			r.logger.Error("tls: failed to reload certificate", map[string]interface{}{
+				"_err": err.Error(),
+			})
+			continue
+		}
+		r.logger.Info("tls: certificate reloaded", map[string]interface{}{
+			"_cert": r.certFile,
+		})
+	}
+}
+
+// NewTLSConfig returns *tls.Config for a TLS listener, together with
+// CertReloader for the certificate.
+func NewTLSConfig(config *TLSConfig) (*tls.Config, *CertReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, nil, errors.New("cert_file and key_file must be specified")
+	}
+	r, err := NewCertReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tc := &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if config.MinVersion != "" {
+		v, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, nil, errors.New("unsupported min_version: " + config.MinVersion)
+		}
+		tc.MinVersion = v
+	}
+
+	if config.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, errors.New("no certificates in " + config.ClientCAFile)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, r, nil
+}
+
+// WatchInterval returns the interval to check certificate files.
+func (config *TLSConfig) WatchInterval() time.Duration {
+	if config.ReloadInterval == 0 {
+		return defaultTLSReloadInterval * time.Second
+	}
+	return time.Duration(config.ReloadInterval) * time.Second
+}
@@ -0,0 +1,121 @@
+package aptcacher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and its key.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serialOf(t *testing.T, r *CertReloader) int64 {
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x.SerialNumber.Int64()
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+
+	_, _, err = NewTLSConfig(&TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "0.9"})
+	if err == nil {
+		t.Error(`min_version 0.9 must be rejected`)
+	}
+	tc, _, err := NewTLSConfig(&TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.MinVersion != tls.VersionTLS13 {
+		t.Error(`tc.MinVersion != tls.VersionTLS13`)
+	}
+	_, _, err = NewTLSConfig(&TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile})
+	if err == nil {
+		t.Error(`client CA without certificates must be rejected`)
+	}
+
+	tc, r, err := NewTLSConfig(&TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.ClientCAs == nil {
+		t.Error(`tc.ClientCAs == nil`)
+	}
+	if serialOf(t, r) != 1 {
+		t.Error(`serialOf(t, r) != 1`)
+	}
+
+	writeTestCert(t, certFile, keyFile, 2)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if serialOf(t, r) != 2 {
+		t.Error(`serialOf(t, r) != 2`)
+	}
+
+	// broken files must not replace the current certificate.
+	if err := ioutil.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error(`broken key must be an error`)
+	}
+	if serialOf(t, r) != 2 {
+		t.Error(`certificate was replaced by broken files`)
+	}
+}
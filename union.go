@@ -0,0 +1,315 @@
+package aptcacher
+
+// This file implements union repositories that merge suites of
+// other mappings into one.
+//
+// Packages indices of a union are generated from Packages indices
+// of member suites, or their filtered views for filtered mappings.
+// Filename fields are rewritten to point files of the member mapping,
+// hence requests for pool files are served from the member mapping
+// with checksums validated and filters applied as usual.
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Precedence rules for packages found in multiple members.
+const (
+	PrecedenceFirst   = "first"
+	PrecedenceVersion = "version"
+)
+
+// unionMember is a suite merged into a union.
+type unionMember struct {
+	prefix string
+	suite  string
+}
+
+func (m unionMember) dir() string {
+	return path.Join(m.prefix, "dists", m.suite)
+}
+
+// union keeps the state of a union repository.
+type union struct {
+	prefix  string
+	config  *UnionConfig
+	signer  *signer
+	members []unionMember
+	trigger chan struct{}
+}
+
+func newUnion(prefix string, config *UnionConfig) (*union, error) {
+	if config.Codename == "" || strings.Contains(config.Codename, "/") {
+		return nil, errors.New("invalid codename: " + config.Codename)
+	}
+	if len(config.Components) == 0 {
+		config.Components = []string{"main"}
+	}
+	if len(config.Architectures) == 0 {
+		return nil, errors.New("no architectures")
+	}
+	switch config.Precedence {
+	case "":
+		config.Precedence = PrecedenceFirst
+	case PrecedenceFirst, PrecedenceVersion:
+	default:
+		return nil, errors.New("invalid precedence: " + config.Precedence)
+	}
+	if len(config.Members) == 0 {
+		return nil, errors.New("no members")
+	}
+
+	u := &union{
+		prefix:  prefix,
+		config:  config,
+		trigger: make(chan struct{}, 1),
+	}
+	for _, s := range config.Members {
+		t := strings.SplitN(s, "/", 2)
+		if len(t) != 2 || t[1] == "" {
+			return nil, errors.New("invalid member: " + s)
+		}
+		u.members = append(u.members, unionMember{t[0], t[1]})
+	}
+	if config.SigningKey != "" {
+		s, err := newSigner(config.SigningKey, config.SigningPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		u.signer = s
+	}
+	return u, nil
+}
+
+// notify requests regeneration of the union indices.
+func (u *union) notify() {
+	select {
+	case u.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// hasMember returns true if prefix is a member mapping of the union.
+func (u *union) hasMember(prefix string) bool {
+	for _, m := range u.members {
+		if m.prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSuite returns true if dir is the directory of a member suite
+// or its filtered view.
+func (u *union) hasSuite(dir string) bool {
+	for _, m := range u.members {
+		if m.dir() == dir || filteredPath(m.dir()) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// dir returns the path of the suite directory.
+func (u *union) dir() string {
+	return path.Join(u.prefix, "dists", u.config.Codename)
+}
+
+// mergePackages merges lists of paragraphs in Packages indices.
+//
+// lists are ordered by the member order.  Packages are identified
+// by their names and architectures.  If a package is found in
+// multiple members, the precedence rule decides which to keep:
+// PrecedenceFirst keeps packages of the first member, and
+// PrecedenceVersion keeps the one with the highest version.
+func mergePackages(lists [][]Paragraph, precedence string) []Paragraph {
+	owner := make(map[string]int)
+	selected := make(map[string][]Paragraph)
+	for i, l := range lists {
+		for _, d := range l {
+			key := d.get("Package") + "/" + d.get("Architecture")
+			o, ok := owner[key]
+			switch {
+			case !ok:
+				owner[key] = i
+				selected[key] = []Paragraph{d}
+			case precedence == PrecedenceFirst:
+				if o == i {
+					selected[key] = append(selected[key], d)
+				}
+			case CompareVersion(d.get("Version"), selected[key][0].get("Version")) > 0:
+				selected[key] = []Paragraph{d}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(selected))
+	for key := range selected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var merged []Paragraph
+	for _, key := range keys {
+		merged = append(merged, selected[key]...)
+	}
+	return merged
+}
+
+// memberDir returns the suite directory of a member to read indices.
+//
+// For filtered mappings, the filtered view is generated if needed
+// and its directory is returned.
+func (c *Cacher) memberDir(m unionMember) (string, error) {
+	f, ok := c.filters[m.prefix]
+	if !ok {
+		return m.dir(), nil
+	}
+	if err := c.generateView(f, m.dir()); err != nil {
+		return "", err
+	}
+	return filteredPath(m.dir()), nil
+}
+
+// memberPackages returns paragraphs in a Packages index of a member
+// with Filename rewritten to be relative to the union.
+//
+// dir is the suite directory returned by memberDir, and fil is
+// the list of files in Release in dir.
+// If the member does not have the index, nil is returned.
+func (c *Cacher) memberPackages(m unionMember, dir string, fil []*FileInfo, component, arch string) ([]Paragraph, error) {
+	p := path.Join(dir, packagesPath(component, arch))
+
+	var lastErr error
+	for _, fi := range fil {
+		if indexBase(fi.path) != "Packages" || path.Dir(fi.path) != path.Dir(p) || !IsSupported(fi.path) {
+			continue
+		}
+		// generated views are not downloaded.
+		if !isFilteredPath(fi.path) {
+			if err := c.fetch(fi.path); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+		f, err := c.meta.LookupItem(fi)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		l, err := readParagraphs(fi.path, f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, fi.path)
+		}
+
+		for i, d := range l {
+			d2 := make(Paragraph, len(d))
+			for k, v := range d {
+				d2[k] = v
+			}
+			d2["Filename"] = []string{path.Join(m.prefix, d.get("Filename"))}
+			l[i] = d2
+		}
+		return l, nil
+	}
+	return nil, lastErr
+}
+
+// syncUnion regenerates indices of a union from its members.
+//
+// If indices of some members are not available, the union is
+// not updated so that packages do not disappear temporarily.
+func (c *Cacher) syncUnion(u *union) error {
+	// lists[packagesPath][member index]
+	lists := make(map[string][][]Paragraph)
+	for _, component := range u.config.Components {
+		for _, arch := range u.config.Architectures {
+			lists[packagesPath(component, arch)] = make([][]Paragraph, len(u.members))
+		}
+	}
+
+	for i, m := range u.members {
+		for _, name := range []string{"InRelease", "Release"} {
+			// some of them may not exist.
+			c.fetch(path.Join(m.dir(), name))
+		}
+		dir, err := c.memberDir(m)
+		if err != nil {
+			return err
+		}
+		fil, err := c.releaseIndices(dir)
+		if err != nil {
+			return err
+		}
+		for _, component := range u.config.Components {
+			for _, arch := range u.config.Architectures {
+				l, err := c.memberPackages(m, dir, fil, component, arch)
+				if err != nil {
+					return err
+				}
+				lists[packagesPath(component, arch)][i] = l
+			}
+		}
+	}
+
+	var files []indexFile
+	for _, component := range u.config.Components {
+		for _, arch := range u.config.Architectures {
+			name := packagesPath(component, arch)
+			merged := mergePackages(lists[name], u.config.Precedence)
+			files = append(files, withGzip(name, writeIndex(merged, packagesOrder, nil))...)
+		}
+	}
+
+	fields := suiteFields(u.config.Codename, u.config.Origin, u.config.Label,
+		u.config.Components, u.config.Architectures)
+	return c.publishSuite(u.dir(), files, fields, u.signer)
+}
+
+// runUnion is a goroutine to keep a union up to date.
+//
+// Regeneration is triggered by updates of Release files of members.
+// If regeneration fails, it is retried after check interval.
+func (c *Cacher) runUnion(u *union) {
+	u.notify()
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-u.trigger:
+		case <-retry:
+		}
+
+		retry = nil
+		if err := c.syncUnion(u); err != nil {
+			c.logger.Warn("union: failed to regenerate indices", map[string]interface{}{
+				"_prefix": u.prefix,
+				"_err":    err.Error(),
+			})
+			retry = time.After(c.checkInterval)
+		}
+	}
+}
+
+// getUnion looks up an item in a union.
+//
+// Files of member mappings are looked up in the member mappings.
+func (c *Cacher) getUnion(ctx context.Context, u *union, p string) (*Result, error) {
+	t := strings.SplitN(p, "/", 3)
+	if len(t) == 3 && t[1] != "dists" && u.hasMember(t[1]) {
+		return c.GetContext(ctx, path.Join(t[1], t[2]))
+	}
+	if len(t) < 2 || t[1] != "dists" {
+		return &Result{Status: http.StatusNotFound}, nil
+	}
+	return c.getKnown(ctx, p)
+}
@@ -0,0 +1,75 @@
+package aptcacher
+
+import "testing"
+
+func TestMergePackages(t *testing.T) {
+	t.Parallel()
+
+	pkg := func(name, version, arch string) Paragraph {
+		return Paragraph{
+			"Package":      {name},
+			"Version":      {version},
+			"Architecture": {arch},
+		}
+	}
+	lists := [][]Paragraph{
+		{pkg("hoge", "1.0", "amd64"), pkg("hoge", "0.9", "amd64")},
+		{pkg("hoge", "2.0", "amd64"), pkg("hoge", "1.0", "all"), pkg("fuga", "1.0", "amd64")},
+	}
+
+	merged := mergePackages(lists, PrecedenceFirst)
+	if len(merged) != 4 {
+		t.Fatal(`len(merged) != 4`)
+	}
+	if merged[0].get("Package") != "fuga" {
+		t.Error(`merged[0].get("Package") != "fuga"`)
+	}
+	if merged[1].get("Architecture") != "all" {
+		t.Error(`merged[1].get("Architecture") != "all"`)
+	}
+	if merged[2].get("Version") != "1.0" || merged[3].get("Version") != "0.9" {
+		t.Error(`packages in the first member must be chosen`)
+	}
+
+	merged = mergePackages(lists, PrecedenceVersion)
+	if len(merged) != 3 {
+		t.Fatal(`len(merged) != 3`)
+	}
+	if merged[2].get("Version") != "2.0" {
+		t.Error(`merged[2].get("Version") != "2.0"`)
+	}
+}
+
+func TestNewUnion(t *testing.T) {
+	t.Parallel()
+
+	u, err := newUnion("all", &UnionConfig{
+		Codename:      "jammy",
+		Members:       []string{"internal/stable", "ubuntu/jammy-updates"},
+		Architectures: []string{"amd64"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.config.Precedence != PrecedenceFirst {
+		t.Error(`u.config.Precedence != PrecedenceFirst`)
+	}
+	if !u.hasMember("ubuntu") {
+		t.Error(`!u.hasMember("ubuntu")`)
+	}
+	if !u.hasSuite("ubuntu/dists/jammy-updates") {
+		t.Error(`!u.hasSuite("ubuntu/dists/jammy-updates")`)
+	}
+	if u.hasSuite("ubuntu/dists/jammy") {
+		t.Error(`u.hasSuite("ubuntu/dists/jammy")`)
+	}
+
+	_, err = newUnion("all", &UnionConfig{
+		Codename:      "jammy",
+		Members:       []string{"ubuntu"},
+		Architectures: []string{"amd64"},
+	})
+	if err == nil {
+		t.Error(`member without suite must be an error`)
+	}
+}
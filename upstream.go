@@ -0,0 +1,596 @@
+package aptcacher
+
+// This file implements settings to access upstream repositories.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/net/proxy"
+)
+
+// upstreamAuth is a set of credentials for an upstream repository.
+type upstreamAuth struct {
+	username string
+	password string
+	token    string
+}
+
+// set sets Authorization header of req.
+func (a *upstreamAuth) set(req *http.Request) {
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+		return
+	}
+	req.SetBasicAuth(a.username, a.password)
+}
+
+// readSecret reads a secret such as a password from a file.
+// Trailing newlines are removed.
+func readSecret(fname string) (string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// newUpstreamAuth returns credentials for u.
+//
+// The user information in u is removed not to be logged.
+// If no credentials are available, nil is returned.
+func newUpstreamAuth(u *url.URL, config *UpstreamConfig) (*upstreamAuth, error) {
+	userinfo := u.User
+	u.User = nil
+
+	if config.Token != "" || config.TokenFile != "" {
+		if config.Username != "" {
+			return nil, errors.New("both token and username are specified")
+		}
+		token := config.Token
+		if token == "" {
+			var err error
+			token, err = readSecret(config.TokenFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &upstreamAuth{token: token}, nil
+	}
+
+	if config.Username != "" {
+		password := config.Password
+		if password == "" && config.PasswordFile != "" {
+			var err error
+			password, err = readSecret(config.PasswordFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &upstreamAuth{username: config.Username, password: password}, nil
+	}
+
+	if userinfo != nil {
+		password, _ := userinfo.Password()
+		return &upstreamAuth{username: userinfo.Username(), password: password}, nil
+	}
+
+	if config.AuthFile != "" {
+		return readAuthFile(config.AuthFile, u)
+	}
+	return nil, nil
+}
+
+// readAuthFile reads a netrc or APT auth.conf file, and returns
+// credentials of the first entry matching u.
+//
+// Lines beginning with "#" are ignored.  "macdef" is not supported.
+func readAuthFile(fname string, u *url.URL) (*upstreamAuth, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	var a *upstreamAuth
+	matched := false
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine", "default":
+			if matched {
+				return a, nil
+			}
+			a = &upstreamAuth{}
+			if tokens[i] == "default" {
+				matched = true
+				continue
+			}
+			if i+1 == len(tokens) {
+				return nil, errors.New("no value for machine in " + fname)
+			}
+			i++
+			matched = matchMachine(tokens[i], u)
+		case "login", "password", "account":
+			if i+1 == len(tokens) {
+				return nil, errors.New("no value for " + tokens[i] + " in " + fname)
+			}
+			if a == nil {
+				return nil, errors.New(tokens[i] + " without machine in " + fname)
+			}
+			switch tokens[i] {
+			case "login":
+				a.username = tokens[i+1]
+			case "password":
+				a.password = tokens[i+1]
+			}
+			i++
+		}
+	}
+	if matched {
+		return a, nil
+	}
+	return nil, nil
+}
+
+// matchMachine returns true if machine in netrc or auth.conf
+// matches u.
+//
+// machine may have a scheme, a port, and a path such as
+// "https://example.com:8443/repo".
+func matchMachine(machine string, u *url.URL) bool {
+	if t := strings.SplitN(machine, "://", 2); len(t) == 2 {
+		if t[0] != u.Scheme {
+			return false
+		}
+		machine = t[1]
+	}
+
+	t := strings.SplitN(machine, "/", 2)
+	host := t[0]
+	if host != u.Host {
+		// machine without a port matches any ports.
+		h, _, err := net.SplitHostPort(u.Host)
+		if err != nil || host != h {
+			return false
+		}
+	}
+	if len(t) == 1 {
+		return true
+	}
+	return strings.HasPrefix(strings.TrimPrefix(u.Path, "/"), strings.TrimSuffix(t[1], "/"))
+}
+
+// authTransport is an http.RoundTripper that adds credentials to
+// requests for an upstream host.
+//
+// Credentials are not added to requests for other hosts, such as
+// redirected ones.
+type authTransport struct {
+	base   http.RoundTripper
+	scheme string
+	host   string
+	auth   *upstreamAuth
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != t.scheme || req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+
+	// RoundTrip must not modify req.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	t.auth.set(r)
+	return t.base.RoundTrip(r)
+}
+
+// CancelRequest is for HTTP clients of Go 1.6 to cancel requests.
+func (t *authTransport) CancelRequest(req *http.Request) {
+	cancelRequest(t.base, req)
+}
+
+func cancelRequest(rt http.RoundTripper, req *http.Request) {
+	type canceler interface {
+		CancelRequest(*http.Request)
+	}
+	if cr, ok := rt.(canceler); ok {
+		cr.CancelRequest(req)
+	}
+}
+
+// verifyPins returns a function for tls.Config.VerifyPeerCertificate
+// to check that one of public keys in the certificate chain matches
+// SPKI pins.
+//
+// As the check is done during TLS handshakes, nothing is sent to
+// servers without pinned keys.  Certificates are verified with CAs
+// before the check as usual.
+func verifyPins(pins map[string]bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		chains := verifiedChains
+		if len(chains) == 0 {
+			// InsecureSkipVerify is set.
+			var certs []*x509.Certificate
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+			chains = [][]*x509.Certificate{certs}
+		}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[string(sum[:])] {
+					return nil
+				}
+			}
+		}
+		return errors.New("no pinned public key")
+	}
+}
+
+// newUpstreamTLS returns a TLS configuration for an upstream.
+// If nothing is configured, nil is returned.
+func newUpstreamTLS(config *UpstreamConfig) (*tls.Config, error) {
+	var pins map[string]bool
+	if len(config.Pins) > 0 {
+		pins = make(map[string]bool)
+		for _, pin := range config.Pins {
+			if !strings.HasPrefix(pin, "sha256//") {
+				return nil, errors.New("invalid pin: " + pin)
+			}
+			sum, err := base64.StdEncoding.DecodeString(pin[len("sha256//"):])
+			if err != nil || len(sum) != sha256.Size {
+				return nil, errors.New("invalid pin: " + pin)
+			}
+			pins[string(sum)] = true
+		}
+	}
+
+	if config.CAFile == "" && config.CertFile == "" && config.KeyFile == "" &&
+		config.ServerName == "" && pins == nil {
+		return nil, nil
+	}
+
+	tc := &tls.Config{
+		ServerName: config.ServerName,
+	}
+	if pins != nil {
+		tc.VerifyPeerCertificate = verifyPins(pins)
+	}
+	if config.CAFile != "" {
+		data, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates in " + config.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, config.CertFile)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// upstreamProxy is a proxy to access upstreams.
+type upstreamProxy struct {
+	// nil means direct connections.
+	u *url.URL
+
+	noProxyAll   bool
+	noProxyHosts []string
+	noProxyNets  networkList
+}
+
+// newUpstreamProxy parses a proxy URL.
+//
+// proxy may be "direct" to disable proxies.
+func newUpstreamProxy(proxy string, noProxy []string) (*upstreamProxy, error) {
+	p := &upstreamProxy{}
+	for _, s := range noProxy {
+		switch {
+		case s == "*":
+			p.noProxyAll = true
+		case strings.Contains(s, "/"):
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, errors.Wrap(err, "no_proxy")
+			}
+			p.noProxyNets = append(p.noProxyNets, n)
+		case net.ParseIP(s) != nil:
+			nl, _ := parseNetworks([]string{s})
+			p.noProxyNets = append(p.noProxyNets, nl...)
+		default:
+			p.noProxyHosts = append(p.noProxyHosts, strings.ToLower(strings.TrimPrefix(s, ".")))
+		}
+	}
+
+	if proxy == "direct" {
+		return p, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "proxy")
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.New("unsupported proxy scheme: " + u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("no host in proxy URL")
+	}
+	p.u = u
+	return p, nil
+}
+
+// bypass returns true if addr should be accessed directly.
+//
+// addr is a host name or an IP address with an optional port.
+func (p *upstreamProxy) bypass(addr string) bool {
+	if p.u == nil || p.noProxyAll {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.noProxyNets.contains(ip)
+	}
+	host = strings.ToLower(host)
+	for _, h := range p.noProxyHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply configures t to use the proxy.
+func (p *upstreamProxy) apply(t *http.Transport) error {
+	t.Proxy = nil
+	if p.u == nil {
+		return nil
+	}
+
+	if p.u.Scheme != "socks5" {
+		// CONNECT is used for https upstreams by http.Transport.
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			if p.bypass(req.URL.Host) {
+				return nil, nil
+			}
+			return p.u, nil
+		}
+		return nil
+	}
+
+	direct := dialFunc(t.DialContext)
+	if direct == nil {
+		direct = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	d, err := proxy.FromURL(p.u, direct)
+	if err != nil {
+		return err
+	}
+	cd, ok := d.(contextDialer)
+	if !ok {
+		cd = dialFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.Dial(network, addr)
+		})
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if p.bypass(addr) {
+			return direct(ctx, network, addr)
+		}
+		return cd.DialContext(ctx, network, addr)
+	}
+	return nil
+}
+
+// contextDialer is implemented by dialers that can be canceled.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dialFunc implements proxy.Dialer and contextDialer.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// newTransport returns a new http.Transport that inherits settings
+// from base, with tc as its TLS configuration.  If p is not nil,
+// the proxy settings of base are replaced by p.
+//
+// base must be nil or *http.Transport.
+func newTransport(base http.RoundTripper, tc *tls.Config, p *upstreamProxy) (*http.Transport, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	bt, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.New("transport of the HTTP client is not *http.Transport")
+	}
+	dial := bt.DialContext
+	if dial == nil && bt.Dial != nil {
+		legacy := bt.Dial
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return legacy(network, addr)
+		}
+	}
+	t := &http.Transport{
+		Proxy:                 bt.Proxy,
+		DialContext:           dial,
+		TLSClientConfig:       tc,
+		TLSHandshakeTimeout:   bt.TLSHandshakeTimeout,
+		DisableKeepAlives:     bt.DisableKeepAlives,
+		DisableCompression:    bt.DisableCompression,
+		MaxIdleConns:          bt.MaxIdleConns,
+		MaxIdleConnsPerHost:   bt.MaxIdleConnsPerHost,
+		IdleConnTimeout:       bt.IdleConnTimeout,
+		ResponseHeaderTimeout: bt.ResponseHeaderTimeout,
+		ExpectContinueTimeout: bt.ExpectContinueTimeout,
+	}
+	if p != nil {
+		if err := p.apply(t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// upstreamFetchers returns fetchers for each prefix in um.
+//
+// Credentials are removed from URLs in um.
+func (c *Cacher) upstreamFetchers(um URLMap, cc *CacherConfig) (map[string]Fetcher, error) {
+	configs := cc.Upstream
+	for prefix := range configs {
+		if _, ok := um[prefix]; !ok {
+			return nil, errors.New("upstream for unknown prefix: " + prefix)
+		}
+	}
+
+	var global *upstreamProxy
+	var err error
+	if cc.Proxy != "" {
+		global, err = newUpstreamProxy(cc.Proxy, cc.NoProxy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fetchers := make(map[string]Fetcher)
+	for prefix, u := range um {
+		f, ok := c.fetchers[u.Scheme]
+		if !ok {
+			return nil, errors.New(prefix + ": unsupported scheme: " + u.Scheme)
+		}
+
+		config := configs[prefix]
+		if config == nil {
+			config = &UpstreamConfig{}
+		}
+		px := global
+		if config.Proxy != "" || (global != nil && config.NoProxy != nil) {
+			proxy := config.Proxy
+			if proxy == "" {
+				proxy = cc.Proxy
+			}
+			noProxy := cc.NoProxy
+			if config.NoProxy != nil {
+				noProxy = config.NoProxy
+			}
+			px, err = newUpstreamProxy(proxy, noProxy)
+			if err != nil {
+				return nil, errors.Wrap(err, "upstream."+prefix)
+			}
+		}
+		if config.Proxy == "" && u.Scheme != "http" && u.Scheme != "https" {
+			// the global proxy is only for HTTP upstreams.
+			px = nil
+		}
+		client, err := c.upstreamClient(u, config, px)
+		if err != nil {
+			return nil, errors.Wrap(err, "upstream."+prefix)
+		}
+		if client != nil {
+			if _, ok := f.(*HTTPFetcher); !ok {
+				return nil, errors.New("upstream." + prefix + ": settings need HTTPFetcher")
+			}
+			f = &HTTPFetcher{Client: client}
+		}
+		fetchers[prefix] = f
+	}
+	return fetchers, nil
+}
+
+// upstreamClient returns an HTTP client for u as configured.
+// px is the proxy for u, or nil to use the proxy of the default client.
+// If the default client can be used, nil is returned.
+func (c *Cacher) upstreamClient(u *url.URL, config *UpstreamConfig, px *upstreamProxy) (*http.Client, error) {
+	auth, err := newUpstreamAuth(u, config)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := newUpstreamTLS(config)
+	if err != nil {
+		return nil, err
+	}
+	if auth == nil && tc == nil && px == nil {
+		return nil, nil
+	}
+
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return nil, errors.New("settings for non-HTTP upstream")
+	case tc != nil && u.Scheme != "https":
+		return nil, errors.New("TLS settings for non-HTTPS upstream")
+	}
+
+	rt := c.client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if tc != nil || px != nil {
+		rt, err = newTransport(rt, tc, px)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if auth != nil {
+		rt = &authTransport{rt, u.Scheme, u.Host, auth}
+	}
+
+	client := *c.client
+	client.Transport = rt
+	return &client, nil
+}
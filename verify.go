@@ -0,0 +1,348 @@
+package aptcacher
+
+// This file implements an offline consistency check of storages.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cybozu-go/log"
+	"github.com/pkg/errors"
+)
+
+// VerifyReport is the result of Verify.
+//
+// Files are reported by their paths in the file system.
+type VerifyReport struct {
+	// Checked is the number of cached files examined.
+	Checked int `json:"checked"`
+
+	// TempFiles are temporary files left by interrupted writes.
+	// They have been removed.
+	TempFiles []string `json:"temp_files"`
+
+	// OrphanedSidecars are sidecar files whose cached files are
+	// missing.  They have been removed.
+	OrphanedSidecars []string `json:"orphaned_sidecars"`
+
+	// Broken are files that do not match the indices, or cannot
+	// be parsed.  They have been removed or quarantined.
+	Broken []string `json:"broken"`
+
+	// Unreferenced are files not referenced by any index.
+	// They are kept as they may become referenced later.
+	Unreferenced []string `json:"unreferenced"`
+}
+
+// WriteTo writes a human readable report to w.
+func (r *VerifyReport) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	printf := func(format string, args ...interface{}) error {
+		m, err := fmt.Fprintf(w, format, args...)
+		n += int64(m)
+		return err
+	}
+	if err := printf("checked %d files\n", r.Checked); err != nil {
+		return n, err
+	}
+	sections := []struct {
+		title string
+		files []string
+	}{
+		{"removed temporary files", r.TempFiles},
+		{"removed orphaned sidecar files", r.OrphanedSidecars},
+		{"broken files", r.Broken},
+		{"unreferenced files", r.Unreferenced},
+	}
+	for _, s := range sections {
+		if err := printf("%s: %d\n", s.title, len(s.files)); err != nil {
+			return n, err
+		}
+		for _, f := range s.files {
+			if err := printf("  %s\n", f); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// verifier keeps the state of Verify.
+type verifier struct {
+	report     *VerifyReport
+	quarantine string
+	logger     *log.Logger
+	unions     map[string]bool
+
+	// checksums of files listed in valid indices.
+	info map[string]*FileInfo
+}
+
+// isRootMeta returns true if p is a meta file not listed in any index.
+func isRootMeta(p string) bool {
+	switch path.Base(p) {
+	case "Release", "InRelease", "Release.gpg":
+		return true
+	}
+	return false
+}
+
+// itemPath returns the path of an item in cache directory for p
+// listed in an index.  See Cacher.itemPath.
+func (v *verifier) itemPath(p string) string {
+	if _, ok := snapshotName(p); ok {
+		return upstreamPath(p)
+	}
+	t := strings.SplitN(p, "/", 2)
+	if v.unions[t[0]] && len(t) == 2 {
+		return t[1]
+	}
+	return p
+}
+
+// walk removes temporary files and orphaned sidecar files in dir,
+// and returns paths of cached items in dir.
+func (v *verifier) walk(dir string) ([]string, error) {
+	var items []string
+	wf := func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), "_tmp") {
+			if err := os.Remove(fname); err != nil {
+				return err
+			}
+			v.report.TempFiles = append(v.report.TempFiles, fname)
+			return nil
+		}
+		if strings.HasSuffix(fname, fileSuffix+metaSuffix) {
+			_, err := os.Stat(strings.TrimSuffix(fname, metaSuffix))
+			switch {
+			case os.IsNotExist(err):
+				if err := os.Remove(fname); err != nil {
+					return err
+				}
+				v.report.OrphanedSidecars = append(v.report.OrphanedSidecars, fname)
+			case err != nil:
+				return err
+			}
+			return nil
+		}
+		if filepath.Ext(fname) != fileSuffix {
+			return nil
+		}
+		subpath, err := filepath.Rel(dir, fname)
+		if err != nil {
+			return err
+		}
+		items = append(items, filepath.ToSlash(subpath[:len(subpath)-len(fileSuffix)]))
+		return nil
+	}
+	if err := filepath.Walk(dir, wf); err != nil {
+		return nil, err
+	}
+	sort.Strings(items)
+	return items, nil
+}
+
+// broken removes or quarantines a broken file.
+//
+// name is "meta" or "cache", and is used as the directory name
+// in the quarantine directory.
+func (v *verifier) broken(name, dir, p string) error {
+	fname := filepath.Join(dir, p+fileSuffix)
+	v.report.Broken = append(v.report.Broken, fname)
+	v.logger.Warn("broken file", map[string]interface{}{
+		"_path": fname,
+	})
+	if v.quarantine == "" {
+		return removeItemFile(fname)
+	}
+
+	dest := filepath.Join(v.quarantine, name, p+fileSuffix)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return moveItemFile(fname, dest)
+}
+
+// verifyMeta checks files in meta directory, and collects checksums
+// of files listed in valid indices.
+//
+// As indices are listed in Release files, and files are listed
+// in indices, files are examined from Release files until no more
+// files can be validated.
+func (v *verifier) verifyMeta(dir string) error {
+	items, err := v.walk(dir)
+	if err != nil {
+		return err
+	}
+
+	pending := make(map[string]bool)
+	for _, p := range items {
+		pending[p] = true
+	}
+
+	for {
+		progress := false
+		for _, p := range items {
+			if !pending[p] {
+				continue
+			}
+			valid, listed := v.info[p]
+			if !listed && !isRootMeta(p) {
+				continue
+			}
+			delete(pending, p)
+			progress = true
+			v.report.Checked++
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, p+fileSuffix))
+			if err != nil {
+				return err
+			}
+			ok := len(data) > 0
+			if listed {
+				ok = valid.Same(MakeFileInfo(p, data))
+			}
+			var fil []*FileInfo
+			if ok && IsMeta(p) && IsSupported(p) {
+				fil, err = ExtractFileInfo(p, bytes.NewReader(data))
+				ok = err == nil
+			}
+			if !ok {
+				if err := v.broken("meta", dir, p); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, fi := range fil {
+				v.info[fi.path] = fi
+			}
+		}
+		if !progress {
+			break
+		}
+	}
+
+	for _, p := range items {
+		if pending[p] {
+			v.report.Unreferenced = append(v.report.Unreferenced, filepath.Join(dir, p+fileSuffix))
+		}
+	}
+	return nil
+}
+
+// verifyItems checks files in cache directory.
+func (v *verifier) verifyItems(dir string) error {
+	items, err := v.walk(dir)
+	if err != nil {
+		return err
+	}
+
+	valid := make(map[string][]*FileInfo)
+	for p, fi := range v.info {
+		ip := v.itemPath(p)
+		valid[ip] = append(valid[ip], fi.withPath(ip))
+	}
+
+	for _, p := range items {
+		v.report.Checked++
+		fi, err := fileInfo(p, filepath.Join(dir, p+fileSuffix))
+		if err != nil {
+			return err
+		}
+
+		l, listed := valid[p]
+		ok := fi.size > 0
+		if listed {
+			// the same file may be listed in different versions
+			// of indices such as snapshots.
+			ok = false
+			for _, fi2 := range l {
+				if fi2.Same(fi) {
+					ok = true
+					break
+				}
+			}
+		}
+		if !ok {
+			if err := v.broken("cache", dir, p); err != nil {
+				return err
+			}
+			continue
+		}
+		if !listed {
+			v.report.Unreferenced = append(v.report.Unreferenced, filepath.Join(dir, p+fileSuffix))
+		}
+	}
+	return nil
+}
+
+// Verify checks the consistency of MetaDirectory and CacheDirectory
+// of config.  This must not be called while Cacher is using them.
+//
+// Temporary files left by interrupted writes and sidecar files
+// without cached files are removed.  Cached files are checked
+// against checksums in cached indices, and broken ones are moved
+// to QuarantineDirectory, or removed if it is not configured.
+// Empty files not listed in indices are also considered broken.
+func Verify(config *CacherConfig) (*VerifyReport, error) {
+	return verify(config, log.DefaultLogger())
+}
+
+// verify is Verify that logs with logger.
+func verify(config *CacherConfig, logger *log.Logger) (*VerifyReport, error) {
+	metaDir := filepath.Clean(config.MetaDirectory)
+	cacheDir := filepath.Clean(config.CacheDirectory)
+	if !filepath.IsAbs(metaDir) || !filepath.IsAbs(cacheDir) {
+		return nil, errors.New("meta_dir and cache_dir must be absolute paths")
+	}
+
+	var quarantine string
+	if config.QuarantineDirectory != "" {
+		quarantine = filepath.Clean(config.QuarantineDirectory)
+		for _, dir := range []string{metaDir, cacheDir} {
+			if quarantine == dir || strings.HasPrefix(quarantine, dir+string(filepath.Separator)) {
+				return nil, errors.New("quarantine_dir must be outside of meta_dir and cache_dir")
+			}
+		}
+	}
+
+	v := &verifier{
+		report:     &VerifyReport{},
+		quarantine: quarantine,
+		logger:     logger,
+		unions:     make(map[string]bool),
+		info:       make(map[string]*FileInfo),
+	}
+	for prefix := range config.Union {
+		v.unions[prefix] = true
+	}
+
+	if err := v.verifyMeta(metaDir); err != nil {
+		return nil, errors.Wrap(err, "meta_dir")
+	}
+	if err := v.verifyItems(cacheDir); err != nil {
+		return nil, errors.Wrap(err, "cache_dir")
+	}
+
+	v.logger.Info("verified storages", map[string]interface{}{
+		"_checked":           v.report.Checked,
+		"_temp_files":        len(v.report.TempFiles),
+		"_orphaned_sidecars": len(v.report.OrphanedSidecars),
+		"_broken":            len(v.report.Broken),
+		"_unreferenced":      len(v.report.Unreferenced),
+	})
+	return v.report, nil
+}
@@ -0,0 +1,138 @@
+package aptcacher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	root, err := ioutil.TempDir("", "gotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	metaDir := filepath.Join(root, "meta")
+	cacheDir := filepath.Join(root, "cache")
+	quarantine := filepath.Join(root, "quarantine")
+
+	write := func(dir, p string, data []byte) {
+		fname := filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sha256hex := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	deb := []byte("good deb")
+	packages := []byte(fmt.Sprintf(`Package: a
+Version: 1.0
+Architecture: amd64
+Filename: pool/a.deb
+Size: %d
+SHA256: %s
+
+Package: b
+Version: 1.0
+Architecture: amd64
+Filename: pool/b.deb
+Size: 5
+SHA256: %s
+`, len(deb), sha256hex(deb), sha256hex([]byte("bbbbb"))))
+	release := []byte(fmt.Sprintf(`Suite: stable
+SHA256:
+ %s %d main/binary-amd64/Packages
+`, sha256hex(packages), len(packages)))
+
+	write(metaDir, "ubuntu/dists/stable/Release"+fileSuffix, release)
+	write(metaDir, "ubuntu/dists/stable/main/binary-amd64/Packages"+fileSuffix, packages)
+	write(metaDir, "ubuntu/dists/stable/main/binary-i386/Packages"+fileSuffix, []byte("stale"))
+	write(metaDir, "ubuntu/dists/old/InRelease"+fileSuffix, nil)
+	write(metaDir, "_tmp123", []byte("partial"))
+
+	write(cacheDir, "ubuntu/pool/a.deb"+fileSuffix, deb)
+	write(cacheDir, "ubuntu/pool/b.deb"+fileSuffix, []byte("BBBBB"))
+	write(cacheDir, "ubuntu/pool/c.deb"+fileSuffix, []byte("unknown"))
+	write(cacheDir, "ubuntu/pool/d.deb"+fileSuffix, nil)
+	write(cacheDir, "_tmp456", []byte("partial"))
+	write(cacheDir, "ubuntu/pool/a.deb"+fileSuffix+metaSuffix, []byte("{}"))
+	write(cacheDir, "ubuntu/pool/e.deb"+fileSuffix+metaSuffix, []byte("{}"))
+
+	config := &CacherConfig{
+		MetaDirectory:       metaDir,
+		CacheDirectory:      cacheDir,
+		QuarantineDirectory: quarantine,
+	}
+	report, err := Verify(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Checked != 7 {
+		t.Error(`report.Checked != 7`, report.Checked)
+	}
+	if len(report.TempFiles) != 2 {
+		t.Error(`len(report.TempFiles) != 2`, report.TempFiles)
+	}
+	expectedOrphaned := []string{
+		filepath.Join(cacheDir, "ubuntu/pool/e.deb"+fileSuffix+metaSuffix),
+	}
+	if fmt.Sprint(report.OrphanedSidecars) != fmt.Sprint(expectedOrphaned) {
+		t.Error(`wrong orphaned sidecar files`, report.OrphanedSidecars)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "ubuntu/pool/a.deb"+fileSuffix+metaSuffix)); err != nil {
+		t.Error(`sidecar file of an existing file is removed`)
+	}
+	expectedBroken := []string{
+		filepath.Join(metaDir, "ubuntu/dists/old/InRelease"+fileSuffix),
+		filepath.Join(cacheDir, "ubuntu/pool/b.deb"+fileSuffix),
+		filepath.Join(cacheDir, "ubuntu/pool/d.deb"+fileSuffix),
+	}
+	if fmt.Sprint(report.Broken) != fmt.Sprint(expectedBroken) {
+		t.Error(`wrong broken files`, report.Broken)
+	}
+	expectedUnreferenced := []string{
+		filepath.Join(metaDir, "ubuntu/dists/stable/main/binary-i386/Packages"+fileSuffix),
+		filepath.Join(cacheDir, "ubuntu/pool/c.deb"+fileSuffix),
+	}
+	if fmt.Sprint(report.Unreferenced) != fmt.Sprint(expectedUnreferenced) {
+		t.Error(`wrong unreferenced files`, report.Unreferenced)
+	}
+
+	if _, err := os.Stat(filepath.Join(quarantine, "cache/ubuntu/pool/b.deb"+fileSuffix)); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "ubuntu/pool/b.deb"+fileSuffix)); !os.IsNotExist(err) {
+		t.Error(`broken file is not removed`)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "ubuntu/pool/a.deb"+fileSuffix)); err != nil {
+		t.Error(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := report.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("broken files: 3\n")) {
+		t.Error(`wrong report`, buf.String())
+	}
+
+	config.QuarantineDirectory = filepath.Join(cacheDir, "q")
+	if _, err := Verify(config); err == nil {
+		t.Error(`quarantine_dir in cache_dir must be an error`)
+	}
+}
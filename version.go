@@ -0,0 +1,109 @@
+package aptcacher
+
+// This file implements comparison of Debian package versions.
+//
+// The algorithm is described in Debian policy 5.6.12:
+// https://www.debian.org/doc/debian-policy/ch-controlfields.html#s-f-Version
+
+import (
+	"strconv"
+	"strings"
+)
+
+// splitVersion splits a version string into epoch, upstream version
+// and debian revision.
+func splitVersion(v string) (epoch int, upstream, revision string) {
+	if i := strings.IndexByte(v, ':'); i >= 0 {
+		epoch, _ = strconv.Atoi(v[:i])
+		v = v[i+1:]
+	}
+	if i := strings.LastIndexByte(v, '-'); i >= 0 {
+		return epoch, v[:i], v[i+1:]
+	}
+	return epoch, v, ""
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// order returns the sort weight of a character in non-digit parts.
+// c == 0 means the end of the string.
+func order(c byte) int {
+	switch {
+	case c == 0, isDigit(c):
+		return 0
+	case isAlpha(c):
+		return int(c)
+	case c == '~':
+		return -1
+	}
+	return int(c) + 256
+}
+
+// compareFragment compares upstream versions or debian revisions.
+func compareFragment(a, b string) int {
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac := order(at(a, i))
+			bc := order(at(b, j))
+			if ac != bc {
+				return ac - bc
+			}
+			i++
+			j++
+		}
+		for at(a, i) == '0' {
+			i++
+		}
+		for at(b, j) == '0' {
+			j++
+		}
+		firstDiff := 0
+		for isDigit(at(a, i)) && isDigit(at(b, j)) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if isDigit(at(a, i)) {
+			return 1
+		}
+		if isDigit(at(b, j)) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return firstDiff
+		}
+	}
+	return 0
+}
+
+// CompareVersion compares two Debian package versions.
+//
+// The result is negative if a is older than b, positive if a is
+// newer than b, or zero if they are the same.
+func CompareVersion(a, b string) int {
+	ae, au, ar := splitVersion(a)
+	be, bu, br := splitVersion(b)
+	if ae != be {
+		return ae - be
+	}
+	if n := compareFragment(au, bu); n != 0 {
+		return n
+	}
+	return compareFragment(ar, br)
+}
@@ -0,0 +1,36 @@
+package aptcacher
+
+import "testing"
+
+func TestCompareVersion(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		a, b string
+		sign int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.0-0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-1ubuntu1", "1.0-1", 1},
+		{"1:0.9", "2.0", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0a", "1.0", 1},
+		{"1.0+b1", "1.0a", 1},
+		{"1.1.1f-1ubuntu2.19", "1.1.1f-1ubuntu2.20", -1},
+		{"2.35-0ubuntu3.1", "2.35-0ubuntu3", 1},
+	}
+
+	for _, c := range cases {
+		n := CompareVersion(c.a, c.b)
+		switch {
+		case c.sign < 0 && n >= 0,
+			c.sign > 0 && n <= 0,
+			c.sign == 0 && n != 0:
+			t.Errorf("CompareVersion(%q, %q) = %d", c.a, c.b, n)
+		}
+	}
+}
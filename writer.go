@@ -0,0 +1,92 @@
+package aptcacher
+
+// This file implements a debian control file writer.
+//
+// Writer is the counterpart of Parser.  As Parser strips newlines
+// and leading spaces from multiline fields, Writer writes values
+// other than the first one as continuation lines.
+
+import (
+	"bufio"
+	"io"
+	"sort"
+)
+
+// Writer writes Paragraph in debian control file format.
+type Writer struct {
+	w     *bufio.Writer
+	order []string
+	lists map[string]bool
+	n     int
+}
+
+// NewWriter creates a writer for w.
+//
+// Fields listed in order are written first in the order, then other
+// fields are written in lexical order.
+//
+// Fields listed in lists are written as multiline fields whose first
+// line is empty, such as SHA256 in Release files or Files in Sources
+// files.
+func NewWriter(w io.Writer, order, lists []string) *Writer {
+	m := make(map[string]bool)
+	for _, f := range lists {
+		m[f] = true
+	}
+	return &Writer{
+		w:     bufio.NewWriter(w),
+		order: order,
+		lists: m,
+	}
+}
+
+func (w *Writer) writeField(k string, v []string) {
+	if len(v) == 0 {
+		return
+	}
+
+	w.w.WriteString(k)
+	w.w.WriteByte(':')
+	if !w.lists[k] {
+		w.w.WriteByte(' ')
+		w.w.WriteString(v[0])
+		v = v[1:]
+	}
+	w.w.WriteByte('\n')
+	for _, l := range v {
+		w.w.WriteByte(' ')
+		w.w.WriteString(l)
+		w.w.WriteByte('\n')
+	}
+}
+
+// Write writes a paragraph.
+//
+// Paragraphs are separated by an empty line.
+func (w *Writer) Write(d Paragraph) error {
+	if w.n > 0 {
+		w.w.WriteByte('\n')
+	}
+	w.n++
+
+	written := make(map[string]bool)
+	for _, k := range w.order {
+		if v, ok := d[k]; ok {
+			w.writeField(k, v)
+			written[k] = true
+		}
+	}
+
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		if !written[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w.writeField(k, d[k])
+	}
+
+	return w.w.Flush()
+}
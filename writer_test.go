@@ -0,0 +1,96 @@
+package aptcacher
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	t.Parallel()
+
+	d := Paragraph{
+		"Package":     {"hoge"},
+		"Version":     {"1.0-1"},
+		"Zzz":         {"last"},
+		"Aaa":         {"first"},
+		"Description": {"short", "long line 1", ".", "long line 2"},
+		"SHA256":      {"abc 10 main/Packages", "def 20 main/Packages.gz"},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, []string{"Package", "Version"}, []string{"SHA256"})
+	if err := w.Write(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(Paragraph{"Package": {"fuga"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `Package: hoge
+Version: 1.0-1
+Aaa: first
+Description: short
+ long line 1
+ .
+ long line 2
+SHA256:
+ abc 10 main/Packages
+ def 20 main/Packages.gz
+Zzz: last
+
+Package: fuga
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	p := NewParser(&buf)
+	d2, err := p.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, d2) {
+		t.Errorf("%#v != %#v", d, d2)
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("t/Packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var l []Paragraph
+	p := NewParser(f)
+	for {
+		d, err := p.Read()
+		if err != nil {
+			break
+		}
+		l = append(l, d)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, nil, nil)
+	for _, d := range l {
+		if err := w.Write(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p = NewParser(&buf)
+	for _, d := range l {
+		d2, err := p.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(d, d2) {
+			t.Errorf("%#v != %#v", d, d2)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package aptcacher
+
+import (
+	"syscall"
+)
+
+// setXattr sets an extended attribute of a file.
+func setXattr(fname, name string, data []byte) error {
+	return syscall.Setxattr(fname, name, data, 0)
+}
+
+// getXattr returns an extended attribute of a file.
+func getXattr(fname, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(fname, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	size, err = syscall.Getxattr(fname, name, data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:size], nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package aptcacher
+
+import (
+	"github.com/pkg/errors"
+)
+
+var errNoXattr = errors.New("extended attributes are not supported on this platform")
+
+// setXattr sets an extended attribute of a file.
+func setXattr(fname, name string, data []byte) error {
+	return errNoXattr
+}
+
+// getXattr returns an extended attribute of a file.
+func getXattr(fname, name string) ([]byte, error) {
+	return nil, errNoXattr
+}